@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -10,57 +12,289 @@ import (
 	"github.com/nduyphuong/reverse-registry/config"
 	"github.com/nduyphuong/reverse-registry/handler"
 	"github.com/nduyphuong/reverse-registry/inject"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/nduyphuong/reverse-registry/services/blobcache"
 	digestfetcher "github.com/nduyphuong/reverse-registry/services/digest-fetcher"
+	"github.com/nduyphuong/reverse-registry/services/externalurl"
+	"github.com/nduyphuong/reverse-registry/services/logging"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/notifier"
+	"github.com/nduyphuong/reverse-registry/services/ratelimit"
+	"github.com/nduyphuong/reverse-registry/services/responsecache"
+	"github.com/nduyphuong/reverse-registry/services/tlsconfig"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
 	"github.com/nduyphuong/reverse-registry/utils"
 	"github.com/sirupsen/logrus"
 )
 
+// CheckSharedDB refuses configurations the api and fetcher can not share
+// when they run as separate processes: the sqlite database is in memory,
+// each process would have its own.
+func CheckSharedDB(conf config.Config) error {
+	if conf.DB != "mysql" {
+		return fmt.Errorf("db %q is in memory and can not be shared between processes, run both roles with server or use db: mysql", conf.DB)
+	}
+	return nil
+}
+
 func RunAPI(conf config.Config) error {
-	router := gin.Default()
-	log := logrus.New()
-	storage, err := inject.GetStorage(conf)
+	router := gin.New()
+	router.Use(gin.Recovery())
+	log, err := logging.New(conf.Logging)
+	if err != nil {
+		return err
+	}
+	redaction := utils.NewRedactionPolicy(conf.Logging.RedactHeaders)
+	// Client IPs, used by the access log and rate limits, are only taken
+	// from X-Forwarded-For when a trusted proxy sets it.
+	if err := router.SetTrustedProxies(conf.API.TrustedProxies); err != nil {
+		return err
+	}
+	baseURL, err := externalurl.New(externalurl.Options{PublicURL: conf.API.PublicURL, TrustedProxies: conf.API.TrustedProxies})
+	if err != nil {
+		return err
+	}
+	if _, err := tracing.Setup(conf.Tracing); err != nil {
+		return err
+	}
+	storage, err := inject.GetStorage(conf.ForRole(conf.API))
+	if err != nil {
+		return err
+	}
+	registryClient, err := inject.GetContainerRegistryClient(conf)
+	if err != nil {
+		return err
+	}
+	refresh, err := inject.GetRefreshStorage(conf.ForRole(conf.API))
+	if err != nil {
+		return err
+	}
+	upstreamClient, err := inject.GetUpstream(conf)
+	if err != nil {
+		return err
+	}
+	artifacts, err := inject.GetArtifactStorage(conf.ForRole(conf.API))
 	if err != nil {
 		return err
 	}
-	registryClient, err := inject.GetContainerRegistryClient()
+	var conversions repository.ConversionInterface
+	if conf.ManifestConversion.Enabled {
+		if conversions, err = inject.GetConversionStorage(conf.ForRole(conf.API)); err != nil {
+			return err
+		}
+	}
+	var (
+		authenticator auth.Interface
+		tokens        auth.TokenService
+	)
+	if conf.Auth.ClientCertificates && conf.API.TLS.ClientCAFile == "" {
+		return fmt.Errorf("auth.clientCertificates needs api.tls.clientCAFile")
+	}
+	if conf.Auth.TokenService.Enabled && !conf.Auth.Enabled() {
+		return fmt.Errorf("auth.tokenService needs auth.htpasswd, auth.tokens, auth.oidc or auth.clientCertificates")
+	}
+	if conf.Auth.Enabled() {
+		if authenticator, err = auth.New(auth.Options{Config: conf.Auth, Log: log}); err != nil {
+			return err
+		}
+		if conf.Auth.TokenService.Enabled {
+			tokens, err = auth.NewTokenService(auth.TokenOptions{Config: conf.Auth.TokenService, Log: log})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	policy, err := newAuthz(conf, log)
+	if err != nil {
+		return err
+	}
+	upstreamTransport, err := inject.GetUpstreamTransport(conf)
 	if err != nil {
 		return err
 	}
+	upstreamHTTPClient, err := inject.GetUpstreamClient(conf)
+	if err != nil {
+		return err
+	}
+	var manifests repository.ManifestInterface
+	if conf.Offline.Enabled {
+		if manifests, err = inject.GetManifestStorage(conf.ForRole(conf.API)); err != nil {
+			return err
+		}
+	}
+	var blobs blobcache.Interface
+	if conf.BlobCache.Dir != "" {
+		if blobs, err = blobcache.New(blobcache.Options{Config: conf.BlobCache, Log: log}); err != nil {
+			return err
+		}
+	}
+	var responses responsecache.Interface
+	if conf.ResponseCache.Enabled() {
+		if responses, err = responsecache.New(responsecache.Options{Config: conf.ResponseCache}); err != nil {
+			return err
+		}
+	}
 	handlerFactory := handler.New(handler.Options{
-		Log:     log,
-		Cr:      registryClient,
-		Storage: storage,
+		Log:           log,
+		Cr:            registryClient,
+		Storage:       storage,
+		Refresh:       refresh,
+		Images:        conf.Images,
+		WebhookToken:  conf.Webhooks.Token,
+		Redaction:     redaction,
+		LocalAuth:     conf.Auth.Enabled(),
+		Tokens:        tokens,
+		Upstream:      upstreamClient,
+		Authz:         policy,
+		Transport:     upstreamTransport,
+		BlobCache:     blobs,
+		Manifests:     manifests,
+		Circuits:      upstreamHTTPClient.Circuits,
+		ResponseCache: responses,
+		Convert:       conf.ManifestConversion.Enabled,
+		Conversions:   conversions,
+		Artifacts:     artifacts,
 	})
 
-	router.Use(gin.WrapF(func(resp http.ResponseWriter, req *http.Request) {
-		log.WithFields(logrus.Fields{
-			"method": req.Method,
-			"url":    req.URL.String(),
-			"header": utils.Redact(req.Header),
-		}).Info("app got request")
-	}))
-	router.Any("/v2", handlerFactory.V2Handler)
-	router.Any("/v2/", handlerFactory.V2Handler)
-	router.Any("/token", handlerFactory.TokenHandler)
-	router.Any("/token/", handlerFactory.TokenHandler)
-	router.Any("/v2/:repo/*rest", handlerFactory.ProxyHandler)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9090"
+	router.Use(logging.RequestID())
+	router.Use(externalurl.Middleware(baseURL))
+	router.Use(tracing.Middleware())
+	router.Use(logging.AccessLog(redaction))
+	router.Use(metrics.Middleware())
+	router.Use(func(ctx *gin.Context) {
+		logging.FromContext(ctx.Request.Context(), log).WithFields(logrus.Fields{
+			"method": ctx.Request.Method,
+			"url":    redaction.URL(ctx.Request.URL),
+			"header": redaction.Header(ctx.Request.Header),
+		}).Debug("app got request")
+	})
+	// With the token service clients trade their credentials for a token
+	// on /token and present it on /v2, otherwise they send credentials on
+	// every request.
+	registry := router.Group("")
+	token := router.Group("")
+	switch {
+	case tokens != nil:
+		registry.Use(auth.TokenMiddleware(tokens, authenticator))
+		token.Use(auth.Middleware(authenticator))
+	case authenticator != nil:
+		registry.Use(auth.Middleware(authenticator))
+		token.Use(auth.Middleware(authenticator))
+	}
+	if conf.RateLimit.Manifest.PerSecond > 0 || conf.RateLimit.Blob.PerSecond > 0 || len(conf.RateLimit.Overrides) > 0 {
+		limiter, err := ratelimit.New(ratelimit.Options{Config: conf.RateLimit})
+		if err != nil {
+			return err
+		}
+		registry.Use(ratelimit.Middleware(limiter))
 	}
-	if err := router.Run(fmt.Sprintf(":%s", port)); err != nil {
+	registry.Any("/v2", handlerFactory.V2Handler)
+	// Repository names have any number of components, the handler parses
+	// the path itself.
+	registry.Any("/v2/*path", func(ctx *gin.Context) {
+		switch ctx.Param("path") {
+		case "/":
+			handlerFactory.V2Handler(ctx)
+		case "/_catalog":
+			handlerFactory.CatalogHandler(ctx)
+		default:
+			handlerFactory.ProxyHandler(ctx)
+		}
+	})
+	token.Any("/token", handlerFactory.TokenHandler)
+	token.Any("/token/", handlerFactory.TokenHandler)
+	admin := router.Group("")
+	if authenticator != nil {
+		admin.Use(auth.Identify(authenticator))
+	}
+	admin.POST("/api/v1/images/*path", handlerFactory.RefreshHandler)
+	registry.GET("/api/v1/images/*path", handlerFactory.ArtifactHandler)
+	router.GET("/api/v1/status", handlerFactory.StatusHandler)
+	router.POST("/api/v1/webhooks/distribution", handlerFactory.DistributionWebhookHandler)
+	router.POST("/api/v1/webhooks/harbor", handlerFactory.HarborWebhookHandler)
+	router.POST("/api/v1/webhooks/dockerhub", handlerFactory.DockerHubWebhookHandler)
+	if err := serveMetrics(router, conf.API.MetricsAddr, log); err != nil {
+		return err
+	}
+	if err := serve(router, apiListenAddr(conf.API), conf.API.TLS, log); err != nil {
 		return err
 	}
 	return nil
 }
 
+// serve runs router on addr, over https when conf has a certificate.
+func serve(router *gin.Engine, addr string, conf config.TLS, log *logrus.Logger) error {
+	if !conf.Enabled() {
+		return router.Run(addr)
+	}
+	certs, err := tlsconfig.New(tlsconfig.Options{Config: conf, Log: log})
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           router,
+		TLSConfig:         certs.Config(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.Infof("listening and serving HTTPS on %s", addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// newAuthz returns the access rules of conf, nil when there are none.
+func newAuthz(conf config.Config, log *logrus.Logger) (authz.Interface, error) {
+	if !conf.Authz.Enabled() {
+		return nil, nil
+	}
+	if !conf.Auth.Enabled() {
+		return nil, fmt.Errorf("authz needs auth.htpasswd, auth.tokens, auth.oidc or auth.clientCertificates")
+	}
+	opt := authz.Options{Config: conf.Authz, Log: log}
+	if conf.Authz.DB {
+		rules, err := inject.GetAccessRuleStorage(conf.ForRole(conf.API))
+		if err != nil {
+			return nil, err
+		}
+		opt.Storage = rules
+	}
+	if conf.Authz.AuditLog != "" {
+		f, err := os.OpenFile(conf.Authz.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		opt.Audit = f
+	}
+	return authz.New(opt)
+}
+
+// apiListenAddr prefers the configured address, then $PORT as set by
+// Cloud Run, then the default port.
+func apiListenAddr(role config.RoleConfig) string {
+	if role.ListenAddr != "" {
+		return role.ListenAddr
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "9090"
+	}
+	return fmt.Sprintf(":%s", port)
+}
+
 func RunFetcher(conf config.Config) error {
-	log := logrus.New()
-	storage, err := inject.GetStorage(conf)
+	log, err := logging.New(conf.Logging)
 	if err != nil {
 		return err
 	}
-	registryClient, err := inject.GetContainerRegistryClient()
+	if _, err := tracing.Setup(conf.Tracing); err != nil {
+		return err
+	}
+	storage, err := inject.GetStorage(conf.ForRole(conf.Fetcher))
+	if err != nil {
+		return err
+	}
+	registryClient, err := inject.GetContainerRegistryClient(conf)
 	if err != nil {
 		return err
 	}
@@ -68,11 +302,94 @@ func RunFetcher(conf config.Config) error {
 	if err != nil {
 		return err
 	}
+	refresh, err := inject.GetRefreshStorage(conf.ForRole(conf.Fetcher))
+	if err != nil {
+		return err
+	}
+	pollInterval := time.Second
+	if conf.Webhooks.PollInterval != "" {
+		if pollInterval, err = time.ParseDuration(conf.Webhooks.PollInterval); err != nil {
+			return err
+		}
+	}
+	outbox, err := inject.GetOutboxStorage(conf.ForRole(conf.Fetcher))
+	if err != nil {
+		return err
+	}
+	artifacts, err := inject.GetArtifactStorage(conf.ForRole(conf.Fetcher))
+	if err != nil {
+		return err
+	}
+	n, err := notifier.New(notifier.Options{
+		Outbox: outbox,
+		Config: conf.Notifications,
+		Log:    log,
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := n.Run(context.Background()); err != nil {
+			log.Errorf("notifier %v", err)
+		}
+	}()
 	fetcher := digestfetcher.New(digestfetcher.Options{
-		Storage:       storage,
-		Registry:      registryClient,
-		Log:           log,
-		FetchInterval: d,
+		Storage:          storage,
+		Registry:         registryClient,
+		Log:              log,
+		FetchInterval:    d,
+		Notifier:         n,
+		Refresh:          refresh,
+		RefreshPoll:      pollInterval,
+		Artifacts:        artifacts,
+		VerifySignatures: conf.SignatureVerification.Enabled,
 	})
+	if conf.Fetcher.ListenAddr != "" {
+		go func() {
+			if err := runFetcherHealth(conf.Fetcher, log); err != nil {
+				log.Errorf("fetcher health server %v", err)
+			}
+		}()
+	} else if conf.Fetcher.MetricsAddr != "" {
+		if err := serveMetrics(nil, conf.Fetcher.MetricsAddr, log); err != nil {
+			return err
+		}
+	}
 	return fetcher.Fetch(conf.Images)
 }
+
+// runFetcherHealth serves a liveness endpoint so a standalone fetcher can be
+// probed like the api.
+func runFetcherHealth(role config.RoleConfig, log *logrus.Logger) error {
+	router := gin.New()
+	router.GET("/healthz", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	if err := serveMetrics(router, role.MetricsAddr, log); err != nil {
+		return err
+	}
+	return serve(router, role.ListenAddr, role.TLS, log)
+}
+
+// serveMetrics mounts /metrics on router, or on its own listener when addr
+// is set.
+func serveMetrics(router *gin.Engine, addr string, log *logrus.Logger) error {
+	if addr == "" {
+		if router != nil {
+			router.GET("/metrics", gin.WrapH(metrics.Handler()))
+		}
+		return nil
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			log.Errorf("metrics server %v", err)
+		}
+	}()
+	return nil
+}
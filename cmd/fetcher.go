@@ -0,0 +1,45 @@
+/*
+Copyright © 2023 nduyphuong <nguyenduyphuong_t59@hus.edu.vn>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"github.com/nduyphuong/reverse-registry/app"
+	"github.com/spf13/cobra"
+)
+
+// fetcherCmd represents the fetcher command
+var fetcherCmd = &cobra.Command{
+	Use:   "fetcher",
+	Short: "Start reverse registry fetcher only",
+	Long: `Watch the configured images and write their digests to the shared
+database without serving the registry API.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.CheckSharedDB(c); err != nil {
+			return err
+		}
+		return app.RunFetcher(c)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetcherCmd)
+}
@@ -101,5 +101,14 @@ func initConfig() {
 		if mP != "" {
 			c.DBConfig.Password = mP
 		}
+		if p := os.Getenv(constant.APIMySQLPassWordEnv); p != "" {
+			c.API.DBConfig.Password = p
+		}
+		if p := os.Getenv(constant.FetcherMySQLPassWordEnv); p != "" {
+			c.Fetcher.DBConfig.Password = p
+		}
+		if t := os.Getenv(constant.WebhookTokenEnv); t != "" {
+			c.Webhooks.Token = t
+		}
 	}
 }
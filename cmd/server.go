@@ -34,7 +34,7 @@ var (
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
 	Use:   "server",
-	Short: "Start reverse registry server",
+	Short: "Start reverse registry API and fetcher in one process",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		g.Go(func() error {
 			return app.RunAPI(c)
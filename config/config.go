@@ -7,11 +7,67 @@ type MysqlConfig struct {
 	DBName   string `mapstructure:"dbName"`
 }
 
+// RoleConfig holds the settings that differ between the api and the fetcher
+// when they run as separate processes.
+type RoleConfig struct {
+	ListenAddr string `mapstructure:"listenAddr"`
+	// MetricsAddr serves /metrics on its own listener. When empty /metrics
+	// is served on ListenAddr.
+	MetricsAddr string `mapstructure:"metricsAddr"`
+	// DBConfig overrides the shared dbConfig field by field, so a role can
+	// connect to the same database with its own user.
+	DBConfig MysqlConfig `mapstructure:"dbConfig"`
+	// TLS serves ListenAddr over https when a certificate is set.
+	TLS TLS `mapstructure:"tls"`
+	// PublicURL is the URL clients reach the api at, e.g.
+	// https://registry.example.com, used in the URLs handed to clients.
+	// When empty it is taken from the request.
+	PublicURL string `mapstructure:"publicURL"`
+	// TrustedProxies are the IPs and CIDRs of load balancers whose
+	// Forwarded and X-Forwarded-* headers are honored.
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+}
+
+// TLS holds the server certificate and the client certificate policy. The
+// files are reloaded when they change, e.g. when cert-manager renews them.
+type TLS struct {
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	// ClientCAFile is a PEM bundle of the CAs client certificates are
+	// verified against.
+	ClientCAFile string `mapstructure:"clientCAFile"`
+	// ClientAuth is "optional" to verify client certificates when sent or
+	// "require" to reject connections without one, defaults to optional
+	// when ClientCAFile is set.
+	ClientAuth string `mapstructure:"clientAuth"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
 type Config struct {
-	DB                  string      `mapstructure:"db"`
-	DBConfig            MysqlConfig `mapstructure:"dbConfig"`
-	Images              []Image     `mapstructure:"images"`
-	WorkerFetchInterval string      `mapstructure:"workerFetchInterval"`
+	DB                    string                `mapstructure:"db"`
+	DBConfig              MysqlConfig           `mapstructure:"dbConfig"`
+	Images                []Image               `mapstructure:"images"`
+	WorkerFetchInterval   string                `mapstructure:"workerFetchInterval"`
+	API                   RoleConfig            `mapstructure:"api"`
+	Fetcher               RoleConfig            `mapstructure:"fetcher"`
+	Notifications         Notifications         `mapstructure:"notifications"`
+	Webhooks              Webhooks              `mapstructure:"webhooks"`
+	Tracing               Tracing               `mapstructure:"tracing"`
+	Logging               Logging               `mapstructure:"logging"`
+	Auth                  Auth                  `mapstructure:"auth"`
+	Upstreams             []Upstream            `mapstructure:"upstreams"`
+	BlobCache             BlobCache             `mapstructure:"blobCache"`
+	Offline               Offline               `mapstructure:"offline"`
+	ManifestConversion    Conversion            `mapstructure:"manifestConversion"`
+	ResponseCache         ResponseCache         `mapstructure:"responseCache"`
+	RepositoryCache       RepositoryCache       `mapstructure:"repositoryCache"`
+	UpstreamClient        UpstreamClient        `mapstructure:"upstreamClient"`
+	Authz                 Authz                 `mapstructure:"authz"`
+	RateLimit             RateLimit             `mapstructure:"rateLimit"`
+	SignatureVerification SignatureVerification `mapstructure:"signatureVerification"`
 }
 
 type Image struct {
@@ -19,3 +75,330 @@ type Image struct {
 	Constraint  string `mapstructure:"constraint"`
 	MainPackage string `mapstructure:"mainPackage"`
 }
+
+// SignatureVerification makes the fetcher check the cosign signature of an
+// image index before recording its digest.
+type SignatureVerification struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Key is a PEM public key file the images are signed with. Without one
+	// keyless signatures are checked against the Sigstore public good
+	// instance.
+	Key string `mapstructure:"key"`
+	// CertificateIdentity and CertificateOIDCIssuer the signing certificate
+	// of keyless signatures must have.
+	CertificateIdentity   string `mapstructure:"certificateIdentity"`
+	CertificateOIDCIssuer string `mapstructure:"certificateOidcIssuer"`
+	// IgnoreTlog skips the transparency log check, for keys whose
+	// signatures are not uploaded to Rekor.
+	IgnoreTlog bool `mapstructure:"ignoreTlog"`
+}
+
+// Notifications configures outbound webhooks for fetcher events.
+type Notifications struct {
+	Endpoints []WebhookEndpoint `mapstructure:"endpoints"`
+	// MaxAttempts before an event is given up on, defaults to 10.
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// PollInterval of the outbox dispatcher, defaults to 5s.
+	PollInterval string `mapstructure:"pollInterval"`
+}
+
+type WebhookEndpoint struct {
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+	// Secret used to sign the body with HMAC-SHA256.
+	Secret string `mapstructure:"secret"`
+	// Events is the list of event types delivered to this endpoint, all
+	// events when empty.
+	Events []string `mapstructure:"events"`
+}
+
+// Webhooks configures the inbound refresh endpoint and registry webhook
+// receivers.
+type Webhooks struct {
+	// Token callers must send as a bearer token or in the token query
+	// parameter. The endpoints are disabled when it is empty.
+	Token string `mapstructure:"token"`
+	// PollInterval at which the fetcher picks up refresh requests,
+	// defaults to 1s.
+	PollInterval string `mapstructure:"pollInterval"`
+}
+
+// Tracing configures OpenTelemetry tracing, it is off when Exporter is empty.
+type Tracing struct {
+	// Exporter is otlp or stdout.
+	Exporter string `mapstructure:"exporter"`
+	// Protocol of the OTLP exporter, http/protobuf (default) or grpc.
+	Protocol string `mapstructure:"protocol"`
+	// Endpoint URL of the OTLP collector, defaults to http://localhost:4318
+	// for http/protobuf and http://localhost:4317 for grpc. http:// URLs
+	// are sent without TLS.
+	Endpoint string            `mapstructure:"endpoint"`
+	Headers  map[string]string `mapstructure:"headers"`
+	// SampleRatio of the traces started here, defaults to 1.
+	SampleRatio float64 `mapstructure:"sampleRatio"`
+	ServiceName string  `mapstructure:"serviceName"`
+}
+
+// Logging configures the application log and the access log.
+type Logging struct {
+	// Level is a logrus level, defaults to info.
+	Level string `mapstructure:"level"`
+	// Format is text or json, the access log is always json.
+	Format string `mapstructure:"format"`
+	// RedactHeaders are masked in logs on top of the credential headers
+	// that always are.
+	RedactHeaders []string `mapstructure:"redactHeaders"`
+}
+
+// Auth configures how clients authenticate to /v2 and /token. Anyone can
+// pull when neither Htpasswd nor Tokens is set.
+type Auth struct {
+	// Realm is sent in the basic auth challenge, defaults to
+	// reverse-registry.
+	Realm string `mapstructure:"realm"`
+	// Htpasswd is the path of an htpasswd file with bcrypt hashes, as
+	// written by htpasswd -B.
+	Htpasswd string        `mapstructure:"htpasswd"`
+	Tokens   []StaticToken `mapstructure:"tokens"`
+	// Groups maps a group name to its members, for access rules.
+	Groups map[string][]string `mapstructure:"groups"`
+	// ClientCertificates accepts verified TLS client certificates as
+	// credentials, the identity is named after the subject common name and
+	// is in the groups of its organizational units.
+	ClientCertificates bool `mapstructure:"clientCertificates"`
+	// OIDC lists the issuers whose workload identity tokens are accepted,
+	// e.g. GitHub Actions or Kubernetes service accounts.
+	OIDC []OIDCIssuer `mapstructure:"oidc"`
+	// TokenService makes the proxy its own Docker token server instead of
+	// asking clients for credentials on every request.
+	TokenService TokenService `mapstructure:"tokenService"`
+}
+
+// OIDCIssuer is a trusted issuer of OIDC JWTs. Claims are referenced in
+// Subject, Groups and RequiredClaims by name, nested claims with a slash,
+// e.g. kubernetes.io/serviceaccount/name.
+type OIDCIssuer struct {
+	// Issuer must equal the iss claim.
+	Issuer string `mapstructure:"issuer"`
+	// Audiences accepted in the aud claim, at least one is required.
+	Audiences []string `mapstructure:"audiences"`
+	// JWKSURL or JWKSFile hold the signing keys, when both are empty they
+	// are discovered from the issuer's openid-configuration.
+	JWKSURL  string `mapstructure:"jwksURL"`
+	JWKSFile string `mapstructure:"jwksFile"`
+	// Subject is the template of the identity name, e.g.
+	// "github:{repository}", defaults to "{sub}".
+	Subject string `mapstructure:"subject"`
+	// Groups are templates of groups the identity is in, e.g.
+	// "k8s:{kubernetes.io/namespace}". Groups naming a missing claim are
+	// left out.
+	Groups []string `mapstructure:"groups"`
+	// RequiredClaims must have exactly these values, e.g.
+	// repository_owner: my-org.
+	RequiredClaims map[string]string `mapstructure:"requiredClaims"`
+}
+
+// TokenService configures the JWTs issued on /token.
+type TokenService struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Realm is the token endpoint advertised to clients, defaults to
+	// http://$HOST/token.
+	Realm string `mapstructure:"realm"`
+	// Issuer and Service are the iss and aud of the tokens, both default
+	// to reverse-registry.
+	Issuer  string `mapstructure:"issuer"`
+	Service string `mapstructure:"service"`
+	// Key is a PEM file with the RSA or ECDSA signing key. A key is
+	// generated at start when empty, which only works with one api
+	// replica.
+	Key string `mapstructure:"key"`
+	// Expiration of the tokens, defaults to 5m.
+	Expiration string `mapstructure:"expiration"`
+}
+
+// StaticToken is a long lived token accepted as a bearer token, or as the
+// password of any user, for the identity Name.
+type StaticToken struct {
+	Name   string   `mapstructure:"name"`
+	Token  string   `mapstructure:"token"`
+	Groups []string `mapstructure:"groups"`
+}
+
+// Enabled reports whether clients have to authenticate.
+func (a Auth) Enabled() bool {
+	return a.Htpasswd != "" || len(a.Tokens) > 0 || len(a.OIDC) > 0 || a.ClientCertificates
+}
+
+// Authz restricts what authenticated clients may do. Without rules every
+// client may do everything, with rules anything not granted is denied.
+type Authz struct {
+	Rules []AccessRule `mapstructure:"rules"`
+	// DB loads rules from the access_rules table as well, they are
+	// reloaded every ReloadInterval, 30s by default.
+	DB             bool   `mapstructure:"db"`
+	ReloadInterval string `mapstructure:"reloadInterval"`
+	// AuditLog is a file denials are appended to, stdout when empty.
+	AuditLog string `mapstructure:"auditLog"`
+}
+
+// AccessRule grants Subjects the Actions (pull, list, admin) on the
+// repositories matching one of Repositories. Subjects are user names,
+// group:<name> or *; repositories are names as clients see them, with *
+// matching within a path segment and a trailing /** or ** matching any
+// suffix.
+type AccessRule struct {
+	Subjects     []string `mapstructure:"subjects"`
+	Repositories []string `mapstructure:"repositories"`
+	Actions      []string `mapstructure:"actions"`
+}
+
+// Enabled reports whether access rules are enforced.
+func (a Authz) Enabled() bool {
+	return len(a.Rules) > 0 || a.DB
+}
+
+// RateLimit limits each client, keyed by the authenticated user or token
+// name or else by client ip. Manifest covers manifests, tag lists and the
+// other metadata requests, Blob covers blobs.
+type RateLimit struct {
+	Manifest  Budget              `mapstructure:"manifest"`
+	Blob      Budget              `mapstructure:"blob"`
+	Overrides []RateLimitOverride `mapstructure:"overrides"`
+	// UpstreamConcurrency caps the requests in flight to each upstream
+	// registry, 0 for no cap.
+	UpstreamConcurrency int `mapstructure:"upstreamConcurrency"`
+}
+
+// Budget is a token bucket: PerSecond requests on average with bursts of
+// Burst. A zero PerSecond means unlimited.
+type Budget struct {
+	PerSecond float64 `mapstructure:"perSecond"`
+	Burst     int     `mapstructure:"burst"`
+}
+
+// RateLimitOverride replaces the budgets of a user or token name. A zero
+// budget keeps the default.
+type RateLimitOverride struct {
+	Subject  string `mapstructure:"subject"`
+	Manifest Budget `mapstructure:"manifest"`
+	Blob     Budget `mapstructure:"blob"`
+}
+
+// Upstream holds the credentials used for an upstream registry. Set one of
+// Username and Password, IdentityTokenFile or CredentialHelper.
+type Upstream struct {
+	// Registry is the upstream host, e.g. cgr.dev.
+	Registry string `mapstructure:"registry"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// IdentityTokenFile holds an OAuth2 refresh token. It is read on every
+	// token exchange so it can be rotated in place.
+	IdentityTokenFile string `mapstructure:"identityTokenFile"`
+	// CredentialHelper is the name of a docker-credential-<name> binary on
+	// the PATH, e.g. ecr-login.
+	CredentialHelper string `mapstructure:"credentialHelper"`
+	// FollowRedirects makes the proxy follow blob redirects, e.g. to a CDN,
+	// and stream the blob to the client, for clients that can only reach
+	// the proxy.
+	FollowRedirects bool `mapstructure:"followRedirects"`
+}
+
+// UpstreamClient tunes the HTTP client every upstream request goes through.
+// Durations are Go durations, empty fields take the defaults.
+type UpstreamClient struct {
+	// DialTimeout defaults to 10s.
+	DialTimeout string `mapstructure:"dialTimeout"`
+	// TLSHandshakeTimeout defaults to 10s.
+	TLSHandshakeTimeout string `mapstructure:"tlsHandshakeTimeout"`
+	// ResponseHeaderTimeout bounds the wait for the response headers once
+	// the request is sent, defaults to 30s. Bodies are not bounded so large
+	// blobs can stream.
+	ResponseHeaderTimeout string `mapstructure:"responseHeaderTimeout"`
+	// MaxAttempts of GET and HEAD requests failing with a connection error
+	// or a 5xx, defaults to 3. 1 disables retries.
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// RetryBackoff is the wait before the first retry, doubled for every
+	// further one, defaults to 200ms.
+	RetryBackoff string         `mapstructure:"retryBackoff"`
+	Breaker      CircuitBreaker `mapstructure:"breaker"`
+}
+
+// CircuitBreaker fails requests to an upstream fast after it failed
+// repeatedly.
+type CircuitBreaker struct {
+	// Failures in a row that open the circuit, defaults to 5. A negative
+	// value disables the breaker.
+	Failures int `mapstructure:"failures"`
+	// OpenFor is how long requests fail fast before one is let through to
+	// probe the upstream, defaults to 30s.
+	OpenFor string `mapstructure:"openFor"`
+}
+
+// BlobCache keeps the blobs the proxy streamed on disk.
+type BlobCache struct {
+	// Dir enables the cache.
+	Dir string `mapstructure:"dir"`
+	// MaxSize in bytes, the least recently used blobs are removed when the
+	// cache grows over it. 0 is unlimited.
+	MaxSize int64 `mapstructure:"maxSize"`
+}
+
+// Offline keeps the manifests and tags the proxy passed through in the
+// database, to serve them, and the blob cache, while the upstream is down.
+type Offline struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// Conversion lets the proxy serve an OCI index as a Docker manifest list,
+// or the other way around, to clients that only accept the other type.
+type Conversion struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// ResponseCache keeps upstream responses to manifest requests by tag and tag
+// lists in memory for a short time. TTLs are Go durations, empty disables
+// caching of that kind.
+type ResponseCache struct {
+	ManifestTTL string `mapstructure:"manifestTTL"`
+	TagsTTL     string `mapstructure:"tagsTTL"`
+	// NotFoundTTL caches 404s of both kinds.
+	NotFoundTTL string `mapstructure:"notFoundTTL"`
+	// MaxSize bounds the cached bodies in bytes, evicting the least
+	// recently used. 0 is unlimited.
+	MaxSize int64 `mapstructure:"maxSize"`
+}
+
+// Enabled reports whether any response is cached.
+func (r ResponseCache) Enabled() bool {
+	return r.ManifestTTL != "" || r.TagsTTL != "" || r.NotFoundTTL != ""
+}
+
+// RepositoryCache keeps the digest lookups of the proxy in memory, saving a
+// database round trip on most manifest requests.
+type RepositoryCache struct {
+	// Size is the number of lookups kept, 0 disables the cache.
+	Size int `mapstructure:"size"`
+	// TTL bounds how long a lookup is kept, defaults to 1m.
+	TTL string `mapstructure:"ttl"`
+	// VersionCheck is how often replicas check for digests saved by
+	// others, defaults to 5s.
+	VersionCheck string `mapstructure:"versionCheck"`
+}
+
+// ForRole returns a copy of the config with the role's database settings
+// merged over the shared ones.
+func (c Config) ForRole(role RoleConfig) Config {
+	if role.DBConfig.Host != "" {
+		c.DBConfig.Host = role.DBConfig.Host
+	}
+	if role.DBConfig.User != "" {
+		c.DBConfig.User = role.DBConfig.User
+	}
+	if role.DBConfig.Password != "" {
+		c.DBConfig.Password = role.DBConfig.Password
+	}
+	if role.DBConfig.DBName != "" {
+		c.DBConfig.DBName = role.DBConfig.DBName
+	}
+	return c
+}
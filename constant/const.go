@@ -1,6 +1,9 @@
 package constant
 
 const (
-	WorkerFetchIntervalEnv = "WORKER_FETCH_INTERVAL"
-	MySQLPassWordEnv       = "MYSQL_PASSWORD"
+	WorkerFetchIntervalEnv  = "WORKER_FETCH_INTERVAL"
+	MySQLPassWordEnv        = "MYSQL_PASSWORD"
+	APIMySQLPassWordEnv     = "API_MYSQL_PASSWORD"
+	FetcherMySQLPassWordEnv = "FETCHER_MYSQL_PASSWORD"
+	WebhookTokenEnv         = "WEBHOOK_TOKEN"
 )
@@ -20,6 +20,16 @@ func NewMySQLDB(host string, user string, password string, dbName string) (*gorm
 
 	db.AutoMigrate(
 		&model.ImageModel{},
+		&model.OutboxEvent{},
+		&model.RefreshRequest{},
+		&model.AccessRule{},
+		&model.Manifest{},
+		&model.ManifestTag{},
+		&model.CacheVersion{},
+		&model.Artifact{},
+		&model.ArtifactLink{},
+		&model.ArtifactBlob{},
+		&model.ManifestConversion{},
 	)
 	return db, nil
 }
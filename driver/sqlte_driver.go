@@ -16,6 +16,16 @@ func NewSqliteDB() (*gorm.DB, error) {
 	}
 	db.AutoMigrate(
 		&model.ImageModel{},
+		&model.OutboxEvent{},
+		&model.RefreshRequest{},
+		&model.AccessRule{},
+		&model.Manifest{},
+		&model.ManifestTag{},
+		&model.CacheVersion{},
+		&model.Artifact{},
+		&model.ArtifactLink{},
+		&model.ArtifactBlob{},
+		&model.ManifestConversion{},
 	)
 	return db, nil
 }
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/sirupsen/logrus"
+)
+
+// artifactTag matches the tags cosign attaches signatures, attestations and
+// SBOMs to an image digest with.
+var artifactTag = regexp.MustCompile(`^sha256-[a-f0-9]{64}\.(sig|att|sbom)$`)
+
+// watchedImage is the image a repository of the proxy is pulled from, the
+// reverse of proxiedRepository.
+func watchedImage(repo string) string {
+	return "cgr.dev/chainguard/" + repo
+}
+
+// serveArtifactTag answers requests for the signatures, attestations and
+// SBOMs kept of the recorded images by their tag. It reports whether it did,
+// the request goes upstream otherwise.
+func (s *client) serveArtifactTag(ctx *gin.Context, p registrypath.Path) bool {
+	tag, ok := p.Tag()
+	if s.artifacts == nil || !ok || !artifactTag.MatchString(tag) {
+		return false
+	}
+	a, err := s.artifacts.FindArtifact(watchedImage(p.Repository), tag)
+	if err != nil {
+		s.logger(ctx).Errorf("find artifact %v", err)
+		return false
+	}
+	if a.Digest == "" {
+		return false
+	}
+	metrics.ProxyLookups.WithLabelValues(metrics.LookupLocal).Inc()
+	s.writeArtifact(ctx, a.MediaType, a.Digest, a.Manifest)
+	return true
+}
+
+// serveMissingArtifact answers a request the upstream answered 404 from
+// the artifacts kept, for manifests by digest and blobs the upstream
+// dropped. It reports whether it did.
+func (s *client) serveMissingArtifact(ctx *gin.Context, p registrypath.Path) bool {
+	dgst, ok := p.Digest()
+	if s.artifacts == nil || !ok {
+		return false
+	}
+	repo := watchedImage(p.Repository)
+	switch p.Endpoint {
+	case registrypath.Manifests:
+		a, err := s.artifacts.FindArtifactByDigest(repo, dgst.String())
+		if err != nil {
+			s.logger(ctx).Errorf("find artifact %v", err)
+			return false
+		}
+		if a.Digest == "" {
+			return false
+		}
+		metrics.ProxyLookups.WithLabelValues(metrics.LookupArtifact).Inc()
+		s.writeArtifact(ctx, a.MediaType, a.Digest, a.Manifest)
+		return true
+	case registrypath.Blobs:
+		b, err := s.artifacts.FindBlob(repo, dgst.String())
+		if err != nil {
+			s.logger(ctx).Errorf("find artifact blob %v", err)
+			return false
+		}
+		if b.Digest == "" {
+			return false
+		}
+		metrics.ProxyLookups.WithLabelValues(metrics.LookupArtifact).Inc()
+		s.writeArtifact(ctx, "application/octet-stream", b.Digest, b.Content)
+		return true
+	}
+	return false
+}
+
+func (s *client) writeArtifact(ctx *gin.Context, mediaType, digest string, content []byte) {
+	s.logger(ctx).WithField("digest", digest).Info("sent artifact from local db")
+	ctx.Header("Docker-Content-Digest", digest)
+	ctx.Header("Content-Length", strconv.Itoa(len(content)))
+	ctx.Header("Content-Type", mediaType)
+	ctx.Status(http.StatusOK)
+	if ctx.Request.Method != http.MethodHead {
+		_, _ = ctx.Writer.Write(content)
+	}
+}
+
+// Predicate types of the documents served by ArtifactHandler.
+var documentTypes = map[string][]string{
+	"provenance": {"https://slsa.dev/provenance/"},
+	"sbom":       {"https://spdx.dev/Document", "https://cyclonedx.org/bom"},
+}
+
+type artifactResponse struct {
+	Image     string            `json:"image"`
+	Digest    string            `json:"digest"`
+	Platform  string            `json:"platform"`
+	Documents []json.RawMessage `json:"documents"`
+}
+
+// ArtifactHandler serves GET /api/v1/images/{name}:{tag}/sbom and
+// /provenance, or {name}@{digest}, where name is the image as written in
+// config and tag a recorded version. The documents are read from the
+// attestations kept of the image for the platform asked for, linux/amd64 by
+// default, and SBOMs attached as such.
+func (s *client) ArtifactHandler(ctx *gin.Context) {
+	path := strings.TrimPrefix(ctx.Param("path"), "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || documentTypes[path[i+1:]] == nil || s.artifacts == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	ref, document := path[:i], path[i+1:]
+	name, index, tagged := ref, "", false
+	if at := strings.Index(ref, "@"); at >= 0 {
+		name, index = ref[:at], ref[at+1:]
+	} else if colon := strings.LastIndex(ref, ":"); colon > strings.LastIndex(ref, "/") {
+		name, tagged = ref[:colon], true
+	}
+	if !s.authorize(ctx, proxiedRepository(name), authz.Pull) {
+		return
+	}
+	if tagged {
+		r, err := s.imageStorage.WithContext(ctx.Request.Context()).FindByNameTag(ref)
+		if err != nil {
+			s.logger(ctx).Errorf("find name tag %v", err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "can not find image"})
+			return
+		}
+		index = r.HashedIndex
+	}
+	if index == "" {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "image version is not recorded", "image": ref})
+		return
+	}
+	artifacts, err := s.artifacts.ListArtifacts(index)
+	if err != nil {
+		s.logger(ctx).Errorf("list artifacts %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "can not list artifacts"})
+		return
+	}
+	platform := ctx.DefaultQuery("platform", "linux/amd64")
+	resp := artifactResponse{Image: name, Digest: index, Platform: platform, Documents: []json.RawMessage{}}
+	for _, a := range artifacts {
+		if a.Repository != name || (a.Platform != "" && a.Platform != platform) {
+			continue
+		}
+		resp.Documents = append(resp.Documents, s.documents(ctx, a, document)...)
+	}
+	if len(resp.Documents) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no " + document + " kept", "image": ref})
+		return
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// documents returns the documents of kind in artifact a: the predicates of
+// its in-toto statements of that kind for attestations, and the SBOMs
+// themselves for SBOMs attached as such.
+func (s *client) documents(ctx *gin.Context, a model.Artifact, kind string) []json.RawMessage {
+	if a.Kind != "att" && (a.Kind != "sbom" || kind != "sbom") {
+		return nil
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(a.Manifest))
+	if err != nil {
+		return nil
+	}
+	var documents []json.RawMessage
+	for _, l := range m.Layers {
+		b, err := s.artifacts.FindBlob(a.Repository, l.Digest.String())
+		if err != nil {
+			s.logger(ctx).Errorf("find artifact blob %v", err)
+			continue
+		}
+		if a.Kind == "sbom" {
+			if json.Valid(b.Content) {
+				documents = append(documents, b.Content)
+			}
+			continue
+		}
+		statement, err := decodeStatement(b.Content)
+		if err != nil {
+			s.logger(ctx).WithFields(logrus.Fields{"artifact": a.Tag, "layer": l.Digest}).Errorf("decode attestation %v", err)
+			continue
+		}
+		for _, prefix := range documentTypes[kind] {
+			if strings.HasPrefix(statement.PredicateType, prefix) {
+				documents = append(documents, statement.Predicate)
+				break
+			}
+		}
+	}
+	return documents
+}
+
+type dsseEnvelope struct {
+	Payload string `json:"payload"`
+}
+
+type inTotoStatement struct {
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// decodeStatement decodes the in-toto statement signed in a DSSE envelope.
+func decodeStatement(envelope []byte) (inTotoStatement, error) {
+	var e dsseEnvelope
+	var statement inTotoStatement
+	if err := json.Unmarshal(envelope, &e); err != nil {
+		return statement, err
+	}
+	payload, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return statement, err
+	}
+	err = json.Unmarshal(payload, &statement)
+	return statement, err
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifacts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	storage := repository.NewStorage(db)
+	artifacts := repository.NewArtifactStorage(db)
+	const repo = "cgr.dev/chainguard/artifacts"
+	index := digest.FromString("artifacts index")
+	_, err = storage.SaveDigest(repo+":1.0", index.String())
+	assert.NoError(t, err)
+
+	envelope := func(predicateType, predicate string) []byte {
+		statement := `{"_type":"https://in-toto.io/Statement/v1","predicateType":"` + predicateType + `","predicate":` + predicate + `}`
+		return []byte(`{"payloadType":"application/vnd.in-toto+json","payload":"` + base64.StdEncoding.EncodeToString([]byte(statement)) + `"}`)
+	}
+	provenance := envelope("https://slsa.dev/provenance/v1", `{"buildDefinition":{}}`)
+	sbom := envelope("https://spdx.dev/Document", `{"spdxVersion":"SPDX-2.3"}`)
+	layer := func(b []byte) string {
+		return `{"mediaType":"application/vnd.dsse.envelope.v1+json","size":` + strconv.Itoa(len(b)) + `,"digest":"` + digest.FromBytes(b).String() + `"}`
+	}
+	att := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":0,"digest":"` + digest.FromString("").String() + `"},"layers":[` + layer(provenance) + `,` + layer(sbom) + `]}`)
+	sig := []byte(`{"schemaVersion":2,"layers":[]}`)
+	tag := "sha256-" + index.Encoded()
+	assert.NoError(t, artifacts.SaveArtifact(model.Artifact{
+		Repository: repo, Tag: tag + ".sig", Subject: index.String(), Kind: "sig",
+		Digest: digest.FromBytes(sig).String(), MediaType: "application/vnd.oci.image.manifest.v1+json", Manifest: sig,
+	}, nil))
+	assert.NoError(t, artifacts.SaveArtifact(model.Artifact{
+		Repository: repo, Tag: "sha256-" + digest.FromString("amd64").Encoded() + ".att",
+		Subject: digest.FromString("amd64").String(), Platform: "linux/amd64", Kind: "att",
+		Digest: digest.FromBytes(att).String(), MediaType: "application/vnd.oci.image.manifest.v1+json", Manifest: att,
+	}, []model.ArtifactBlob{
+		{Repository: repo, Digest: digest.FromBytes(provenance).String(), Content: provenance},
+		{Repository: repo, Digest: digest.FromBytes(sbom).String(), Content: sbom},
+	}))
+	assert.NoError(t, artifacts.LinkArtifact(repo, tag+".sig", index.String()))
+	assert.NoError(t, artifacts.LinkArtifact(repo, "sha256-"+digest.FromString("amd64").Encoded()+".att", index.String()))
+
+	// The upstream garbage collected everything.
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.NotFoundHandler(),
+	}}
+	h := New(Options{
+		Log:       logrus.New(),
+		Transport: net,
+		Upstream:  &fakeUpstream{},
+		Storage:   storage,
+		Artifacts: artifacts,
+	})
+	router := gin.New()
+	router.Any("/v2/*path", h.ProxyHandler)
+	router.GET("/api/v1/images/*path", h.ArtifactHandler)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/v2/artifacts/manifests/"+tag+".sig")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, string(sig), resp.Body.String())
+	assert.Equal(t, digest.FromBytes(sig).String(), resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, 0, net.calls["cgr.dev"], "tagged artifacts are served locally")
+
+	resp = do(http.MethodHead, "/v2/artifacts/manifests/"+digest.FromBytes(att).String())
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+	resp = do(http.MethodGet, "/v2/artifacts/blobs/"+digest.FromBytes(provenance).String())
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, string(provenance), resp.Body.String())
+	assert.Equal(t, 2, net.calls["cgr.dev"])
+
+	// Artifacts are only served in their repository.
+	resp = do(http.MethodGet, "/v2/other/manifests/"+tag+".sig")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/images/" + repo + ":1.0/provenance", `{"buildDefinition":{}}`},
+		{"/api/v1/images/" + repo + "@" + index.String() + "/sbom", `{"spdxVersion":"SPDX-2.3"}`},
+	} {
+		resp := do(http.MethodGet, tc.path)
+		assert.Equal(t, http.StatusOK, resp.Code, tc.path)
+		var body artifactResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, index.String(), body.Digest)
+		assert.Equal(t, "linux/amd64", body.Platform)
+		if assert.Len(t, body.Documents, 1) {
+			assert.JSONEq(t, tc.want, string(body.Documents[0]))
+		}
+	}
+	for _, path := range []string{
+		"/api/v1/images/" + repo + ":1.0/provenance?platform=linux/arm64",
+		"/api/v1/images/" + repo + ":2.0/sbom",
+		"/api/v1/images/" + repo + ":1.0/signature",
+	} {
+		resp := do(http.MethodGet, path)
+		assert.Equal(t, http.StatusNotFound, resp.Code, path)
+		assert.True(t, strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json"))
+	}
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/services/blobcache"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// serveCachedBlob answers a blob request from the blob cache, with Range
+// and conditional request support. It reports whether the blob was cached
+// for repo. Only clients that passed local authentication, and so the
+// access rules of repo, are served: cached blobs may have been pulled with
+// the credentials of another client.
+func (s *client) serveCachedBlob(ctx *gin.Context, repo string, dgst digest.Digest) bool {
+	if s.blobCache == nil || !authenticated(ctx) || (ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead) {
+		return false
+	}
+	f, err := s.blobCache.Open(repo, dgst)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger(ctx).Errorf("open cached blob %v", err)
+		}
+		metrics.BlobCacheLookups.WithLabelValues("miss").Inc()
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.logger(ctx).Errorf("stat cached blob %v", err)
+		return false
+	}
+	metrics.BlobCacheLookups.WithLabelValues("hit").Inc()
+	s.logger(ctx).WithField("digest", dgst).Info("sent blob from cache")
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Header("Docker-Content-Digest", dgst.String())
+	ctx.Header("Etag", `"`+dgst.String()+`"`)
+	http.ServeContent(ctx.Writer, ctx.Request, "", info.ModTime(), f)
+	return true
+}
+
+// proxyBlob handles the upstream response to a blob request when the proxy
+// streams the blob itself: to follow a redirect for clients that can not
+// reach the redirect target, or to fill the blob cache. It reports whether
+// the response was handled.
+func (s *client) proxyBlob(ctx *gin.Context, back *http.Response, repo string, dgst digest.Digest) bool {
+	switch {
+	case isRedirect(back.StatusCode) && s.upstream.FollowRedirects("cgr.dev"):
+		location, err := back.Location()
+		if err != nil {
+			return false
+		}
+		out, _ := http.NewRequestWithContext(ctx.Request.Context(), ctx.Request.Method, location.String(), nil)
+		// The redirect target is presigned, the client's credentials stay
+		// with us.
+		for _, h := range []string{"Range", "If-Range"} {
+			if v := ctx.GetHeader(h); v != "" {
+				out.Header.Set(h, v)
+			}
+		}
+		s.logger(ctx).WithFields(logrus.Fields{
+			"url":    s.redaction.URL(out.URL),
+			"digest": dgst,
+		}).Info("following blob redirect")
+		resp, err := s.httpClient.Do(out)
+		if err != nil {
+			s.logger(ctx).Errorf("follow blob redirect %v", err)
+			if upstreamUnavailable(ctx, err) {
+				return true
+			}
+			ctx.AbortWithStatusJSON(http.StatusBadGateway, err)
+			return true
+		}
+		defer resp.Body.Close()
+		s.streamBlob(ctx, resp, repo, dgst)
+		return true
+	case back.StatusCode == http.StatusOK && s.blobCache != nil && ctx.Request.Method == http.MethodGet:
+		s.streamBlob(ctx, back, repo, dgst)
+		return true
+	}
+	return false
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// streamBlob copies a blob to the client while verifying its digest and
+// writing it to the blob cache for repo. The last bytes are held back until the
+// digest is verified, so a client never receives a complete corrupt blob:
+// on a mismatch the response ends short of its Content-Length and the
+// connection is closed.
+func (s *client) streamBlob(ctx *gin.Context, resp *http.Response, repo string, dgst digest.Digest) {
+	header := ctx.Writer.Header()
+	if resp.StatusCode/100 != 2 {
+		// An error of the blob storage, e.g. an expired signature.
+		s.logger(ctx).WithField("status", resp.Status).Error("fetch blob")
+		header.Set("Content-Type", resp.Header.Get("Content-Type"))
+		ctx.Status(resp.StatusCode)
+		if _, err := io.Copy(ctx.Writer, resp.Body); err != nil {
+			s.logger(ctx).Errorf("Error copying response body: %v", err)
+		}
+		return
+	}
+	for _, h := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Docker-Content-Digest", dgst.String())
+	header.Set("Etag", `"`+dgst.String()+`"`)
+	ctx.Status(resp.StatusCode)
+	if ctx.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Part of the blob, there is nothing to verify it against.
+		if _, err := io.Copy(ctx.Writer, resp.Body); err != nil {
+			s.logger(ctx).Errorf("Error copying response body: %v", err)
+		}
+		return
+	}
+
+	verifier := dgst.Verifier()
+	var cache blobcache.Writer
+	if s.blobCache != nil {
+		w, err := s.blobCache.Create(repo, dgst)
+		if err != nil {
+			s.logger(ctx).Errorf("cache blob %v", err)
+		} else {
+			cache = w
+			defer cache.Abort()
+		}
+	}
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			verifier.Write(buf[:n])
+			if cache != nil {
+				if _, err := cache.Write(buf[:n]); err != nil {
+					s.logger(ctx).Errorf("cache blob %v", err)
+					cache.Abort()
+					cache = nil
+				}
+			}
+			if len(pending) > 0 {
+				if _, err := ctx.Writer.Write(pending); err != nil {
+					// The client went away.
+					return
+				}
+			}
+			pending = append(pending[:0], buf[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.logger(ctx).Errorf("read blob %v", err)
+			return
+		}
+	}
+	if !verifier.Verified() {
+		metrics.BlobDigestMismatches.Inc()
+		s.logger(ctx).WithField("digest", dgst).Error("blob does not match its digest")
+		return
+	}
+	if _, err := ctx.Writer.Write(pending); err != nil {
+		return
+	}
+	if cache != nil {
+		if err := cache.Commit(); err != nil {
+			s.logger(ctx).Errorf("cache blob %v", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/blobcache"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// network answers requests with the handler of their host, as if it was
+// the server.
+type network struct {
+	hosts map[string]http.Handler
+	calls map[string]int
+}
+
+func (n *network) RoundTrip(req *http.Request) (*http.Response, error) {
+	n.calls[req.URL.Host]++
+	rec := httptest.NewRecorder()
+	n.hosts[req.URL.Host].ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+// identify stands in for local authentication, the client named by the
+// X-User header passed it.
+func identify(ctx *gin.Context) {
+	if user := ctx.GetHeader("X-User"); user != "" {
+		ctx.Request = ctx.Request.WithContext(auth.WithIdentity(ctx.Request.Context(), auth.Identity{Name: user}))
+	}
+}
+
+type fakeUpstream struct {
+	follow bool
+}
+
+func (f *fakeUpstream) Keychain() authn.Keychain    { return authn.DefaultKeychain }
+func (f *fakeUpstream) Configured(string) bool      { return false }
+func (f *fakeUpstream) FollowRedirects(string) bool { return f.follow }
+func (f *fakeUpstream) Transport(context.Context, name.Repository, ...string) (http.RoundTripper, error) {
+	return nil, errors.New("clients authenticate upstream")
+}
+
+func TestProxyBlob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	blob := []byte(strings.Repeat("layer data ", 10000))
+	dgst := digest.FromBytes(blob)
+	corrupt := digest.FromString("something else")
+
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		// cgr.dev redirects blobs to its CDN.
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer client-token", r.Header.Get("Authorization"))
+			d := strings.TrimPrefix(r.URL.Path, "/v2/chainguard/nginx/blobs/")
+			http.Redirect(w, r, "https://cdn.example/blobs/"+d+"?sig=secret", http.StatusTemporaryRedirect)
+		}),
+		"cdn.example": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		}),
+	}}
+	cache, err := blobcache.New(blobcache.Options{Config: config.BlobCache{Dir: t.TempDir()}})
+	assert.NoError(t, err)
+	h := New(Options{
+		Log:       logrus.New(),
+		Transport: net,
+		Upstream:  &fakeUpstream{follow: true},
+		BlobCache: cache,
+	})
+	router := gin.New()
+	router.Use(identify)
+	router.GET("/v2/*path", h.ProxyHandler)
+
+	getAs := func(user, repo string, d digest.Digest, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/"+repo+"/blobs/"+d.String(), nil)
+		req.Header.Set("Authorization", "Bearer client-token")
+		req.Header.Set("X-User", user)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	get := func(d digest.Digest, rangeHeader string) *httptest.ResponseRecorder {
+		return getAs("alice", "nginx", d, rangeHeader)
+	}
+
+	// Ranges are passed to the CDN and not cached.
+	resp := get(dgst, "bytes=0-4")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "layer", resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Location"))
+
+	// The redirect is followed and the blob streamed and cached.
+	resp = get(dgst, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, blob, resp.Body.Bytes())
+	assert.Equal(t, dgst.String(), resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, 2, net.calls["cgr.dev"])
+
+	// Then it is served from the cache, ranges included.
+	resp = get(dgst, "bytes=6-9")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "data", resp.Body.String())
+	assert.Equal(t, 2, net.calls["cgr.dev"])
+
+	// Relayed clients, and clients of other repositories, go upstream.
+	resp = getAs("", "nginx", dgst, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 3, net.calls["cgr.dev"])
+	resp = getAs("alice", "redis", dgst, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 4, net.calls["cgr.dev"])
+
+	// A blob not matching its digest is cut short and not cached.
+	resp = get(corrupt, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Less(t, resp.Body.Len(), len(blob))
+	_, err = cache.Open("nginx", corrupt)
+	assert.Error(t, err)
+}
+
+func TestProxyBlobRedirectsByDefault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://cdn.example/blob", http.StatusTemporaryRedirect)
+		}),
+	}}
+	h := New(Options{Log: logrus.New(), Transport: net, Upstream: &fakeUpstream{}})
+	router := gin.New()
+	router.GET("/v2/*path", h.ProxyHandler)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/nginx/blobs/"+digest.FromString("x").String(), nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.Code)
+	assert.Equal(t, "https://cdn.example/blob", resp.Header().Get("Location"))
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/nduyphuong/reverse-registry/services/responsecache"
+)
+
+// cacheKind returns the kind of response cache entry for a request, empty
+// when it is not cached: manifests by tag and tag lists. Manifests by digest
+// are immutable and left to the clients' own caches.
+func cacheKind(p registrypath.Path) string {
+	if _, ok := p.Tag(); ok {
+		return responsecache.Manifest
+	}
+	if p.Endpoint == registrypath.Tags {
+		return responsecache.Tags
+	}
+	return ""
+}
+
+// responseCacheKey keys entries by upstream request and Accept header, so
+// clients negotiating different media types do not share entries. HEAD
+// requests are answered from the entries of GET requests.
+func responseCacheKey(out *http.Request) string {
+	return upstreamKey(out) + " " + strings.Join(out.Header.Values("Accept"), ",")
+}
+
+// cachedResponse returns the cached response to out, nil when there is none.
+func (s *client) cachedResponse(out *http.Request, p registrypath.Path) *http.Response {
+	kind := cacheKind(p)
+	if s.responseCache == nil || kind == "" {
+		return nil
+	}
+	e, ok := s.responseCache.Get(responseCacheKey(out))
+	if !ok {
+		metrics.ResponseCacheLookups.WithLabelValues(kind, "miss").Inc()
+		return nil
+	}
+	metrics.ResponseCacheLookups.WithLabelValues(kind, "hit").Inc()
+	return e.Response()
+}
+
+// cacheResponse stores the upstream response to a GET. The body of back is
+// replaced by one that still reads the whole response.
+func (s *client) cacheResponse(out *http.Request, p registrypath.Path, back *http.Response) {
+	kind := cacheKind(p)
+	if s.responseCache == nil || kind == "" || out.Method != http.MethodGet {
+		return
+	}
+	if back.StatusCode != http.StatusOK && back.StatusCode != http.StatusNotFound {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(back.Body, maxManifestSize+1))
+	back.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), back.Body))
+	if err != nil || len(body) > maxManifestSize {
+		return
+	}
+	s.responseCache.Set(responseCacheKey(out), responsecache.Entry{
+		Kind:        kind,
+		Status:      back.StatusCode,
+		ContentType: back.Header.Get("Content-Type"),
+		Digest:      back.Header.Get("Docker-Content-Digest"),
+		Link:        back.Header.Get("Link"),
+		Body:        body,
+	})
+}
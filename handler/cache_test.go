@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/responsecache"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v2/chainguard/cached/manifests/latest":
+				w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+				w.Header().Set("Docker-Content-Digest", "sha256:abc")
+				w.Write([]byte(`{"schemaVersion":2}`))
+			case "/v2/chainguard/cached/tags/list":
+				w.Write([]byte(`{"name":"chainguard/cached","tags":["latest"]}`))
+			default:
+				http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+			}
+		}),
+	}}
+	cache, err := responsecache.New(responsecache.Options{Config: config.ResponseCache{ManifestTTL: "1m", TagsTTL: "1m", NotFoundTTL: "1m"}})
+	assert.NoError(t, err)
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	h := New(Options{
+		Log:           logrus.New(),
+		Transport:     net,
+		Upstream:      &fakeUpstream{},
+		Storage:       repository.NewStorage(db),
+		ResponseCache: cache,
+	})
+	router := gin.New()
+	router.Any("/v2/*path", h.ProxyHandler)
+	do := func(method, path, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", authorization)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := do(http.MethodGet, "/v2/cached/manifests/latest", "Bearer one")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, `{"schemaVersion":2}`, resp.Body.String())
+		assert.Equal(t, "sha256:abc", resp.Header().Get("Docker-Content-Digest"))
+
+		resp = do(http.MethodGet, "/v2/cached/tags/list", "Bearer one")
+		assert.JSONEq(t, `{"name":"cached","tags":["latest"]}`, resp.Body.String())
+
+		resp = do(http.MethodGet, "/v2/cached/manifests/missing", "Bearer one")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	}
+	assert.Equal(t, 3, net.calls["cgr.dev"])
+
+	// HEAD is answered from the GET entry.
+	resp := do(http.MethodHead, "/v2/cached/manifests/latest", "Bearer one")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "sha256:abc", resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, 3, net.calls["cgr.dev"])
+
+	// Other credentials do not share entries.
+	do(http.MethodGet, "/v2/cached/manifests/latest", "Bearer two")
+	assert.Equal(t, 4, net.calls["cgr.dev"])
+}
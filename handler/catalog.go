@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+)
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// CatalogHandler serves GET /v2/_catalog from local state, the upstream
+// has no catalog: the watched images, the images with a recorded digest
+// and the repositories kept for offline mode. Clients only see the
+// repositories they may pull.
+func (s *client) CatalogHandler(ctx *gin.Context) {
+	repositories, err := s.repositories(ctx)
+	if err != nil {
+		s.logger(ctx).Errorf("list repositories %v", err)
+		auth.Error(ctx, http.StatusInternalServerError, "UNKNOWN", "can not list repositories", nil)
+		return
+	}
+	id, identified := auth.IdentityFrom(ctx.Request.Context())
+	allowed := []string{}
+	for _, repo := range repositories {
+		if s.authz == nil || !identified || s.authz.Allowed(id, repo, authz.Pull) {
+			allowed = append(allowed, repo)
+		}
+	}
+	ctx.JSON(http.StatusOK, catalogResponse{Repositories: paginate(ctx, allowed, "/v2/_catalog")})
+}
+
+// repositories returns the repositories the proxy serves, sorted.
+func (s *client) repositories(ctx *gin.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var repositories []string
+	add := func(repo string) {
+		if !seen[repo] {
+			seen[repo] = true
+			repositories = append(repositories, repo)
+		}
+	}
+	for _, img := range s.images {
+		add(proxiedRepository(img.Name))
+	}
+	images, err := s.imageStorage.WithContext(ctx.Request.Context()).ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		add(proxiedRepository(img))
+	}
+	if s.manifests != nil {
+		kept, err := s.manifests.ListRepositories()
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range kept {
+			add(repo)
+		}
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
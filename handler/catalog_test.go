@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	storage := repository.NewStorage(db)
+	manifests := repository.NewManifestStorage(db)
+	// The database is shared with the other tests, names are unique.
+	_, err = storage.SaveDigest("cgr.dev/chainguard/catalog-archived:1.0", "sha256:a")
+	assert.NoError(t, err)
+	_, err = storage.SaveDigest("cgr.dev/chainguard/catalog-archived:1.1", "sha256:b")
+	assert.NoError(t, err)
+	assert.NoError(t, manifests.SaveTag("catalog-team/kept", "latest", "sha256:c"))
+	policy, err := authz.New(authz.Options{Config: config.Authz{Rules: []config.AccessRule{
+		{Subjects: []string{"alice"}, Repositories: []string{"catalog-*"}, Actions: []string{"pull"}},
+	}}, Audit: io.Discard, Log: logrus.New()})
+	assert.NoError(t, err)
+	h := New(Options{
+		Log:       logrus.New(),
+		Storage:   storage,
+		Manifests: manifests,
+		Images:    []config.Image{{Name: "cgr.dev/chainguard/catalog-watched"}, {Name: "cgr.dev/chainguard/catalog-archived"}},
+		Authz:     policy,
+	})
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		if name := ctx.GetHeader("X-User"); name != "" {
+			ctx.Request = ctx.Request.WithContext(auth.WithIdentity(ctx.Request.Context(), auth.Identity{Name: name}))
+		}
+	})
+	router.GET("/v2/_catalog", h.CatalogHandler)
+	list := func(query, user string) ([]string, string) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/_catalog"+query, nil)
+		req.Header.Set("X-User", user)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var catalog catalogResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&catalog))
+		return catalog.Repositories, resp.Header().Get("Link")
+	}
+
+	var all []string
+	for query := "?n=1"; ; {
+		page, link := list(query, "")
+		all = append(all, page...)
+		if link == "" {
+			break
+		}
+		assert.Equal(t, `</v2/_catalog?last=`+url.QueryEscape(page[0])+`&n=1>; rel="next"`, link)
+		query = "?n=1&last=" + page[0]
+	}
+	for _, repo := range []string{"catalog-archived", "catalog-team/kept", "catalog-watched"} {
+		assert.Contains(t, all, repo)
+	}
+	assert.IsIncreasing(t, all)
+
+	// Clients only see what they may pull.
+	repositories, _ := list("", "alice")
+	assert.Contains(t, repositories, "catalog-archived")
+	assert.Contains(t, repositories, "catalog-watched")
+	assert.NotContains(t, repositories, "catalog-team/kept")
+	repositories, _ = list("", "bob")
+	assert.Empty(t, repositories)
+}
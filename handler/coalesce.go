@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/opencontainers/go-digest"
+)
+
+// coalescable returns what is requested when identical concurrent requests
+// can share one upstream response: manifests and tag lists, which are small
+// enough to buffer.
+func coalescable(method string, p registrypath.Path) string {
+	if method != http.MethodGet && method != http.MethodHead {
+		return ""
+	}
+	switch p.Endpoint {
+	case registrypath.Manifests:
+		return "manifest"
+	case registrypath.Tags:
+		return "tags"
+	}
+	return ""
+}
+
+// upstreamKey identifies what out asks upstream for and with which
+// credentials: the URL, and a hash of the client's credentials when they are
+// relayed.
+func upstreamKey(out *http.Request) string {
+	key := out.URL.String()
+	if authorization := out.Header.Get("Authorization"); authorization != "" {
+		sum := sha256.Sum256([]byte(authorization))
+		key += " " + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+type sharedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// coalesce sends out through rt, unless an identical request is in flight:
+// it then waits for that request and gets a copy of its response. Requests
+// are identical when they have the same method, URL, credentials and Accept
+// header, so a client never gets a response sent for another client's
+// credentials or in a media type it did not ask for.
+func (s *client) coalesce(ctx *gin.Context, rt http.RoundTripper, out *http.Request, kind string) (*http.Response, error) {
+	key := out.Method + " " + responseCacheKey(out)
+	leader := false
+	ch := s.flight.DoChan(key, func() (interface{}, error) {
+		leader = true
+		// The other clients still wait when the first one gives up.
+		resp, err := rt.RoundTrip(out.Clone(context.WithoutCancel(out.Context())))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedResponse{resp: resp, body: body}, nil
+	})
+	select {
+	case res := <-ch:
+		if !leader {
+			metrics.UpstreamCoalesced.WithLabelValues(kind).Inc()
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		shared := res.Val.(*sharedResponse)
+		resp := *shared.resp
+		resp.Header = shared.resp.Header.Clone()
+		resp.Body = io.NopCloser(bytes.NewReader(shared.body))
+		return &resp, nil
+	case <-ctx.Request.Context().Done():
+		return nil, ctx.Request.Context().Err()
+	}
+}
+
+// blobFlights tracks the blobs being fetched into the blob cache, so clients
+// asking for the same blob of a repository meanwhile wait and are served
+// from the cache rather than each streaming it from upstream.
+type blobFlights struct {
+	mu      sync.Mutex
+	fetches map[string]chan struct{}
+}
+
+// start returns a done func when the caller fetches dgst of repo, otherwise
+// a channel closed when the client fetching it is done.
+func (f *blobFlights) start(repo string, dgst digest.Digest) (<-chan struct{}, func()) {
+	key := repo + "@" + dgst.String()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if wait, ok := f.fetches[key]; ok {
+		return wait, nil
+	}
+	if f.fetches == nil {
+		f.fetches = make(map[string]chan struct{})
+	}
+	wait := make(chan struct{})
+	f.fetches[key] = wait
+	return nil, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.fetches, key)
+		close(wait)
+	}
+}
+
+// coalesceBlob waits for a fetch of dgst of repo in flight and serves the
+// blob from the cache once it is there, to clients serveCachedBlob serves.
+// It reports whether the request was answered, otherwise the returned func,
+// if any, must be called once the caller is done fetching the blob.
+func (s *client) coalesceBlob(ctx *gin.Context, repo string, dgst digest.Digest) (bool, func()) {
+	if s.blobCache == nil || !authenticated(ctx) || ctx.Request.Method != http.MethodGet || ctx.GetHeader("Range") != "" {
+		return false, nil
+	}
+	wait, done := s.blobFlights.start(repo, dgst)
+	if done != nil {
+		return false, done
+	}
+	metrics.UpstreamCoalesced.WithLabelValues("blob").Inc()
+	select {
+	case <-wait:
+	case <-ctx.Request.Context().Done():
+		return true, nil
+	}
+	// When the fetch failed to fill the cache the client fetches the blob
+	// itself rather than waiting in line again.
+	return s.serveCachedBlob(ctx, repo, dgst), nil
+}
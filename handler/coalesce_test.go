@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/blobcache"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// concurrently sends the requests at once, the upstream holding its
+// responses until they all wait.
+func concurrently(router *gin.Engine, release chan struct{}, reqs []*http.Request) []*httptest.ResponseRecorder {
+	resps := make([]*httptest.ResponseRecorder, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		resps[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(resp *httptest.ResponseRecorder, req *http.Request) {
+			defer wg.Done()
+			router.ServeHTTP(resp, req)
+		}(resps[i], req)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return resps
+}
+
+func TestCoalesceManifests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const manifest = `{"schemaVersion":2}`
+	var calls atomic.Int32
+	release := make(chan struct{})
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifest))
+		}),
+	}}
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	h := New(Options{Log: logrus.New(), Transport: &lockedNetwork{network: net}, Upstream: &fakeUpstream{}, Storage: repository.NewStorage(db)})
+	router := gin.New()
+	router.Any("/v2/*path", h.ProxyHandler)
+
+	var reqs []*http.Request
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/v2/nginx/manifests/sha256:"+strings.Repeat("a", 64), nil)
+		req.Header.Set("Authorization", "Bearer one")
+		reqs = append(reqs, req)
+	}
+	// Another client's credentials get their own request.
+	other := httptest.NewRequest(http.MethodGet, reqs[0].URL.Path, nil)
+	other.Header.Set("Authorization", "Bearer two")
+	reqs = append(reqs, other)
+
+	for _, resp := range concurrently(router, release, reqs) {
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, manifest, resp.Body.String())
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCoalesceBlobs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	blob := []byte(strings.Repeat("layer data ", 10000))
+	dgst := digest.FromBytes(blob)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		}),
+	}}
+	cache, err := blobcache.New(blobcache.Options{Config: config.BlobCache{Dir: t.TempDir()}})
+	assert.NoError(t, err)
+	h := New(Options{Log: logrus.New(), Transport: &lockedNetwork{network: net}, Upstream: &fakeUpstream{}, BlobCache: cache})
+	router := gin.New()
+	router.Use(identify)
+	router.GET("/v2/*path", h.ProxyHandler)
+
+	var reqs []*http.Request
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/v2/nginx/blobs/"+dgst.String(), nil)
+		req.Header.Set("X-User", "alice")
+		reqs = append(reqs, req)
+	}
+	for _, resp := range concurrently(router, release, reqs) {
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, blob, resp.Body.Bytes())
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+// lockedNetwork lets concurrent requests through a network.
+type lockedNetwork struct {
+	mu      sync.Mutex
+	network *network
+}
+
+func (n *lockedNetwork) RoundTrip(req *http.Request) (*http.Response, error) {
+	n.mu.Lock()
+	handler := n.network.hosts[req.URL.Host]
+	n.network.calls[req.URL.Host]++
+	n.mu.Unlock()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
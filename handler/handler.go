@@ -1,66 +1,254 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
-	"github.com/docker/distribution/reference"
 	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/nduyphuong/reverse-registry/config"
 	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/nduyphuong/reverse-registry/services/blobcache"
 	containerregistry "github.com/nduyphuong/reverse-registry/services/container-registry"
+	"github.com/nduyphuong/reverse-registry/services/externalurl"
+	"github.com/nduyphuong/reverse-registry/services/httpclient"
+	"github.com/nduyphuong/reverse-registry/services/logging"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/nduyphuong/reverse-registry/services/responsecache"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
+	"github.com/nduyphuong/reverse-registry/services/upstream"
 	"github.com/nduyphuong/reverse-registry/utils"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type Interface interface {
 	V2Handler(c *gin.Context)
 	TokenHandler(c *gin.Context)
 	ProxyHandler(c *gin.Context)
+	CatalogHandler(c *gin.Context)
+	ArtifactHandler(c *gin.Context)
+	RefreshHandler(c *gin.Context)
+	DistributionWebhookHandler(c *gin.Context)
+	HarborWebhookHandler(c *gin.Context)
+	DockerHubWebhookHandler(c *gin.Context)
+	StatusHandler(c *gin.Context)
 }
 
 type client struct {
 	containerRegistryService containerregistry.Interface
 	imageStorage             repository.Interface
+	refresh                  repository.RefreshInterface
+	images                   []config.Image
+	webhookToken             string
 	log                      *logrus.Logger
+	// transport sends requests upstream without following redirects,
+	// httpClient follows them.
+	transport  http.RoundTripper
+	httpClient *http.Client
+	redaction  *utils.RedactionPolicy
+	// upstreamAuth is set when the proxy authenticates to the upstream
+	// itself rather than relaying the client's credentials.
+	upstreamAuth  bool
+	upstream      upstream.Interface
+	tokens        auth.TokenService
+	authz         authz.Interface
+	blobCache     blobcache.Interface
+	manifests     repository.ManifestInterface
+	circuits      func() map[string]string
+	responseCache responsecache.Interface
+	convert       bool
+	conversions   repository.ConversionInterface
+	// recorded holds the conversions already saved to conversions.
+	recorded  sync.Map
+	artifacts repository.ArtifactInterface
+	// flight and blobFlights coalesce identical upstream requests in
+	// flight.
+	flight      singleflight.Group
+	blobFlights blobFlights
 }
 
 type Options struct {
 	Log     *logrus.Logger
 	Cr      containerregistry.Interface
 	Storage repository.Interface
+	Refresh repository.RefreshInterface
+	// Images watched by the fetcher, refresh requests are only accepted
+	// for these.
+	Images       []config.Image
+	WebhookToken string
+	// Transport used for upstream requests, defaults to an instrumented and
+	// traced http.DefaultTransport.
+	Transport http.RoundTripper
+	// Redaction applied to logged headers and urls, defaults to
+	// utils.NewRedactionPolicy(nil).
+	Redaction *utils.RedactionPolicy
+	// LocalAuth is set when clients authenticate to the proxy itself, see
+	// auth.Middleware. Their credentials are then not sent upstream.
+	LocalAuth bool
+	// Tokens makes /token issue the proxy's own tokens instead of
+	// forwarding to the upstream token endpoint.
+	Tokens auth.TokenService
+	// Upstream provides the upstream credentials and token cache. When it
+	// has credentials for cgr.dev they are used for every client.
+	Upstream upstream.Interface
+	// Authz enforces access rules on authenticated clients, nil allows
+	// everything.
+	Authz authz.Interface
+	// BlobCache keeps the blobs streamed through the proxy, nil disables
+	// it.
+	BlobCache blobcache.Interface
+	// Manifests keeps the manifests and tags passed through, to serve them
+	// while the upstream is down. nil disables offline mode.
+	Manifests repository.ManifestInterface
+	// Circuits reports the state of the upstream circuits on
+	// /api/v1/status.
+	Circuits func() map[string]string
+	// ResponseCache keeps upstream responses to manifests by tag and tag
+	// lists for a short time, nil disables it.
+	ResponseCache responsecache.Interface
+	// Convert serves OCI indexes as Docker manifest lists, and the other
+	// way around, to clients that only accept the other type.
+	Convert bool
+	// Conversions keeps the digests of the converted manifests, so clients
+	// can pull them by the digest they were served with. nil leaves them
+	// unknown upstream.
+	Conversions repository.ConversionInterface
+	// Artifacts keeps the signatures, attestations and SBOMs of the
+	// recorded images, served when asked by tag and when the upstream
+	// dropped them.
+	Artifacts repository.ArtifactInterface
 }
 
 func New(opt Options) Interface {
-	return &client{log: opt.Log, containerRegistryService: opt.Cr, imageStorage: opt.Storage}
+	transport := opt.Transport
+	if transport == nil {
+		transport = tracing.Transport(metrics.InstrumentRoundTripper(http.DefaultTransport))
+	}
+	redaction := opt.Redaction
+	if redaction == nil {
+		redaction = utils.NewRedactionPolicy(nil)
+	}
+	upstreamClient := opt.Upstream
+	if upstreamClient == nil {
+		// Without upstream configs New can not fail.
+		upstreamClient, _ = upstream.New(upstream.Options{Transport: transport})
+	}
+	return &client{
+		log:                      opt.Log,
+		containerRegistryService: opt.Cr,
+		imageStorage:             opt.Storage,
+		refresh:                  opt.Refresh,
+		images:                   opt.Images,
+		webhookToken:             opt.WebhookToken,
+		transport:                transport,
+		httpClient:               &http.Client{Transport: transport},
+		redaction:                redaction,
+		upstreamAuth:             opt.LocalAuth || upstreamClient.Configured("cgr.dev"),
+		upstream:                 upstreamClient,
+		tokens:                   opt.Tokens,
+		authz:                    opt.Authz,
+		blobCache:                opt.BlobCache,
+		manifests:                opt.Manifests,
+		circuits:                 opt.Circuits,
+		responseCache:            opt.ResponseCache,
+		convert:                  opt.Convert,
+		conversions:              opt.Conversions,
+		artifacts:                opt.Artifacts,
+	}
+}
+
+// logger returns the handler logger with the request id and trace id of the
+// request being served.
+func (s *client) logger(ctx *gin.Context) *logrus.Entry {
+	return logging.FromContext(ctx.Request.Context(), s.log)
+}
+
+// authorize checks that the client may do action on repo, answering DENIED
+// when not. Anonymous clients are only let in when authentication is off,
+// so there is nothing to check for them.
+func (s *client) authorize(ctx *gin.Context, repo, action string) bool {
+	if s.authz == nil {
+		return true
+	}
+	id, ok := auth.IdentityFrom(ctx.Request.Context())
+	if !ok {
+		return true
+	}
+	if err := s.authz.Authorize(ctx.Request.Context(), id, repo, action); err != nil {
+		authz.Deny(ctx, repo, action)
+		return false
+	}
+	return true
+}
+
+// authenticated reports whether the client passed local authentication.
+// Relayed clients answer the upstream challenges themselves, the proxy can
+// not tell what they may read.
+func authenticated(ctx *gin.Context) bool {
+	_, ok := auth.IdentityFrom(ctx.Request.Context())
+	return ok
+}
+
+// upstreamTransport returns the transport for requests to repo. Clients that
+// authenticated to the proxy can not answer the upstream challenges, so the
+// proxy gets an upstream token on their behalf with the configured
+// credentials, or anonymously.
+func (s *client) upstreamTransport(ctx context.Context, repo string) (http.RoundTripper, error) {
+	if !s.upstreamAuth {
+		return s.transport, nil
+	}
+	r, err := name.NewRepository("cgr.dev/chainguard/" + repo)
+	if err != nil {
+		return nil, err
+	}
+	return s.upstream.Transport(ctx, r, r.Scope(transport.PullScope))
 }
 
 func (s *client) V2Handler(ctx *gin.Context) {
-	s.log.WithContext(ctx)
-	out, _ := http.NewRequest(ctx.Request.Method, "https://cgr.dev/v2/", nil)
-	s.log.WithFields(logrus.Fields{
+	if s.upstreamAuth {
+		// Clients do not authenticate upstream, there is nothing to
+		// relay.
+		ctx.Header("Docker-Distribution-Api-Version", "registry/2.0")
+		ctx.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	out, _ := http.NewRequestWithContext(ctx.Request.Context(), ctx.Request.Method, "https://cgr.dev/v2/", nil)
+	s.logger(ctx).WithFields(logrus.Fields{
 		"method": out.Method,
-		"url":    out.URL.String(),
-		"header": utils.Redact(ctx.Request.Header),
+		"url":    s.redaction.URL(out.URL),
+		"header": s.redaction.Header(ctx.Request.Header),
 	}).Info("sending request")
 
 	ctx.Writer.Header().Add("X-Redirected", out.URL.String())
 
-	back, err := http.DefaultClient.Do(out)
+	back, err := s.httpClient.Do(out)
 	if err != nil {
-		s.log.Errorf("error sending request: %v", err)
+		s.logger(ctx).Errorf("error sending request: %v", err)
+		if upstreamUnavailable(ctx, err) {
+			return
+		}
 		ctx.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 	defer back.Body.Close()
 
-	s.log.WithFields(logrus.Fields{
+	s.logger(ctx).WithFields(logrus.Fields{
 		"method": out.Method,
-		"url":    out.URL.String(),
+		"url":    s.redaction.URL(out.URL),
 		"status": back.Status,
-		"header": utils.Redact(back.Header),
+		"header": s.redaction.Header(back.Header),
 	}).Info("got response")
 
 	for k, v := range back.Header {
@@ -77,8 +265,7 @@ func (s *client) V2Handler(ctx *gin.Context) {
 	//   Www-Authenticate: Bearer realm="http://$HOST/token",service="cgr.dev"
 	wwwAuth := back.Header.Get("Www-Authenticate")
 	if wwwAuth != "" {
-		rewrittenWwwAuth := strings.Replace(wwwAuth, `https://cgr.dev/`, fmt.Sprintf(`http://%s/`, ctx.Request.Host), 1)
-		ctx.Writer.Header().Set("Www-Authenticate", rewrittenWwwAuth)
+		ctx.Writer.Header().Set("Www-Authenticate", rewriteUpstreamURL(ctx, wwwAuth))
 	}
 	ctx.Writer.WriteHeader(back.StatusCode)
 	if _, err := io.Copy(ctx.Writer, back.Body); err != nil {
@@ -88,36 +275,45 @@ func (s *client) V2Handler(ctx *gin.Context) {
 }
 
 func (s *client) TokenHandler(ctx *gin.Context) {
-	s.log.WithContext(ctx)
+	if s.tokens != nil {
+		s.issueToken(ctx)
+		return
+	}
 	vals := ctx.Request.URL.Query()
 	scope := vals.Get("scope")
 	scope = strings.Replace(scope, "repository:", "repository:chainguard/", 1)
 	vals.Set("scope", scope)
 
 	url := "https://cgr.dev/token?" + vals.Encode()
-	out, _ := http.NewRequest(ctx.Request.Method, url, nil)
+	out, _ := http.NewRequestWithContext(ctx.Request.Context(), ctx.Request.Method, url, nil)
 	out.Header = ctx.Request.Header.Clone()
+	if s.upstreamAuth {
+		out.Header.Del("Authorization")
+	}
 
-	s.log.WithFields(logrus.Fields{
+	s.logger(ctx).WithFields(logrus.Fields{
 		"method": out.Method,
-		"url":    out.URL.String(),
-		"header": utils.Redact(ctx.Request.Header),
+		"url":    s.redaction.URL(out.URL),
+		"header": s.redaction.Header(ctx.Request.Header),
 	}).Info("sending request")
 	ctx.Header("X-Redirected", out.URL.String())
 
-	back, err := http.DefaultClient.Do(out)
+	back, err := s.httpClient.Do(out)
 	if err != nil {
-		s.log.Errorf("error sending request: %v", err)
+		s.logger(ctx).Errorf("error sending request: %v", err)
+		if upstreamUnavailable(ctx, err) {
+			return
+		}
 		ctx.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 	defer back.Body.Close()
 
-	s.log.WithFields(logrus.Fields{
+	s.logger(ctx).WithFields(logrus.Fields{
 		"method": out.Method,
-		"url":    out.URL.String(),
+		"url":    s.redaction.URL(out.URL),
 		"status": back.Status,
-		"header": utils.Redact(back.Header),
+		"header": s.redaction.Header(back.Header),
 	}).Info("got response")
 
 	for k, v := range back.Header {
@@ -128,64 +324,108 @@ func (s *client) TokenHandler(ctx *gin.Context) {
 
 	ctx.Status(back.StatusCode)
 	if _, err := io.Copy(ctx.Writer, back.Body); err != nil {
-		s.log.Errorf("Error copying response body: %v", err)
+		s.logger(ctx).Errorf("Error copying response body: %v", err)
 	}
 }
 
 func (s *client) ProxyHandler(ctx *gin.Context) {
-	// /v2/nginx/manifests/1.25.1-r0
-	a := strings.Split(ctx.Request.URL.Path, "/")
-	image := a[2]
-	ref := a[4]
-	if reference.NameRegexp.MatchString(image) && reference.TagRegexp.MatchString(ref) {
-		// nginx:1.25.1-r0
-		nameWithTag := image + ":" + ref
-		r, err := s.imageStorage.FindByNameTag(nameWithTag)
-		if err != nil {
-			s.log.Errorf("find name tag %v", err)
+	p, err := registrypath.Parse(ctx.Request.URL.Path)
+	if err != nil {
+		var perr *registrypath.Error
+		errors.As(err, &perr)
+		status := http.StatusBadRequest
+		if perr.Code == registrypath.CodeUnsupported {
+			status = http.StatusNotFound
 		}
-		if r.HashedIndex != "" {
-			ctx.Writer.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
-			ctx.Writer.Header().Set("Docker-Content-Digest", r.HashedIndex)
-			ctx.Writer.Header().Set("Content-Length", "0")
-			ctx.Status(http.StatusOK)
-			s.log.Info("sent response from local db")
+		auth.Error(ctx, status, perr.Code, perr.Message, nil)
+		return
+	}
+	action := authz.Pull
+	if p.Endpoint == registrypath.Tags {
+		action = authz.List
+	}
+	if !s.authorize(ctx, p.Repository, action) {
+		return
+	}
+	if s.serveArtifactTag(ctx, p) {
+		return
+	}
+	source, convertTo := s.convertedSource(ctx, p)
+	if tag, ok := p.Tag(); ok {
+		if dgst := s.localDigest(ctx, p.Repository, tag); dgst != "" {
+			if s.serveLocalManifest(ctx, p, dgst) {
+				return
+			}
+			// Upstream does not have the tags recorded locally, it is
+			// asked for the digest instead.
+			source.Reference = dgst
+		}
+	}
+	metrics.ProxyLookups.WithLabelValues(metrics.LookupUpstream).Inc()
+	s.logger(ctx).Debugf("repo: %v", p.Repository)
+	dgst, isBlob := p.Digest()
+	isBlob = isBlob && p.Endpoint == registrypath.Blobs
+	if isBlob && s.serveCachedBlob(ctx, p.Repository, dgst) {
+		return
+	}
+	if isBlob {
+		served, done := s.coalesceBlob(ctx, p.Repository, dgst)
+		if served {
 			return
 		}
+		if done != nil {
+			defer done()
+		}
 	}
-	repo := ctx.Param("repo")
-	fmt.Printf("repo: %v\n", repo)
-	rest := ctx.Param("rest")
-	fmt.Printf("rest: %v\n", rest)
-	url := fmt.Sprintf("https://cgr.dev/v2/chainguard/%s%s", repo, rest)
+	url := fmt.Sprintf("https://cgr.dev/v2/chainguard/%s%s", source.Repository, source.Rest())
 	if query := ctx.Request.URL.Query().Encode(); query != "" {
 		url += "?" + query
 	}
-	out, _ := http.NewRequest(ctx.Request.Method, url, nil)
+	out, _ := http.NewRequestWithContext(ctx.Request.Context(), ctx.Request.Method, url, nil)
 	out.Header = ctx.Request.Header.Clone()
+	if s.upstreamAuth {
+		out.Header.Del("Authorization")
+	}
+	s.widenAccept(out, p, convertTo)
 
-	s.log.WithFields(logrus.Fields{
-		"method": out.Method,
-		"url":    out.URL.String(),
-		"header": utils.Redact(out.Header),
-	}).Info("sending request")
 	ctx.Header("X-Redirected", out.URL.String())
-
-	back, err := http.DefaultTransport.RoundTrip(out) // Transport doesn't follow redirects.
-	if err != nil {
-		s.log.Errorf("Error sending request: %v", err)
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, err)
-		return
+	back := s.cachedResponse(out, p)
+	cached := back != nil
+	if !cached {
+		if back = s.sendUpstream(ctx, p, out); back == nil {
+			return
+		}
 	}
 	defer back.Body.Close()
+	if back.StatusCode >= http.StatusInternalServerError && s.serveOffline(ctx, p) {
+		return
+	}
+	if p.Endpoint == registrypath.Referrers && back.StatusCode == http.StatusNotFound && s.synthesizeReferrers(ctx, p, out) {
+		return
+	}
+	if back.StatusCode == http.StatusNotFound && s.serveMissingArtifact(ctx, p) {
+		return
+	}
 
-	s.log.WithFields(logrus.Fields{
+	s.logger(ctx).WithFields(logrus.Fields{
 		"method": out.Method,
-		"url":    out.URL.String(),
+		"url":    s.redaction.URL(out.URL),
 		"status": back.Status,
-		"header": utils.Redact(back.Header),
+		"header": s.redaction.Header(back.Header),
 		"body":   back.Body,
 	}).Info("got response")
+	if isBlob && s.proxyBlob(ctx, back, p.Repository, dgst) {
+		return
+	}
+	if p.Endpoint == registrypath.Manifests {
+		if !cached {
+			s.keepManifest(ctx, source, back)
+		}
+		if !s.negotiate(ctx, p, back, convertTo) {
+			auth.Error(ctx, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown", nil)
+			return
+		}
+	}
 	// Copy response headers.
 	for k, v := range back.Header {
 		for _, vv := range v {
@@ -201,8 +441,7 @@ func (s *client) ProxyHandler(ctx *gin.Context) {
 	//   Www-Authenticate: Bearer realm="http://$HOST/token",service="cgr.dev"
 	wwwAuth := back.Header.Get("Www-Authenticate")
 	if wwwAuth != "" {
-		rewrittenWwwAuth := strings.Replace(wwwAuth, `://cgr.dev/`, fmt.Sprintf(`://%s/`, ctx.Request.Host), 1)
-		ctx.Header("Www-Authenticate", rewrittenWwwAuth)
+		ctx.Header("Www-Authenticate", rewriteUpstreamURL(ctx, wwwAuth))
 	}
 
 	// List responses may include a response header to support pagination, that looks like:
@@ -213,17 +452,22 @@ func (s *client) ProxyHandler(ctx *gin.Context) {
 	//   Link: </v2/static/repo/tags/list?n=100&last=blah>; rel="next">
 	link := back.Header.Get("Link")
 	if link != "" {
-		rewrittenLink := strings.Replace(link, "/v2/chainguard/", "/v2/", 1)
-		ctx.Header("Link", rewrittenLink)
+		ctx.Header("Link", rewriteRepositoryURL(ctx, link))
+	}
+
+	// Redirects to upstream repositories, e.g. for blobs, are rewritten the
+	// same way so clients keep talking to the proxy.
+	if location := back.Header.Get("Location"); location != "" {
+		ctx.Header("Location", rewriteRepositoryURL(ctx, location))
 	}
 
 	// If it's a list request, rewrite the response so the name key matches the
 	// user's requested repo, otherwise clients will repeatedly request the
 	// first page looking for their repo's tags.
-	if strings.Contains(ctx.Request.URL.Path, "/tags/list") {
+	if p.Endpoint == registrypath.Tags {
 		var lr listResponse
 		if err := json.NewDecoder(back.Body).Decode(&lr); err != nil {
-			s.log.Errorf("Error decoding list response body: %v", err)
+			s.logger(ctx).Errorf("Error decoding list response body: %v", err)
 			ctx.AbortWithStatusJSON(http.StatusInternalServerError, err)
 			return
 		}
@@ -237,23 +481,109 @@ func (s *client) ProxyHandler(ctx *gin.Context) {
 		ctx.Header("Content-Length", "")
 		ctx.Status(back.StatusCode)
 		if err := json.NewEncoder(ctx.Writer).Encode(lr); err != nil {
-			s.log.Errorf("Error encoding list response body: %v", err)
+			s.logger(ctx).Errorf("Error encoding list response body: %v", err)
 			ctx.AbortWithStatusJSON(http.StatusInternalServerError, err)
 		}
 
 		return
-	} else {
-		ctx.Status(back.StatusCode)
+	}
+	ctx.Status(back.StatusCode)
+	if ctx.Request.Method == http.MethodHead {
+		// HEAD requests sent upstream as GET to be converted.
+		return
 	}
 
 	// Copy response body.
 	if _, err := io.Copy(ctx.Writer, back.Body); err != nil {
-		s.log.Errorf("Error copying response body: %v", err)
+		s.logger(ctx).Errorf("Error copying response body: %v", err)
 	}
 
 }
 
+// sendUpstream sends out to the upstream, answering the client itself when
+// that fails, in which case it returns nil.
+func (s *client) sendUpstream(ctx *gin.Context, p registrypath.Path, out *http.Request) *http.Response {
+	s.logger(ctx).WithFields(logrus.Fields{
+		"method": out.Method,
+		"url":    s.redaction.URL(out.URL),
+		"header": s.redaction.Header(out.Header),
+	}).Info("sending request")
+	upstream, err := s.upstreamTransport(ctx.Request.Context(), p.Repository)
+	if err != nil {
+		s.logger(ctx).Errorf("Error authenticating upstream: %v", err)
+		if upstreamDown(err) && s.serveOffline(ctx, p) {
+			return nil
+		}
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, err)
+		return nil
+	}
+	var back *http.Response
+	if kind := coalescable(out.Method, p); kind != "" {
+		back, err = s.coalesce(ctx, upstream, out, kind)
+	} else {
+		back, err = upstream.RoundTrip(out) // Transport doesn't follow redirects.
+	}
+	if err != nil {
+		s.logger(ctx).Errorf("Error sending request: %v", err)
+		if (upstreamDown(err) && s.serveOffline(ctx, p)) || upstreamUnavailable(ctx, err) {
+			return nil
+		}
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, err)
+		return nil
+	}
+	s.cacheResponse(out, p, back)
+	return back
+}
+
+// upstreamUnavailable answers 503 when err is the circuit breaker failing
+// fast, so clients back off instead of seeing a server error.
+func upstreamUnavailable(ctx *gin.Context, err error) bool {
+	if !errors.Is(err, httpclient.ErrCircuitOpen) {
+		return false
+	}
+	auth.Error(ctx, http.StatusServiceUnavailable, "UNAVAILABLE", "upstream unavailable", nil)
+	return true
+}
+
 type listResponse struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
 }
+
+// rewriteUpstreamURL points the cgr.dev URLs in a response header to the
+// public base URL of the proxy.
+func rewriteUpstreamURL(ctx *gin.Context, value string) string {
+	base := externalurl.From(ctx.Request) + "/"
+	value = strings.Replace(value, "https://cgr.dev/", base, 1)
+	return strings.Replace(value, "http://cgr.dev/", base, 1)
+}
+
+// rewriteRepositoryURL rewrites a Link or Location to upstream repository
+// paths, absolute or relative, to the repository the client asked for:
+//
+//	</v2/chainguard/static/tags/list?n=100>; rel="next"
+//	</v2/static/tags/list?n=100>; rel="next"
+//
+// URLs of other hosts, e.g. blob storage redirects, are left alone.
+func rewriteRepositoryURL(ctx *gin.Context, value string) string {
+	base := externalurl.From(ctx.Request)
+	prefix := ""
+	if u, err := url.Parse(base); err == nil {
+		prefix = strings.TrimSuffix(u.Path, "/")
+	}
+	value = rewriteUpstreamURL(ctx, value)
+	link := strings.HasPrefix(value, "<")
+	target := strings.TrimPrefix(value, "<")
+	switch {
+	case strings.HasPrefix(target, base+"/v2/chainguard/"):
+		target = base + "/v2/" + strings.TrimPrefix(target, base+"/v2/chainguard/")
+	case strings.HasPrefix(target, "/v2/"):
+		target = prefix + strings.Replace(target, "/v2/chainguard/", "/v2/", 1)
+	default:
+		return value
+	}
+	if link {
+		return "<" + target
+	}
+	return target
+}
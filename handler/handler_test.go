@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/externalurl"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteUpstreamURLs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prefixed, err := externalurl.New(externalurl.Options{PublicURL: "https://example.com/registry"})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		setup   func(r *http.Request)
+		base    externalurl.Interface
+		rewrite func(*gin.Context, string) string
+		value   string
+		want    string
+	}{
+		{"realm", func(r *http.Request) {}, nil, rewriteUpstreamURL, `Bearer realm="https://cgr.dev/token",service="cgr.dev"`, `Bearer realm="http://registry.local/token",service="cgr.dev"`},
+		{"realm over tls", func(r *http.Request) { r.TLS = &tls.ConnectionState{} }, nil, rewriteUpstreamURL, `Bearer realm="https://cgr.dev/token",service="cgr.dev"`, `Bearer realm="https://registry.local/token",service="cgr.dev"`},
+		{"realm with public url", func(r *http.Request) {}, prefixed, rewriteUpstreamURL, `Bearer realm="https://cgr.dev/token",service="cgr.dev"`, `Bearer realm="https://example.com/registry/token",service="cgr.dev"`},
+		{"relative link", func(r *http.Request) {}, nil, rewriteRepositoryURL, `</v2/chainguard/nginx/tags/list?n=1&last=a>; rel="next"`, `</v2/nginx/tags/list?n=1&last=a>; rel="next"`},
+		{"absolute link", func(r *http.Request) {}, prefixed, rewriteRepositoryURL, `<https://cgr.dev/v2/chainguard/nginx/tags/list?n=1>; rel="next"`, `<https://example.com/registry/v2/nginx/tags/list?n=1>; rel="next"`},
+		{"relative link with public url", func(r *http.Request) {}, prefixed, rewriteRepositoryURL, `</v2/chainguard/nginx/tags/list?n=1>; rel="next"`, `</registry/v2/nginx/tags/list?n=1>; rel="next"`},
+		{"location", func(r *http.Request) {}, nil, rewriteRepositoryURL, `https://cgr.dev/v2/chainguard/nginx/blobs/sha256:abc`, `http://registry.local/v2/nginx/blobs/sha256:abc`},
+		{"storage location", func(r *http.Request) {}, nil, rewriteRepositoryURL, `https://storage.example/v2/chainguard/blob?sig=x`, `https://storage.example/v2/chainguard/blob?sig=x`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request = httptest.NewRequest(http.MethodGet, "http://registry.local/v2/", nil)
+			tc.setup(ctx.Request)
+			if tc.base != nil {
+				externalurl.Middleware(tc.base)(ctx)
+			}
+			assert.Equal(t, tc.want, tc.rewrite(ctx, tc.value))
+		})
+	}
+}
+
+func TestNestedRepositories(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var upstreamPaths []string
+	const index = `{"schemaVersion":2,"manifests":[]}`
+	local := digest.FromString(index)
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamPaths = append(upstreamPaths, r.URL.Path)
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				w.Header().Set("Docker-Content-Digest", local.String())
+				w.Write([]byte(index))
+				return
+			}
+			w.Write([]byte(`{"name":"chainguard/team/nginx","tags":["1.25"]}`))
+		}),
+	}}
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	storage := repository.NewStorage(db)
+	_, err = storage.SaveDigest("cgr.dev/chainguard/team/nginx:1.24", local.String())
+	assert.NoError(t, err)
+	h := New(Options{Log: logrus.New(), Transport: net, Upstream: &fakeUpstream{}, Storage: storage})
+	router := gin.New()
+	router.Any("/v2/*path", h.ProxyHandler)
+	do := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		return resp
+	}
+
+	// Tags recorded locally are asked upstream by digest.
+	resp := do("/v2/team/nginx/manifests/1.24")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, local.String(), resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, index, resp.Body.String())
+
+	resp = do("/v2/team/nginx/tags/list")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"name":"team/nginx","tags":["1.25"]}`, resp.Body.String())
+	assert.Equal(t, []string{"/v2/chainguard/team/nginx/manifests/" + local.String(), "/v2/chainguard/team/nginx/tags/list"}, upstreamPaths)
+
+	resp = do("/v2/team/Nginx/manifests/1.24")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "NAME_INVALID")
+	resp = do("/v2/team/nginx/blobs/uploads/")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Len(t, upstreamPaths, 2)
+}
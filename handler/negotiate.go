@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/mediatype"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// convertible reports whether the manifest asked for may be converted to a
+// media type the client accepts. Only manifests by tag are: a manifest by
+// digest must be served as is to match its digest, unless it is the digest
+// of a conversion, see convertedSource.
+func (s *client) convertible(p registrypath.Path) bool {
+	_, ok := p.Tag()
+	return s.convert && ok
+}
+
+// convertedSource returns the path of the upstream manifest a manifest by
+// digest was converted from, and the media type it was converted to. Other
+// requests are returned unchanged, with an empty media type.
+func (s *client) convertedSource(ctx *gin.Context, p registrypath.Path) (registrypath.Path, string) {
+	dgst, ok := p.Digest()
+	if !s.convert || s.conversions == nil || !ok || p.Endpoint != registrypath.Manifests {
+		return p, ""
+	}
+	c, err := s.conversions.FindConversion(p.Repository, dgst.String())
+	if err != nil {
+		s.logger(ctx).Errorf("find conversion %v", err)
+		return p, ""
+	}
+	if c.Source == "" {
+		return p, ""
+	}
+	p.Reference = c.Source
+	return p, c.MediaType
+}
+
+// widenAccept asks upstream for the counterparts of the list types the
+// client accepts, so they can be converted, or for the type a conversion
+// asked by digest was converted from. Converting needs the body, so HEAD
+// requests are sent as GET.
+func (s *client) widenAccept(out *http.Request, p registrypath.Path, convertTo string) {
+	widened := false
+	if convertTo != "" {
+		from, _ := mediatype.Counterpart(convertTo)
+		out.Header.Set("Accept", from)
+		widened = true
+	} else if s.convertible(p) {
+		accept := out.Header.Values("Accept")
+		for _, t := range []string{mediatype.OCIIndex, mediatype.DockerManifestList} {
+			counterpart, _ := mediatype.Counterpart(t)
+			if len(accept) > 0 && mediatype.Accepts(accept, t) && !mediatype.Accepts(accept, counterpart) {
+				out.Header.Add("Accept", counterpart)
+				widened = true
+			}
+		}
+	}
+	if widened && out.Method == http.MethodHead {
+		out.Method = http.MethodGet
+	}
+}
+
+// negotiate converts the manifest of back when the client does not accept
+// its media type but accepts its counterpart, replacing the body and the
+// headers describing it, and records the conversion so its digest can be
+// pulled. Manifests neither type fits, or that fail to convert, are served
+// as is. Conversions asked by digest are converted to convertTo, it reports
+// false when that does not give back the digest asked for.
+func (s *client) negotiate(ctx *gin.Context, p registrypath.Path, back *http.Response, convertTo string) bool {
+	if back.StatusCode != http.StatusOK || (convertTo == "" && !s.convertible(p)) {
+		return true
+	}
+	mediaType := back.Header.Get("Content-Type")
+	counterpart, ok := convertTo, convertTo != ""
+	if !ok {
+		if counterpart, ok = s.counterpart(ctx, mediaType); !ok {
+			return true
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(back.Body, maxManifestSize+1))
+	back.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), back.Body))
+	if err != nil || len(body) > maxManifestSize {
+		return convertTo == ""
+	}
+	converted, ok := s.convertManifest(ctx, p.Repository, body, mediaType, counterpart)
+	dgst := digest.FromBytes(converted)
+	if want, _ := p.Digest(); convertTo != "" && (!ok || dgst != want) {
+		s.logger(ctx).WithField("digest", want).Error("converted manifest does not match its digest")
+		return false
+	}
+	if !ok {
+		return true
+	}
+	back.Body = io.NopCloser(bytes.NewReader(converted))
+	back.ContentLength = int64(len(converted))
+	back.Header.Set("Content-Type", counterpart)
+	back.Header.Set("Content-Length", strconv.Itoa(len(converted)))
+	back.Header.Set("Docker-Content-Digest", dgst.String())
+	back.Header.Del("Etag")
+	return true
+}
+
+// counterpart returns the media type to convert a manifest of mediaType to
+// for the client, false when it is served as is.
+func (s *client) counterpart(ctx *gin.Context, mediaType string) (string, bool) {
+	accept := ctx.Request.Header.Values("Accept")
+	counterpart, ok := mediatype.Counterpart(mediaType)
+	if !ok || mediatype.Accepts(accept, mediaType) || !mediatype.Accepts(accept, counterpart) {
+		return "", false
+	}
+	return counterpart, true
+}
+
+// convertManifest converts the manifest body of repo and records the
+// conversion.
+func (s *client) convertManifest(ctx *gin.Context, repo string, body []byte, from, to string) ([]byte, bool) {
+	converted, err := mediatype.Convert(body, to)
+	if err != nil {
+		s.logger(ctx).Errorf("convert manifest %v", err)
+		return nil, false
+	}
+	metrics.ManifestConversions.WithLabelValues(from, to).Inc()
+	s.recordConversion(ctx, model.ManifestConversion{
+		Repository: repo,
+		Digest:     digest.FromBytes(converted).String(),
+		Source:     digest.FromBytes(body).String(),
+		MediaType:  to,
+	})
+	return converted, true
+}
+
+// recordConversion saves c once per process.
+func (s *client) recordConversion(ctx *gin.Context, c model.ManifestConversion) {
+	if s.conversions == nil {
+		return
+	}
+	key := c.Repository + "@" + c.Digest
+	if _, ok := s.recorded.Load(key); ok {
+		return
+	}
+	if err := s.conversions.SaveConversion(c); err != nil {
+		s.logger(ctx).WithFields(logrus.Fields{"repo": c.Repository, "digest": c.Digest}).Errorf("save conversion %v", err)
+		return
+	}
+	s.recorded.Store(key, true)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/mediatype"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const index = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	const list = `{"manifests":[],"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","schemaVersion":2}`
+	var seen *http.Request
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r
+			w.Header().Set("Content-Type", mediatype.OCIIndex)
+			w.Header().Set("Docker-Content-Digest", digest.FromString(index).String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(index)))
+			w.Write([]byte(index))
+		}),
+	}}
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	storage := repository.NewStorage(db)
+	local := digest.FromString(index).String()
+	_, err = storage.SaveDigest("cgr.dev/chainguard/negotiate:local", local)
+	assert.NoError(t, err)
+	router := func(convert bool) *gin.Engine {
+		h := New(Options{
+			Log:         logrus.New(),
+			Transport:   net,
+			Upstream:    &fakeUpstream{},
+			Storage:     storage,
+			Convert:     convert,
+			Conversions: repository.NewConversionStorage(db),
+			Manifests:   repository.NewManifestStorage(db),
+		})
+		router := gin.New()
+		router.Use(identify)
+		router.Any("/v2/*path", h.ProxyHandler)
+		return router
+	}
+	do := func(router *gin.Engine, method, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	converting := router(true)
+
+	for _, tc := range []struct {
+		name   string
+		router *gin.Engine
+		path   string
+		accept string
+		want   string
+	}{
+		{"accepted", converting, "/v2/negotiate/manifests/latest", mediatype.OCIIndex + "," + mediatype.DockerManifestList, index},
+		{"anything", converting, "/v2/negotiate/manifests/latest", "", index},
+		{"converted", converting, "/v2/negotiate/manifests/latest", mediatype.DockerManifestList, list},
+		{"by digest", converting, "/v2/negotiate/manifests/" + digest.FromString(index).String(), mediatype.DockerManifestList, index},
+		{"disabled", router(false), "/v2/negotiate/manifests/latest", mediatype.DockerManifestList, index},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := do(tc.router, http.MethodGet, tc.path, tc.accept)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, tc.want, resp.Body.String())
+			assert.Equal(t, digest.FromString(tc.want).String(), resp.Header().Get("Docker-Content-Digest"))
+			assert.Equal(t, strconv.Itoa(len(tc.want)), resp.Header().Get("Content-Length"))
+		})
+	}
+
+	// Upstream is asked for what can be converted, with a GET for HEAD
+	// requests to have the body to convert.
+	resp := do(converting, http.MethodHead, "/v2/negotiate/manifests/latest", mediatype.DockerManifestList)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+	assert.Equal(t, mediatype.DockerManifestList, resp.Header().Get("Content-Type"))
+	assert.Equal(t, digest.FromString(list).String(), resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, http.MethodGet, seen.Method)
+	assert.Equal(t, []string{mediatype.DockerManifestList, mediatype.OCIIndex}, seen.Header.Values("Accept"))
+
+	// The converted manifest is pulled by the digest it was served with,
+	// converted again from the upstream one.
+	converted := digest.FromString(list).String()
+	resp = do(converting, http.MethodGet, "/v2/negotiate/manifests/"+converted, mediatype.DockerManifestList+","+mediatype.OCIManifest)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, list, resp.Body.String())
+	assert.Equal(t, converted, resp.Header().Get("Docker-Content-Digest"))
+	assert.Equal(t, mediatype.DockerManifestList, resp.Header().Get("Content-Type"))
+	assert.Equal(t, "/v2/chainguard/negotiate/manifests/"+digest.FromString(index).String(), seen.URL.Path)
+	assert.Equal(t, []string{mediatype.OCIIndex}, seen.Header.Values("Accept"))
+	resp = do(converting, http.MethodHead, "/v2/negotiate/manifests/"+converted, mediatype.DockerManifestList)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, converted, resp.Header().Get("Docker-Content-Digest"))
+	resp = do(router(false), http.MethodGet, "/v2/negotiate/manifests/"+converted, mediatype.DockerManifestList)
+	assert.Equal(t, "/v2/chainguard/negotiate/manifests/"+converted, seen.URL.Path)
+
+	// Tags recorded locally are served with their manifest, converted for
+	// clients not taking OCI indexes.
+	for _, tc := range []struct {
+		name   string
+		user   string
+		accept string
+		want   string
+	}{
+		{"local index", "", mediatype.OCIIndex, index},
+		{"local list", "", mediatype.DockerManifestList, list},
+		{"kept index", "alice", mediatype.OCIIndex, index},
+		{"kept list", "alice", mediatype.DockerManifestList, list},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := net.calls["cgr.dev"]
+			req := httptest.NewRequest(http.MethodGet, "/v2/negotiate/manifests/local", nil)
+			req.Header.Set("Accept", tc.accept)
+			req.Header.Set("X-User", tc.user)
+			resp := httptest.NewRecorder()
+			converting.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, tc.want, resp.Body.String())
+			assert.Equal(t, digest.FromString(tc.want).String(), resp.Header().Get("Docker-Content-Digest"))
+			assert.Equal(t, strconv.Itoa(len(tc.want)), resp.Header().Get("Content-Length"))
+			if tc.user == "" {
+				// Relayed clients get it from upstream, by digest.
+				assert.Equal(t, "/v2/chainguard/negotiate/manifests/"+local, seen.URL.Path)
+				assert.Equal(t, calls+1, net.calls["cgr.dev"])
+			} else {
+				assert.Equal(t, calls, net.calls["cgr.dev"])
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/httpclient"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// offlineWarning is set on responses served from local state because the
+// upstream could not be reached.
+const offlineWarning = `110 - "upstream unavailable, served from local state"`
+
+// maxManifestSize bounds the manifests kept for offline use, registries
+// refuse larger ones anyway.
+const maxManifestSize = 4 << 20
+
+// keepManifest stores a manifest on its way to the client, and the tag it
+// was asked for, so it can be served while the upstream is down. The body
+// of back is replaced by one that still reads the whole manifest.
+func (s *client) keepManifest(ctx *gin.Context, p registrypath.Path, back *http.Response) {
+	if s.manifests == nil || p.Endpoint != registrypath.Manifests || ctx.Request.Method != http.MethodGet || back.StatusCode != http.StatusOK {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(back.Body, maxManifestSize+1))
+	back.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), back.Body))
+	if err != nil || len(body) > maxManifestSize {
+		return
+	}
+	dgst := digest.FromBytes(body)
+	if want, ok := p.Digest(); ok {
+		if dgst = want.Algorithm().FromBytes(body); dgst != want {
+			s.logger(ctx).WithField("digest", want).Error("manifest does not match its digest")
+			return
+		}
+	}
+	m := model.Manifest{Repository: p.Repository, Digest: dgst.String(), MediaType: back.Header.Get("Content-Type"), Content: body}
+	if err := s.manifests.SaveManifest(m); err != nil {
+		s.logger(ctx).Errorf("save manifest %v", err)
+		return
+	}
+	if tag, ok := p.Tag(); ok {
+		if err := s.manifests.SaveTag(p.Repository, tag, m.Digest); err != nil {
+			s.logger(ctx).Errorf("save tag %v", err)
+		}
+	}
+}
+
+// upstreamDown reports whether err, of a request sent upstream, says the
+// upstream can not be reached: its circuit is open, the connection failed or
+// timed out. Other errors, e.g. of certificates or credentials, are not
+// hidden by offline mode.
+func upstreamDown(err error) bool {
+	if errors.Is(err, httpclient.ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &opErr) || errors.As(err, &dnsErr)
+}
+
+// serveOffline answers a request the upstream failed from the manifests
+// and tags kept by keepManifest. It reports whether it did. Only clients
+// that passed local authentication, and so the access rules of the
+// repository, are served: what is kept may have been pulled with the
+// credentials of another client. Blobs are already served from the blob
+// cache before asking upstream.
+func (s *client) serveOffline(ctx *gin.Context, p registrypath.Path) bool {
+	if s.manifests == nil || !authenticated(ctx) {
+		return false
+	}
+	switch p.Endpoint {
+	case registrypath.Manifests:
+		return s.serveOfflineManifest(ctx, p)
+	case registrypath.Tags:
+		return s.serveOfflineTags(ctx, p.Repository)
+	}
+	return false
+}
+
+func (s *client) serveOfflineManifest(ctx *gin.Context, p registrypath.Path) bool {
+	dgst := p.Reference
+	if tag, ok := p.Tag(); ok {
+		t, err := s.manifests.FindTag(p.Repository, tag)
+		if err != nil {
+			s.logger(ctx).Errorf("find tag %v", err)
+			return false
+		}
+		dgst = t.Digest
+	}
+	m := s.findManifest(ctx, p.Repository, dgst)
+	if m == nil {
+		return false
+	}
+	s.logger(ctx).WithFields(logrus.Fields{"repo": p.Repository, "reference": p.Reference}).Warn("sent manifest from local state")
+	metrics.ProxyLookups.WithLabelValues(metrics.LookupOffline).Inc()
+	ctx.Header("Warning", offlineWarning)
+	s.serveManifest(ctx, p, m)
+	return true
+}
+
+// localDigest returns the index digest the fetcher recorded for tag of
+// repo, empty when there is none.
+func (s *client) localDigest(ctx *gin.Context, repo, tag string) string {
+	// cgr.dev/chainguard/nginx:1.25.1-r0
+	nameWithTag := watchedImage(repo) + ":" + tag
+	r, err := s.imageStorage.WithContext(ctx.Request.Context()).FindByNameTag(nameWithTag)
+	if err != nil {
+		s.logger(ctx).Errorf("find name tag %v", err)
+		return ""
+	}
+	if r == nil {
+		return ""
+	}
+	return r.HashedIndex
+}
+
+// serveLocalManifest answers a tag recorded by the fetcher with the manifest
+// kept for its digest, to the clients serveOffline serves. It reports
+// whether it did.
+func (s *client) serveLocalManifest(ctx *gin.Context, p registrypath.Path, dgst string) bool {
+	if s.manifests == nil || !authenticated(ctx) {
+		return false
+	}
+	m := s.findManifest(ctx, p.Repository, dgst)
+	if m == nil {
+		return false
+	}
+	s.logger(ctx).Info("sent response from local db")
+	metrics.ProxyLookups.WithLabelValues(metrics.LookupLocal).Inc()
+	s.serveManifest(ctx, p, m)
+	return true
+}
+
+// findManifest returns the manifest dgst kept for repo, nil when there is
+// none.
+func (s *client) findManifest(ctx *gin.Context, repo, dgst string) *model.Manifest {
+	if dgst == "" {
+		return nil
+	}
+	m, err := s.manifests.FindManifest(repo, dgst)
+	if err != nil {
+		s.logger(ctx).Errorf("find manifest %v", err)
+		return nil
+	}
+	if m.Digest == "" {
+		return nil
+	}
+	return m
+}
+
+// serveManifest writes a kept manifest, converted to the media type the
+// client accepts when asked by tag.
+func (s *client) serveManifest(ctx *gin.Context, p registrypath.Path, m *model.Manifest) {
+	if s.convertible(p) {
+		if to, ok := s.counterpart(ctx, m.MediaType); ok {
+			if converted, ok := s.convertManifest(ctx, p.Repository, m.Content, m.MediaType, to); ok {
+				m = &model.Manifest{Repository: m.Repository, Digest: digest.FromBytes(converted).String(), MediaType: to, Content: converted}
+			}
+		}
+	}
+	ctx.Header("Docker-Content-Digest", m.Digest)
+	ctx.Header("Content-Length", strconv.Itoa(len(m.Content)))
+	ctx.Header("Content-Type", m.MediaType)
+	ctx.Status(http.StatusOK)
+	if ctx.Request.Method != http.MethodHead {
+		_, _ = ctx.Writer.Write(m.Content)
+	}
+}
+
+// serveOfflineTags lists the tags seen for repo, with the n and last
+// pagination parameters of the distribution spec.
+func (s *client) serveOfflineTags(ctx *gin.Context, repo string) bool {
+	tags, err := s.manifests.ListTags(repo)
+	if err != nil {
+		s.logger(ctx).Errorf("list tags %v", err)
+		return false
+	}
+	if len(tags) == 0 {
+		return false
+	}
+	tags = paginate(ctx, tags, "/v2/"+repo+"/tags/list")
+	s.logger(ctx).WithField("repo", repo).Warn("sent tags from local state")
+	metrics.ProxyLookups.WithLabelValues(metrics.LookupOffline).Inc()
+	ctx.Header("Warning", offlineWarning)
+	ctx.JSON(http.StatusOK, listResponse{Name: repo, Tags: tags})
+	return true
+}
+
+// paginate returns the page of sorted names asked for with the n and last
+// parameters of the distribution spec, setting a Link to the next page of
+// path when there is one.
+func paginate(ctx *gin.Context, names []string, path string) []string {
+	if last := ctx.Query("last"); last != "" {
+		names = names[sort.SearchStrings(names, last):]
+		if len(names) > 0 && names[0] == last {
+			names = names[1:]
+		}
+	}
+	if n, err := strconv.Atoi(ctx.Query("n")); err == nil && n >= 0 && n < len(names) {
+		names = names[:n]
+		if n > 0 {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {names[n-1]}}
+			ctx.Header("Link", rewriteRepositoryURL(ctx, "<"+path+"?"+next.Encode()+`>; rel="next"`))
+		}
+	}
+	return names
+}
+
+// StatusHandler serves GET /api/v1/status, reporting the upstream circuits
+// and whether the proxy is degraded because one of them is not closed.
+func (s *client) StatusHandler(ctx *gin.Context) {
+	upstreams := map[string]string{}
+	if s.circuits != nil {
+		upstreams = s.circuits()
+	}
+	status := "ok"
+	for _, state := range upstreams {
+		if state != "closed" {
+			status = "degraded"
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":    status,
+		"upstreams": upstreams,
+	})
+}
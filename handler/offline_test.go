@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const mediaType = "application/vnd.oci.image.index.v1+json"
+	manifests := map[string]string{
+		"latest": `{"schemaVersion":2,"manifests":[]}`,
+		"1.25":   `{"schemaVersion":2,"manifests":[{}]}`,
+	}
+	down := false
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Write([]byte(manifests[r.URL.Path[len("/v2/chainguard/offline/manifests/"):]]))
+		}),
+	}}
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	h := New(Options{
+		Log:       logrus.New(),
+		Transport: net,
+		Upstream:  &fakeUpstream{},
+		Storage:   repository.NewStorage(db),
+		Manifests: repository.NewManifestStorage(db),
+	})
+	router := gin.New()
+	router.Use(identify)
+	router.Any("/v2/*path", h.ProxyHandler)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User", "alice")
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for tag, body := range manifests {
+		resp := do(http.MethodGet, "/v2/offline/manifests/"+tag)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, body, resp.Body.String())
+		assert.Empty(t, resp.Header().Get("Warning"))
+	}
+
+	down = true
+	latest := digest.FromString(manifests["latest"])
+	for _, ref := range []string{"latest", latest.String()} {
+		resp := do(http.MethodGet, "/v2/offline/manifests/"+ref)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, manifests["latest"], resp.Body.String())
+		assert.Equal(t, mediaType, resp.Header().Get("Content-Type"))
+		assert.Equal(t, latest.String(), resp.Header().Get("Docker-Content-Digest"))
+		assert.Equal(t, offlineWarning, resp.Header().Get("Warning"))
+	}
+	resp := do(http.MethodHead, "/v2/offline/manifests/latest")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+
+	resp = do(http.MethodGet, "/v2/offline/tags/list?n=1")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, offlineWarning, resp.Header().Get("Warning"))
+	assert.Equal(t, `</v2/offline/tags/list?last=1.25&n=1>; rel="next"`, resp.Header().Get("Link"))
+	var list listResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, listResponse{Name: "offline", Tags: []string{"1.25"}}, list)
+
+	resp = do(http.MethodGet, "/v2/offline/tags/list?n=1&last=1.25")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, []string{"latest"}, list.Tags)
+	assert.Empty(t, resp.Header().Get("Link"))
+
+	// What was never seen still fails.
+	resp = do(http.MethodGet, "/v2/offline/manifests/1.24")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, resp.Header().Get("Warning"))
+
+	// Manifests are kept for the repository they were pulled from.
+	resp = do(http.MethodGet, "/v2/other/manifests/"+latest.String())
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, resp.Header().Get("Warning"))
+
+	// Relayed clients did not pass local authentication.
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/offline/manifests/latest", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, resp.Header().Get("Warning"))
+}
+
+// failingTransport fails every request with err.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+func TestOfflinePing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	status := func(code int) http.RoundTripper {
+		return &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+			"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Www-Authenticate", `Bearer realm="https://cgr.dev/token",service="cgr.dev"`)
+				w.WriteHeader(code)
+			}),
+		}}
+	}
+	// Relayed clients are never let in while the upstream is down, what is
+	// kept may have been pulled with the credentials of another client.
+	for _, tc := range []struct {
+		name      string
+		transport http.RoundTripper
+		want      int
+	}{
+		{"challenge", status(http.StatusUnauthorized), http.StatusUnauthorized},
+		{"forbidden", status(http.StatusForbidden), http.StatusForbidden},
+		{"server error", status(http.StatusBadGateway), http.StatusBadGateway},
+		{"connection refused", failingTransport{&net.OpError{Op: "dial", Err: errors.New("connection refused")}}, http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(Options{
+				Log:       logrus.New(),
+				Transport: tc.transport,
+				Upstream:  &fakeUpstream{},
+				Manifests: repository.NewManifestStorage(db),
+			})
+			router := gin.New()
+			router.GET("/v2/", h.V2Handler)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+			assert.Equal(t, tc.want, resp.Code)
+			assert.Empty(t, resp.Header().Get("Warning"))
+			if tc.want == http.StatusUnauthorized {
+				assert.Contains(t, resp.Header().Get("Www-Authenticate"), `realm="http://example.com/token"`)
+			}
+		})
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tc := range []struct {
+		circuits map[string]string
+		want     string
+	}{
+		{map[string]string{"cgr.dev": "closed"}, `{"status":"ok","upstreams":{"cgr.dev":"closed"}}`},
+		{map[string]string{"cgr.dev": "open"}, `{"status":"degraded","upstreams":{"cgr.dev":"open"}}`},
+		{nil, `{"status":"ok","upstreams":{}}`},
+	} {
+		opt := Options{Log: logrus.New()}
+		if tc.circuits != nil {
+			circuits := tc.circuits
+			opt.Circuits = func() map[string]string { return circuits }
+		}
+		router := gin.New()
+		router.GET("/api/v1/status", New(opt).StatusHandler)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, tc.want, resp.Body.String())
+	}
+}
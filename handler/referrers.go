@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/nduyphuong/reverse-registry/services/mediatype"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// maxTagPages bounds the tag list pages read looking for fallback tags.
+const maxTagPages = 100
+
+// referrerManifest is what the referrers of a manifest are described from.
+// Fallback tags of the OCI tag schema point to an index of the referrers,
+// the ones of cosign to a referrer each.
+type referrerManifest struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType"`
+	Config       struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+	} `json:"layers"`
+	Manifests   []v1.Descriptor   `json:"manifests"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// artifactType of a referrer: its own, else the media type of its config as
+// the distribution spec says. Configs of cosign signatures and attestations
+// are plain image configs, their first layer tells more.
+func (m referrerManifest) artifactType() string {
+	switch {
+	case m.ArtifactType != "":
+		return m.ArtifactType
+	case m.Config.MediaType != string(types.OCIConfigJSON) && m.Config.MediaType != string(types.DockerConfigJSON) && m.Config.MediaType != "":
+		return m.Config.MediaType
+	case len(m.Layers) > 0:
+		return m.Layers[0].MediaType
+	}
+	return ""
+}
+
+// synthesizeReferrers answers a referrers request the upstream does not
+// support from the fallback tags of the subject: sha256-<hex> of the OCI
+// tag schema, and sha256-<hex>.sig, .att, .sbom and the like of cosign. It
+// reports whether it did, the upstream response is served otherwise.
+func (s *client) synthesizeReferrers(ctx *gin.Context, p registrypath.Path, out *http.Request) bool {
+	subject, _ := p.Digest()
+	rt, err := s.upstreamTransport(ctx.Request.Context(), p.Repository)
+	if err != nil {
+		s.logger(ctx).Errorf("Error authenticating upstream: %v", err)
+		return false
+	}
+	get := func(u string, accept ...string) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx.Request.Context(), http.MethodGet, u, nil)
+		req.Header = out.Header.Clone()
+		req.Header.Del("Accept")
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		return rt.RoundTrip(req)
+	}
+	base := fmt.Sprintf("https://cgr.dev/v2/chainguard/%s", p.Repository)
+	tags, err := fallbackTags(get, base, subject)
+	if err != nil {
+		s.logger(ctx).Errorf("list fallback tags %v", err)
+		return false
+	}
+
+	referrers := []v1.Descriptor{}
+	seen := map[string]bool{}
+	add := func(d v1.Descriptor) {
+		if !seen[d.Digest.String()] {
+			seen[d.Digest.String()] = true
+			referrers = append(referrers, d)
+		}
+	}
+	for _, tag := range tags {
+		d, m, err := fetchReferrer(get, base+"/manifests/"+tag)
+		if err != nil {
+			s.logger(ctx).WithField("tag", tag).Errorf("fetch fallback tag %v", err)
+			return false
+		}
+		if d.MediaType == types.OCIImageIndex && !strings.Contains(tag, ".") {
+			for _, r := range m.Manifests {
+				add(r)
+			}
+			continue
+		}
+		add(d)
+	}
+
+	filters := ctx.QueryArray("artifactType")
+	if len(filters) > 0 {
+		filtered := []v1.Descriptor{}
+		for _, d := range referrers {
+			for _, f := range filters {
+				if d.ArtifactType == f {
+					filtered = append(filtered, d)
+					break
+				}
+			}
+		}
+		referrers = filtered
+		ctx.Header("OCI-Filters-Applied", "artifactType")
+	}
+	s.logger(ctx).WithFields(logrus.Fields{"repo": p.Repository, "subject": subject, "referrers": len(referrers)}).Info("sent referrers from fallback tags")
+	ctx.Header("Content-Type", mediatype.OCIIndex)
+	ctx.JSON(http.StatusOK, v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     referrers,
+	})
+	return true
+}
+
+// fallbackTags returns the tags of the repository at base that are
+// fallback tags of subject, following the pages of the tag list.
+func fallbackTags(get func(string, ...string) (*http.Response, error), base string, subject digest.Digest) ([]string, error) {
+	prefix := subject.Algorithm().String() + "-" + subject.Encoded()
+	var tags []string
+	next := base + "/tags/list"
+	for page := 0; next != "" && page < maxTagPages; page++ {
+		resp, err := get(next)
+		if err != nil {
+			return nil, err
+		}
+		var lr listResponse
+		err = decodeUpstream(resp, &lr)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range lr.Tags {
+			if tag == prefix || strings.HasPrefix(tag, prefix+".") {
+				tags = append(tags, tag)
+			}
+		}
+		next = nextPage(resp, next)
+	}
+	return tags, nil
+}
+
+// fetchReferrer fetches the manifest a fallback tag points to, returning
+// its descriptor as a referrer.
+func fetchReferrer(get func(string, ...string) (*http.Response, error), u string) (v1.Descriptor, referrerManifest, error) {
+	resp, err := get(u, mediatype.OCIManifest, mediatype.OCIIndex, mediatype.DockerManifest)
+	if err != nil {
+		return v1.Descriptor{}, referrerManifest{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v1.Descriptor{}, referrerManifest{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return v1.Descriptor{}, referrerManifest{}, err
+	}
+	if len(body) > maxManifestSize {
+		return v1.Descriptor{}, referrerManifest{}, errors.New("manifest too large")
+	}
+	var m referrerManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return v1.Descriptor{}, referrerManifest{}, err
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if m.MediaType != "" {
+		mediaType = m.MediaType
+	}
+	hash, err := v1.NewHash(digest.FromBytes(body).String())
+	if err != nil {
+		return v1.Descriptor{}, referrerManifest{}, err
+	}
+	return v1.Descriptor{
+		MediaType:    types.MediaType(mediaType),
+		Size:         int64(len(body)),
+		Digest:       hash,
+		ArtifactType: m.artifactType(),
+		Annotations:  m.Annotations,
+	}, m, nil
+}
+
+// decodeUpstream decodes the JSON body of a successful upstream response.
+func decodeUpstream(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(v)
+}
+
+// nextPage returns the URL of the page after current from the Link header
+// of resp, empty on the last page.
+func nextPage(resp *http.Response, current string) string {
+	link := resp.Header.Get("Link")
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start || !strings.Contains(link[end:], `rel="next"`) {
+		return ""
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return ""
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return next.String()
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/nduyphuong/reverse-registry/services/mediatype"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferrers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	subject := digest.FromString("subject")
+	prefix := "sha256-" + subject.Encoded()
+	manifests := map[string]string{
+		prefix + ".sig": `{"schemaVersion":2,"mediaType":"` + mediatype.OCIManifest + `","config":{"mediaType":"application/vnd.oci.image.config.v1+json"},"layers":[{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json"}]}`,
+		prefix + ".att": `{"schemaVersion":2,"mediaType":"` + mediatype.OCIManifest + `","config":{"mediaType":"application/vnd.oci.image.config.v1+json"},"layers":[{"mediaType":"application/vnd.dsse.envelope.v1+json"}]}`,
+		prefix:          `{"schemaVersion":2,"mediaType":"` + mediatype.OCIIndex + `","manifests":[{"mediaType":"` + mediatype.OCIManifest + `","digest":"` + digest.FromString("sbom").String() + `","size":1,"artifactType":"application/spdx+json"}]}`,
+	}
+	var native *http.Request
+	net := &network{calls: make(map[string]int), hosts: map[string]http.Handler{
+		"cgr.dev": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/v2/chainguard/native/referrers/"):
+				native = r
+				w.Header().Set("Content-Type", mediatype.OCIIndex)
+				w.Header().Set("Link", `</v2/chainguard/native/referrers/`+subject.String()+`?last=1>; rel="next"`)
+				w.Write([]byte(`{"schemaVersion":2,"manifests":[]}`))
+			case r.URL.Path == "/v2/chainguard/signed/tags/list" && r.URL.Query().Get("last") == "":
+				w.Header().Set("Link", `</v2/chainguard/signed/tags/list?last=latest&n=2>; rel="next"`)
+				json.NewEncoder(w).Encode(listResponse{Name: "chainguard/signed", Tags: []string{"latest", prefix + ".sig"}})
+			case r.URL.Path == "/v2/chainguard/signed/tags/list":
+				json.NewEncoder(w).Encode(listResponse{Name: "chainguard/signed", Tags: []string{prefix, prefix + ".att", "sha256-other.sig"}})
+			case strings.HasPrefix(r.URL.Path, "/v2/chainguard/signed/manifests/"):
+				m, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/chainguard/signed/manifests/")]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(m))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	}}
+	h := New(Options{Log: logrus.New(), Transport: net, Upstream: &fakeUpstream{}})
+	router := gin.New()
+	router.Any("/v2/*path", h.ProxyHandler)
+	do := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		return resp
+	}
+
+	resp := do("/v2/native/referrers/" + subject.String() + "?artifactType=application/spdx%2Bjson")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/spdx+json", native.URL.Query().Get("artifactType"))
+	assert.Equal(t, `</v2/native/referrers/`+subject.String()+`?last=1>; rel="next"`, resp.Header().Get("Link"))
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"application/vnd.dev.cosign.simplesigning.v1+json", "application/spdx+json", "application/vnd.dsse.envelope.v1+json"}},
+		{"?artifactType=application/vnd.dsse.envelope.v1%2Bjson", []string{"application/vnd.dsse.envelope.v1+json"}},
+		{"?artifactType=text/plain", []string{}},
+	} {
+		resp := do("/v2/signed/referrers/" + subject.String() + tc.query)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, mediatype.OCIIndex, resp.Header().Get("Content-Type"))
+		if tc.query != "" {
+			assert.Equal(t, "artifactType", resp.Header().Get("OCI-Filters-Applied"))
+		}
+		var index v1.IndexManifest
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&index))
+		got := []string{}
+		for _, d := range index.Manifests {
+			got = append(got, d.ArtifactType)
+		}
+		assert.Equal(t, tc.want, got, tc.query)
+	}
+	index := do("/v2/signed/referrers/" + subject.String())
+	assert.Contains(t, index.Body.String(), digest.FromString(manifests[prefix+".sig"]).String())
+
+	// Repositories the upstream does not know still get its 404.
+	resp = do("/v2/unknown/referrers/" + subject.String())
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/sirupsen/logrus"
+)
+
+// RefreshHandler serves POST /api/v1/images/{name}/refresh where name is the
+// image as written in config, e.g. cgr.dev/chainguard/nginx. Callers use the
+// webhook token or, with access rules, credentials granting admin on the
+// repository the image is served as.
+func (s *client) RefreshHandler(ctx *gin.Context) {
+	path := strings.TrimPrefix(ctx.Param("path"), "/")
+	name := strings.TrimSuffix(path, "/refresh")
+	if _, ok := auth.IdentityFrom(ctx.Request.Context()); ok && s.authz != nil {
+		if !s.authorize(ctx, proxiedRepository(name), authz.Admin) {
+			return
+		}
+	} else if !s.webhookAuthorized(ctx) {
+		return
+	}
+	if !strings.HasSuffix(path, "/refresh") {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	for _, img := range s.images {
+		if img.Name == name {
+			s.queueRefresh(ctx, []config.Image{img})
+			return
+		}
+	}
+	ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "image is not watched", "image": name})
+}
+
+// DistributionWebhookHandler receives the notifications envelope sent by
+// distribution (registry:2) and compatible registries.
+func (s *client) DistributionWebhookHandler(ctx *gin.Context) {
+	if !s.webhookAuthorized(ctx) {
+		return
+	}
+	var envelope distributionEnvelope
+	if err := ctx.ShouldBindJSON(&envelope); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var matched []config.Image
+	for _, e := range envelope.Events {
+		if e.Action != "push" {
+			continue
+		}
+		matched = append(matched, matchImages(s.images, e.Request.Host, e.Target.Repository)...)
+	}
+	s.queueRefresh(ctx, matched)
+}
+
+// HarborWebhookHandler receives Harbor's PUSH_ARTIFACT webhooks.
+func (s *client) HarborWebhookHandler(ctx *gin.Context) {
+	if !s.webhookAuthorized(ctx) {
+		return
+	}
+	var payload harborPayload
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var matched []config.Image
+	if payload.Type == "PUSH_ARTIFACT" {
+		for _, r := range payload.EventData.Resources {
+			// harbor.example.com/library/nginx:1.25
+			host := strings.SplitN(r.ResourceURL, "/", 2)[0]
+			matched = append(matched, matchImages(s.images, host, payload.EventData.Repository.RepoFullName)...)
+		}
+	}
+	s.queueRefresh(ctx, matched)
+}
+
+// DockerHubWebhookHandler receives Docker Hub repository webhooks.
+func (s *client) DockerHubWebhookHandler(ctx *gin.Context) {
+	if !s.webhookAuthorized(ctx) {
+		return
+	}
+	var payload dockerHubPayload
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.queueRefresh(ctx, matchImages(s.images, "docker.io", payload.Repository.RepoName))
+}
+
+func (s *client) queueRefresh(ctx *gin.Context, images []config.Image) {
+	queued := make([]string, 0, len(images))
+	seen := make(map[string]bool)
+	for _, img := range images {
+		if seen[img.Name] {
+			continue
+		}
+		seen[img.Name] = true
+		if err := s.refresh.Request(img.Name, time.Now()); err != nil {
+			s.logger(ctx).Errorf("queue refresh %v", err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "can not queue refresh"})
+			return
+		}
+		queued = append(queued, img.Name)
+	}
+	s.logger(ctx).WithFields(logrus.Fields{"images": queued}).Info("queued refresh")
+	ctx.JSON(http.StatusAccepted, gin.H{"queued": queued})
+}
+
+// webhookAuthorized checks the shared webhook token. Docker Hub can not send
+// headers, so the token is also accepted as a query parameter.
+func (s *client) webhookAuthorized(ctx *gin.Context) bool {
+	if s.webhookToken == "" {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "webhooks are disabled"})
+		return false
+	}
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = ctx.Query("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.webhookToken)) != 1 {
+		ctx.Header("Www-Authenticate", `Bearer realm="reverse-registry"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return false
+	}
+	return true
+}
+
+// proxiedRepository is the repository clients pull image as, e.g. nginx for
+// cgr.dev/chainguard/nginx. Other images keep their full name.
+func proxiedRepository(image string) string {
+	return strings.TrimPrefix(image, "cgr.dev/chainguard/")
+}
+
+// matchImages returns the watched images a pushed repository is. host is
+// the registry the push happened on and is checked when not empty, the
+// repository must be the full path of the image on it, e.g. chainguard/nginx
+// for cgr.dev/chainguard/nginx.
+func matchImages(images []config.Image, host, repository string) []config.Image {
+	if repository == "" {
+		return nil
+	}
+	pushed := repository
+	if host != "" {
+		pushed = host + "/" + repository
+	}
+	ref, err := name.NewRepository(pushed)
+	if err != nil {
+		return nil
+	}
+	var matched []config.Image
+	for _, img := range images {
+		watched, err := name.NewRepository(img.Name)
+		if err != nil || watched.RepositoryStr() != ref.RepositoryStr() {
+			continue
+		}
+		if host == "" || watched.RegistryStr() == ref.RegistryStr() {
+			matched = append(matched, img)
+		}
+	}
+	return matched
+}
+
+type distributionEnvelope struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+type harborPayload struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+type dockerHubPayload struct {
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
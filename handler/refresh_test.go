@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRefresh struct {
+	requested []string
+}
+
+func (f *fakeRefresh) Request(image string, at time.Time) error {
+	f.requested = append(f.requested, image)
+	return nil
+}
+
+func (f *fakeRefresh) ClaimPending(limit int) ([]model.RefreshRequest, error) {
+	return nil, nil
+}
+
+func newRefreshRouter(refresh *fakeRefresh) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := New(Options{
+		Log:     logrus.New(),
+		Refresh: refresh,
+		Images: []config.Image{
+			{Name: "cgr.dev/chainguard/nginx"},
+			{Name: "docker.io/library/redis"},
+			{Name: "harbor.example.com/team/redis"},
+		},
+		WebhookToken: "t0ken",
+	})
+	router := gin.New()
+	router.POST("/api/v1/images/*path", h.RefreshHandler)
+	router.POST("/api/v1/webhooks/distribution", h.DistributionWebhookHandler)
+	router.POST("/api/v1/webhooks/harbor", h.HarborWebhookHandler)
+	router.POST("/api/v1/webhooks/dockerhub", h.DockerHubWebhookHandler)
+	return router
+}
+
+func TestRefreshHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		token     string
+		body      string
+		wantCode  int
+		wantQueue []string
+	}{
+		{
+			name:     "missing token",
+			path:     "/api/v1/images/cgr.dev/chainguard/nginx/refresh",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:      "refresh watched image",
+			path:      "/api/v1/images/cgr.dev/chainguard/nginx/refresh",
+			token:     "t0ken",
+			wantCode:  http.StatusAccepted,
+			wantQueue: []string{"cgr.dev/chainguard/nginx"},
+		},
+		{
+			name:     "refresh unknown image",
+			path:     "/api/v1/images/cgr.dev/chainguard/go/refresh",
+			token:    "t0ken",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:      "distribution push",
+			path:      "/api/v1/webhooks/distribution",
+			token:     "t0ken",
+			body:      `{"events":[{"action":"push","target":{"repository":"chainguard/nginx","tag":"latest"},"request":{"host":"cgr.dev"}},{"action":"pull","target":{"repository":"library/redis"}}]}`,
+			wantCode:  http.StatusAccepted,
+			wantQueue: []string{"cgr.dev/chainguard/nginx"},
+		},
+		{
+			name:      "harbor push",
+			path:      "/api/v1/webhooks/harbor",
+			token:     "t0ken",
+			body:      `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/team/redis:7"}],"repository":{"repo_full_name":"team/redis"}}}`,
+			wantCode:  http.StatusAccepted,
+			wantQueue: []string{"harbor.example.com/team/redis"},
+		},
+		{
+			name:     "push of the same repository on another registry",
+			path:     "/api/v1/webhooks/harbor",
+			token:    "t0ken",
+			body:     `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/library/redis:7"}],"repository":{"repo_full_name":"library/redis"}}}`,
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "push of a repository with the same name",
+			path:     "/api/v1/webhooks/distribution",
+			token:    "t0ken",
+			body:     `{"events":[{"action":"push","target":{"repository":"nginx","tag":"latest"},"request":{"host":"cgr.dev"}},{"action":"push","target":{"repository":"other/nginx"}}]}`,
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:      "distribution push without host",
+			path:      "/api/v1/webhooks/distribution",
+			token:     "t0ken",
+			body:      `{"events":[{"action":"push","target":{"repository":"chainguard/nginx","tag":"latest"}}]}`,
+			wantCode:  http.StatusAccepted,
+			wantQueue: []string{"cgr.dev/chainguard/nginx"},
+		},
+		{
+			name:      "docker hub push with query token",
+			path:      "/api/v1/webhooks/dockerhub?token=t0ken",
+			body:      `{"push_data":{"tag":"7"},"repository":{"repo_name":"library/redis"}}`,
+			wantCode:  http.StatusAccepted,
+			wantQueue: []string{"docker.io/library/redis"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresh := &fakeRefresh{}
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			newRefreshRouter(refresh).ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantQueue, refresh.requested)
+		})
+	}
+}
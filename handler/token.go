@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/sirupsen/logrus"
+)
+
+// issueToken answers token requests as described by the Docker token
+// authentication spec. The client authenticated already, see
+// auth.Middleware, so it is granted the pull access it asks for and the
+// access rules allow.
+func (s *client) issueToken(ctx *gin.Context) {
+	id, _ := auth.IdentityFrom(ctx.Request.Context())
+	if service := ctx.Query("service"); service != "" && service != s.tokens.Service() {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "unknown service " + service})
+		return
+	}
+	var granted []auth.Access
+	for _, param := range ctx.QueryArray("scope") {
+		for _, scope := range strings.Fields(param) {
+			requested, err := auth.ParseScope(scope)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope", "error_description": err.Error()})
+				return
+			}
+			if access, ok := s.grant(ctx, id, requested); ok {
+				granted = append(granted, access)
+			}
+		}
+	}
+	token, err := s.tokens.Issue(id, granted)
+	if err != nil {
+		s.logger(ctx).Errorf("issue token %v", err)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	s.logger(ctx).WithFields(logrus.Fields{
+		"subject": id.Name,
+		"access":  granted,
+	}).Info("issued token")
+	ctx.JSON(http.StatusOK, gin.H{
+		"token":        token.Raw,
+		"access_token": token.Raw,
+		"expires_in":   int(token.ExpiresIn.Seconds()),
+		"issued_at":    token.IssuedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// grant narrows a requested scope to what the proxy serves: pulling
+// repositories. Listing tags needs the pull scope too, so it is granted to
+// clients allowed to either.
+func (s *client) grant(ctx *gin.Context, id auth.Identity, requested auth.Access) (auth.Access, bool) {
+	if requested.Type != "repository" {
+		return auth.Access{}, false
+	}
+	for _, action := range requested.Actions {
+		if action != "pull" && action != "*" {
+			continue
+		}
+		if s.authz != nil && !s.authz.Allowed(id, requested.Name, authz.List) &&
+			s.authz.Authorize(ctx.Request.Context(), id, requested.Name, authz.Pull) != nil {
+			return auth.Access{}, false
+		}
+		return auth.Access{Type: requested.Type, Name: requested.Name, Actions: []string{"pull"}}, true
+	}
+	return auth.Access{}, false
+}
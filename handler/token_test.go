@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/authz"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authenticator, err := auth.New(auth.Options{Config: config.Auth{
+		Tokens: []config.StaticToken{{Name: "ci", Token: "tok-123"}},
+	}})
+	assert.NoError(t, err)
+	tokens, err := auth.NewTokenService(auth.TokenOptions{Log: logrus.New()})
+	assert.NoError(t, err)
+	h := New(Options{Log: logrus.New(), LocalAuth: true, Tokens: tokens})
+
+	router := gin.New()
+	registry := router.Group("", auth.TokenMiddleware(tokens, nil))
+	registry.GET("/v2/*path", func(ctx *gin.Context) {
+		if ctx.Param("path") == "/" {
+			h.V2Handler(ctx)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+	router.GET("/token", auth.Middleware(authenticator), h.TokenHandler)
+
+	// The ping points the client to the token service.
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, `Bearer realm="http://example.com/token",service="reverse-registry"`, resp.Header().Get("Www-Authenticate"))
+
+	// Only pull is granted.
+	req := httptest.NewRequest(http.MethodGet, "/token?service=reverse-registry&scope=repository:nginx:pull,push&scope=registry:catalog:*", nil)
+	req.SetBasicAuth("ci", "tok-123")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var body struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, 300, body.ExpiresIn)
+	id, access, err := tokens.Verify(body.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", id.Name)
+	assert.Equal(t, []auth.Access{{Type: "repository", Name: "nginx", Actions: []string{"pull"}}}, access)
+
+	for _, tc := range []struct {
+		path     string
+		wantCode int
+		wantAuth string
+	}{
+		{"/v2/", http.StatusOK, ""},
+		{"/v2/nginx/manifests/latest", http.StatusOK, ""},
+		{"/v2/static/manifests/latest", http.StatusUnauthorized, `Bearer realm="http://example.com/token",service="reverse-registry",scope="repository:static:pull",error="insufficient_scope"`},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+body.Token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, tc.wantCode, resp.Code, tc.path)
+		assert.Equal(t, tc.wantAuth, resp.Header().Get("Www-Authenticate"), tc.path)
+	}
+
+	// Without credentials there is no token.
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/token?scope=repository:nginx:pull", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestAccessRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	policy, err := authz.New(authz.Options{Config: config.Authz{Rules: []config.AccessRule{
+		{Subjects: []string{"alice"}, Repositories: []string{"nginx"}, Actions: []string{"pull", "admin"}},
+	}}, Audit: io.Discard, Log: logrus.New()})
+	assert.NoError(t, err)
+	tokens, err := auth.NewTokenService(auth.TokenOptions{Log: logrus.New()})
+	assert.NoError(t, err)
+	refresh := &fakeRefresh{}
+	h := New(Options{
+		Log:       logrus.New(),
+		LocalAuth: true,
+		Tokens:    tokens,
+		Authz:     policy,
+		Refresh:   refresh,
+		Images:    []config.Image{{Name: "cgr.dev/chainguard/nginx"}, {Name: "cgr.dev/chainguard/redis"}},
+	})
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		ctx.Request = ctx.Request.WithContext(auth.WithIdentity(ctx.Request.Context(), auth.Identity{Name: "alice"}))
+	})
+	router.GET("/v2/*path", h.ProxyHandler)
+	router.GET("/token", h.TokenHandler)
+	router.POST("/api/v1/images/*path", h.RefreshHandler)
+
+	// Listing is not granted.
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/nginx/tags/list", nil))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.JSONEq(t, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied","detail":{"repository":"nginx","action":"list"}}]}`, resp.Body.String())
+
+	// Tokens only carry the granted repositories.
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/token?scope=repository:nginx:pull&scope=repository:redis:pull", nil))
+	var body struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	_, access, err := tokens.Verify(body.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []auth.Access{{Type: "repository", Name: "nginx", Actions: []string{"pull"}}}, access)
+
+	// The admin API needs admin on the repository the image is served as.
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/api/v1/images/cgr.dev/chainguard/redis/refresh", nil))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/api/v1/images/cgr.dev/chainguard/nginx/refresh", nil))
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Equal(t, []string{"cgr.dev/chainguard/nginx"}, refresh.requested)
+}
@@ -1,15 +1,24 @@
 package inject
 
 import (
+	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/nduyphuong/reverse-registry/config"
 	"github.com/nduyphuong/reverse-registry/driver"
 	"github.com/nduyphuong/reverse-registry/repository"
 	containerregistry "github.com/nduyphuong/reverse-registry/services/container-registry"
+	"github.com/nduyphuong/reverse-registry/services/httpclient"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/ratelimit"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
+	"github.com/nduyphuong/reverse-registry/services/upstream"
+	"gorm.io/gorm"
 )
 
-var imageStorage *repository.Storage
+var imageStorage repository.Interface
 var muImageStorage sync.Mutex
 
 func GetStorage(conf config.Config) (repository.Interface, error) {
@@ -18,36 +27,203 @@ func GetStorage(conf config.Config) (repository.Interface, error) {
 	if imageStorage != nil {
 		return imageStorage, nil
 	}
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	storage := repository.NewStorage(db)
+	if conf.RepositoryCache.Size <= 0 {
+		imageStorage = storage
+		return imageStorage, nil
+	}
+	opt := repository.CacheOptions{Size: conf.RepositoryCache.Size, TTL: time.Minute, VersionCheck: 5 * time.Second}
+	if conf.RepositoryCache.TTL != "" {
+		if opt.TTL, err = time.ParseDuration(conf.RepositoryCache.TTL); err != nil {
+			return nil, fmt.Errorf("repositoryCache.ttl: %w", err)
+		}
+	}
+	if conf.RepositoryCache.VersionCheck != "" {
+		if opt.VersionCheck, err = time.ParseDuration(conf.RepositoryCache.VersionCheck); err != nil {
+			return nil, fmt.Errorf("repositoryCache.versionCheck: %w", err)
+		}
+	}
+	imageStorage = repository.NewCachedStorage(db, storage, opt)
+	return imageStorage, nil
+}
+
+func GetOutboxStorage(conf config.Config) (repository.OutboxInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewOutboxStorage(db), nil
+}
+
+func GetRefreshStorage(conf config.Config) (repository.RefreshInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewRefreshStorage(db), nil
+}
+
+func GetAccessRuleStorage(conf config.Config) (repository.AccessRuleInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewAccessRuleStorage(db), nil
+}
+
+func GetManifestStorage(conf config.Config) (repository.ManifestInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewManifestStorage(db), nil
+}
+
+func GetArtifactStorage(conf config.Config) (repository.ArtifactInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewArtifactStorage(db), nil
+}
+
+func GetConversionStorage(conf config.Config) (repository.ConversionInterface, error) {
+	db, err := getDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewConversionStorage(db), nil
+}
+
+var database *gorm.DB
+var muDatabase sync.Mutex
+
+// getDB returns the database every storage shares, so the process holds one
+// connection pool and migrates once.
+func getDB(conf config.Config) (*gorm.DB, error) {
+	muDatabase.Lock()
+	defer muDatabase.Unlock()
+	if database != nil {
+		return database, nil
+	}
+	var err error
+	if database, err = openDB(conf); err != nil {
+		database = nil
+		return nil, err
+	}
+	return database, nil
+}
+
+func openDB(conf config.Config) (*gorm.DB, error) {
 	dbConfig := conf.DBConfig
 	host := dbConfig.Host
 	user := dbConfig.User
 	password := dbConfig.Password
 	dbName := dbConfig.DBName
 	if conf.DB == "mysql" {
-		db, err := driver.NewMySQLDB(host, user, password, dbName)
-		if err != nil {
-			return nil, err
-		}
-		imageStorage := repository.NewStorage(db)
-		return imageStorage, nil
+		return driver.NewMySQLDB(host, user, password, dbName)
 	}
-	db, err := driver.NewSqliteDB()
-	if err != nil {
-		return nil, err
-	}
-	imageStorage := repository.NewStorage(db)
-	return imageStorage, nil
+	return driver.NewSqliteDB()
 }
 
-var registryClient *containerregistry.Client
+var registryClient containerregistry.Interface
 var muRegistryClient sync.Mutex
 
-func GetContainerRegistryClient() (containerregistry.Interface, error) {
+func GetContainerRegistryClient(conf config.Config) (containerregistry.Interface, error) {
 	muRegistryClient.Lock()
 	defer muRegistryClient.Unlock()
 	if registryClient != nil {
 		return registryClient, nil
 	}
-	c := containerregistry.New()
-	return c, nil
+	u, err := GetUpstream(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := GetUpstreamTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	registryClient = containerregistry.New(containerregistry.Options{
+		Keychain:     u.Keychain(),
+		Transport:    transport,
+		Verification: conf.SignatureVerification,
+	})
+	return registryClient, nil
+}
+
+var upstreamHTTPClient httpclient.Interface
+var upstreamTransport http.RoundTripper
+var muUpstreamTransport sync.Mutex
+
+// GetUpstreamTransport returns the transport every upstream request goes
+// through, so timeouts, retries, the circuit breakers and the per-upstream
+// concurrency cap hold across the fetcher and the proxy.
+func GetUpstreamTransport(conf config.Config) (http.RoundTripper, error) {
+	muUpstreamTransport.Lock()
+	defer muUpstreamTransport.Unlock()
+	if err := initUpstreamTransport(conf); err != nil {
+		return nil, err
+	}
+	return upstreamTransport, nil
+}
+
+// GetUpstreamClient returns the client under GetUpstreamTransport, which
+// knows the state of the upstream circuits.
+func GetUpstreamClient(conf config.Config) (httpclient.Interface, error) {
+	muUpstreamTransport.Lock()
+	defer muUpstreamTransport.Unlock()
+	if err := initUpstreamTransport(conf); err != nil {
+		return nil, err
+	}
+	return upstreamHTTPClient, nil
+}
+
+func initUpstreamTransport(conf config.Config) error {
+	if upstreamTransport != nil {
+		return nil
+	}
+	base, err := httpclient.NewTransport(conf.UpstreamClient)
+	if err != nil {
+		return err
+	}
+	resilient, err := httpclient.New(httpclient.Options{
+		Config:    conf.UpstreamClient,
+		Transport: metrics.InstrumentRoundTripper(ratelimit.LimitConcurrency(base, conf.RateLimit.UpstreamConcurrency)),
+	})
+	if err != nil {
+		return err
+	}
+	upstreamHTTPClient = resilient
+	upstreamTransport = tracing.Transport(resilient)
+	return nil
+}
+
+var upstreamClient upstream.Interface
+var muUpstreamClient sync.Mutex
+
+// GetUpstream returns the upstream credentials shared by the fetcher and
+// the proxy, so upstream tokens are cached once per process.
+func GetUpstream(conf config.Config) (upstream.Interface, error) {
+	muUpstreamClient.Lock()
+	defer muUpstreamClient.Unlock()
+	if upstreamClient != nil {
+		return upstreamClient, nil
+	}
+	transport, err := GetUpstreamTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	u, err := upstream.New(upstream.Options{
+		Upstreams: conf.Upstreams,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	upstreamClient = u
+	return u, nil
 }
@@ -0,0 +1,14 @@
+package model
+
+// AccessRule grants a subject actions on the repositories matching a
+// pattern. Rules kept in the database are used next to the ones in config,
+// so access can be changed without a redeploy.
+type AccessRule struct {
+	ID uint `gorm:"primaryKey"`
+	// Subject is a user name, group:<name> or * for any authenticated
+	// client.
+	Subject    string `gorm:"index"`
+	Repository string
+	// Actions is a comma separated list of pull, list and admin.
+	Actions string
+}
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+// Artifact is a cosign signature, attestation or SBOM of a recorded image,
+// kept so old versions stay verifiable after the upstream garbage collects
+// them.
+type Artifact struct {
+	// cgr.dev/chainguard/nginx
+	Repository string `gorm:"primaryKey"`
+	// sha256-81bed54c9e507503766c0f8f030f869705dae486f37c2a003bb5b12bcfcc713f.att
+	Tag string `gorm:"primaryKey"`
+	// Subject is the digest the artifact is about: an image index or one
+	// of its platform images.
+	Subject string
+	// linux/amd64, empty when the subject is the index.
+	Platform string
+	// Kind is sig, att or sbom.
+	Kind      string
+	Digest    string `gorm:"index"`
+	MediaType string
+	Manifest  []byte
+	CreatedAt time.Time
+}
+
+// ArtifactLink ties an Artifact to a recorded image index it belongs to. A
+// platform image shared by several versions of an index has its artifacts
+// linked to each of them.
+type ArtifactLink struct {
+	Repository string `gorm:"primaryKey"`
+	Tag        string `gorm:"primaryKey"`
+	// IndexDigest is the recorded digest of the image index.
+	IndexDigest string `gorm:"primaryKey;index"`
+}
+
+// ArtifactBlob is a config or layer of an Artifact.
+type ArtifactBlob struct {
+	Repository string `gorm:"primaryKey"`
+	Digest     string `gorm:"primaryKey"`
+	Content    []byte
+}
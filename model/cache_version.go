@@ -0,0 +1,8 @@
+package model
+
+// CacheVersion is bumped whenever the data cached under Name changes, so
+// replicas caching it in memory know to drop their copy.
+type CacheVersion struct {
+	Name    string `gorm:"primaryKey"`
+	Version int64
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// ManifestConversion is a manifest the proxy converted to another media
+// type, kept so the converted digest it advertised can be pulled.
+type ManifestConversion struct {
+	// nginx
+	Repository string `gorm:"primaryKey"`
+	// Digest of the converted manifest.
+	Digest string `gorm:"primaryKey"`
+	// Source is the digest of the upstream manifest, MediaType the one it
+	// was converted to.
+	Source    string
+	MediaType string
+	CreatedAt time.Time
+}
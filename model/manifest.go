@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// Manifest is a manifest the proxy passed through for a repository, kept so
+// it can be served while the upstream is down.
+type Manifest struct {
+	// nginx
+	Repository string `gorm:"primaryKey"`
+	// sha256:81bed54c9e507503766c0f8f030f869705dae486f37c2a003bb5b12bcfcc713f
+	Digest    string `gorm:"primaryKey"`
+	MediaType string
+	Content   []byte
+	CreatedAt time.Time
+}
+
+// ManifestTag is the digest a tag of a proxied repository last pointed to.
+type ManifestTag struct {
+	// nginx
+	Repository string `gorm:"primaryKey"`
+	Tag        string `gorm:"primaryKey"`
+	Digest     string
+	UpdatedAt  time.Time
+}
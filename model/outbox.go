@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// OutboxEvent is a notification waiting to be delivered to one webhook
+// endpoint. Events are fanned out per endpoint when published so each
+// endpoint retries independently.
+type OutboxEvent struct {
+	ID uint `gorm:"primaryKey"`
+	// Name of the endpoint from config this event is addressed to.
+	Endpoint string `gorm:"index"`
+	// CloudEvents JSON body, signed as is on delivery.
+	Payload       string `gorm:"type:text"`
+	Type          string
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	// LockedUntil is a lease so only one dispatcher sends an event at a time.
+	LockedUntil *time.Time
+	DeliveredAt *time.Time
+	// DeadAt is set once the event ran out of attempts.
+	DeadAt    *time.Time
+	LastError string
+	CreatedAt time.Time
+}
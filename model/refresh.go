@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// RefreshRequest asks the fetcher to fetch an image now instead of waiting
+// for the next cycle. It goes through the database so it works when the api
+// and the fetcher run as separate processes.
+type RefreshRequest struct {
+	ID uint `gorm:"primaryKey"`
+	// Image name as written in config, e.g. cgr.dev/chainguard/nginx
+	Image       string `gorm:"index"`
+	RequestedAt time.Time
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+)
+
+type AccessRuleStorage struct {
+	db *gorm.DB
+}
+
+func NewAccessRuleStorage(db *gorm.DB) AccessRuleInterface {
+	return &AccessRuleStorage{
+		db,
+	}
+}
+
+func (s *AccessRuleStorage) List() ([]model.AccessRule, error) {
+	defer metrics.ObserveDBQuery("access_rule_list", time.Now())
+	var rules []model.AccessRule
+	if err := s.db.Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
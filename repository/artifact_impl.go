@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+)
+
+type ArtifactStorage struct {
+	db *gorm.DB
+}
+
+func NewArtifactStorage(db *gorm.DB) ArtifactInterface {
+	return &ArtifactStorage{
+		db,
+	}
+}
+
+func (s *ArtifactStorage) SaveArtifact(a model.Artifact, blobs []model.ArtifactBlob) error {
+	defer metrics.ObserveDBQuery("save_artifact", time.Now())
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, b := range blobs {
+			if err := tx.Save(&b).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&a).Error
+	})
+}
+
+func (s *ArtifactStorage) FindArtifact(repository, tag string) (*model.Artifact, error) {
+	defer metrics.ObserveDBQuery("find_artifact", time.Now())
+	var a model.Artifact
+	if err := s.db.Where("repository = ? AND tag = ?", repository, tag).Find(&a).Error; err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *ArtifactStorage) FindArtifactByDigest(repository, digest string) (*model.Artifact, error) {
+	defer metrics.ObserveDBQuery("find_artifact_by_digest", time.Now())
+	var a model.Artifact
+	if err := s.db.Where("repository = ? AND digest = ?", repository, digest).Limit(1).Find(&a).Error; err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *ArtifactStorage) FindBlob(repository, digest string) (*model.ArtifactBlob, error) {
+	defer metrics.ObserveDBQuery("find_artifact_blob", time.Now())
+	var b model.ArtifactBlob
+	if err := s.db.Where("repository = ? AND digest = ?", repository, digest).Find(&b).Error; err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *ArtifactStorage) LinkArtifact(repository, tag, index string) error {
+	defer metrics.ObserveDBQuery("link_artifact", time.Now())
+	return s.db.Save(&model.ArtifactLink{Repository: repository, Tag: tag, IndexDigest: index}).Error
+}
+
+func (s *ArtifactStorage) ListArtifacts(index string) ([]model.Artifact, error) {
+	defer metrics.ObserveDBQuery("list_artifacts", time.Now())
+	var artifacts []model.Artifact
+	err := s.db.Joins("JOIN artifact_links ON artifact_links.repository = artifacts.repository AND artifact_links.tag = artifacts.tag").
+		Where("artifact_links.index_digest = ?", index).Order("artifacts.tag").Find(&artifacts).Error
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
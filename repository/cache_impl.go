@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// imagesVersion is the CacheVersion bumped when an image digest is saved.
+const imagesVersion = "images"
+
+type CacheOptions struct {
+	// Size is the number of lookups kept, the least recently used are
+	// dropped first.
+	Size int
+	// TTL bounds how long a lookup is kept.
+	TTL time.Duration
+	// VersionCheck is how often the version counter is read, bounding how
+	// long a digest saved by another replica takes to show.
+	VersionCheck time.Duration
+}
+
+// CachedStorage keeps the lookups of another Interface in memory. Saves
+// through any CachedStorage bump a version counter in the database, which
+// every replica reads at most once per VersionCheck to drop its lookups.
+type CachedStorage struct {
+	next  Interface
+	cache *lookupCache
+	ctx   context.Context
+}
+
+func NewCachedStorage(db *gorm.DB, next Interface, opt CacheOptions) Interface {
+	return &CachedStorage{
+		next: next,
+		cache: &lookupCache{
+			db:           db,
+			size:         opt.Size,
+			ttl:          opt.TTL,
+			versionCheck: opt.VersionCheck,
+			now:          time.Now,
+			lru:          list.New(),
+			items:        make(map[string]*list.Element),
+		},
+		ctx: context.Background(),
+	}
+}
+
+func (s *CachedStorage) WithContext(ctx context.Context) Interface {
+	return &CachedStorage{
+		next:  s.next.WithContext(ctx),
+		cache: s.cache,
+		ctx:   ctx,
+	}
+}
+
+func (s *CachedStorage) FindByNameTag(nameWithTag string) (*model.ImageModel, error) {
+	return s.find("find_by_name_tag", "tag:"+nameWithTag, func() (*model.ImageModel, error) {
+		return s.next.FindByNameTag(nameWithTag)
+	})
+}
+
+func (s *CachedStorage) FindByDigest(digest string) (*model.ImageModel, error) {
+	return s.find("find_by_digest", "digest:"+digest, func() (*model.ImageModel, error) {
+		return s.next.FindByDigest(digest)
+	})
+}
+
+// find returns the cached lookup under key, or looks it up. Lookups finding
+// nothing are cached too, they are most of the manifest requests.
+func (s *CachedStorage) find(query, key string, lookup func() (*model.ImageModel, error)) (*model.ImageModel, error) {
+	s.cache.checkVersion(s.ctx)
+	m, generation, ok := s.cache.get(key)
+	if ok {
+		metrics.RepositoryCacheLookups.WithLabelValues(query, "hit").Inc()
+		return &m, nil
+	}
+	metrics.RepositoryCacheLookups.WithLabelValues(query, "miss").Inc()
+	found, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	s.cache.set(key, *found, generation)
+	return found, nil
+}
+
+// ListImages is not cached, it is only used to list the catalog.
+func (s *CachedStorage) ListImages() ([]string, error) {
+	return s.next.ListImages()
+}
+
+// SaveDigest drops the lookups and bumps the version counter only when the
+// digest changed, the fetcher saving every image on every cycle. The
+// lookups are dropped with the counter read back after the bump, so the
+// replica saving does not drop them again on its next version check.
+func (s *CachedStorage) SaveDigest(nameWithTag, digest string) (bool, error) {
+	changed, err := s.next.SaveDigest(nameWithTag, digest)
+	if err != nil || !changed {
+		return changed, err
+	}
+	var version int64
+	err = s.bumpVersion(&version)
+	s.cache.flush(version)
+	return true, err
+}
+
+func (s *CachedStorage) bumpVersion(version *int64) error {
+	defer metrics.ObserveDBQuery("bump_cache_version", time.Now())
+	return s.cache.db.WithContext(s.ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"version": gorm.Expr("version + 1")}),
+		}).Create(&model.CacheVersion{Name: imagesVersion, Version: 1}).Error
+		if err != nil {
+			return err
+		}
+		var versions []int64
+		if err := tx.Model(&model.CacheVersion{}).Where("name = ?", imagesVersion).Pluck("version", &versions).Error; err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			*version = versions[0]
+		}
+		return nil
+	})
+}
+
+type lookup struct {
+	key     string
+	image   model.ImageModel
+	expires time.Time
+}
+
+type lookupCache struct {
+	db           *gorm.DB
+	size         int
+	ttl          time.Duration
+	versionCheck time.Duration
+	now          func() time.Time
+
+	mu        sync.Mutex
+	lru       *list.List
+	items     map[string]*list.Element
+	version   int64
+	checkedAt time.Time
+	// generation is incremented every time the lookups are dropped, so
+	// lookups started before are not cached.
+	generation uint64
+}
+
+// get returns the lookup cached under key, and the generation a lookup made
+// on a miss is to be set with.
+func (c *lookupCache) get(key string) (model.ImageModel, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return model.ImageModel{}, c.generation, false
+	}
+	l := el.Value.(*lookup)
+	if !c.now().Before(l.expires) {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		return model.ImageModel{}, c.generation, false
+	}
+	c.lru.MoveToFront(el)
+	return l.image, c.generation, true
+}
+
+// set caches image under key unless the lookups were dropped since
+// generation, the lookup possibly predating the save that dropped them.
+func (c *lookupCache) set(key string, image model.ImageModel, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&lookup{key: key, image: image, expires: c.now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		l := c.lru.Remove(c.lru.Back()).(*lookup)
+		delete(c.items, l.key)
+	}
+}
+
+// flush drops the lookups, taking version as the current version counter
+// when it is known.
+func (c *lookupCache) flush(version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+	if version > 0 {
+		c.version = version
+	}
+}
+
+func (c *lookupCache) reset() {
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.generation++
+}
+
+// checkVersion drops the lookups when the version counter moved since it
+// was last read. One caller reads it per VersionCheck, the others go on
+// with the lookups they have meanwhile.
+func (c *lookupCache) checkVersion(ctx context.Context) {
+	c.mu.Lock()
+	if c.now().Sub(c.checkedAt) < c.versionCheck {
+		c.mu.Unlock()
+		return
+	}
+	c.checkedAt = c.now()
+	c.mu.Unlock()
+
+	start := time.Now()
+	var versions []int64
+	err := c.db.WithContext(ctx).Model(&model.CacheVersion{}).Where("name = ?", imagesVersion).Pluck("version", &versions).Error
+	metrics.ObserveDBQuery("read_cache_version", start)
+	var version int64
+	if len(versions) > 0 {
+		version = versions[0]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || version != c.version {
+		// Without the version nothing says the lookups are current.
+		c.reset()
+		if err == nil {
+			c.version = version
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/test-go/testify/assert"
+)
+
+// countingStorage counts the lookups reaching the database.
+type countingStorage struct {
+	Interface
+	lookups int
+	// during runs in the middle of the lookups when set.
+	during func()
+}
+
+func (s *countingStorage) FindByNameTag(nameWithTag string) (*model.ImageModel, error) {
+	s.lookups++
+	m, err := s.Interface.FindByNameTag(nameWithTag)
+	if s.during != nil {
+		s.during()
+	}
+	return m, err
+}
+
+func (s *countingStorage) WithContext(ctx context.Context) Interface {
+	return s
+}
+
+func TestCachedStorage(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	opt := CacheOptions{Size: 10, TTL: time.Minute, VersionCheck: 5 * time.Second}
+	db1 := &countingStorage{Interface: NewStorage(db)}
+	replica1 := NewCachedStorage(db, db1, opt).(*CachedStorage)
+	db2 := &countingStorage{Interface: NewStorage(db)}
+	replica2 := NewCachedStorage(db, db2, opt).(*CachedStorage)
+	now := time.Now()
+	replica1.cache.now = func() time.Time { return now }
+	replica2.cache.now = func() time.Time { return now }
+
+	// Lookups finding nothing are cached too.
+	for i := 0; i < 3; i++ {
+		m, err := replica1.WithContext(context.Background()).FindByNameTag("cached:1.0")
+		assert.NoError(t, err)
+		assert.Empty(t, m.HashedIndex)
+		_, err = replica2.FindByNameTag("cached:1.0")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, db1.lookups)
+	assert.Equal(t, 1, db2.lookups)
+
+	// The replica saving sees the digest right away.
+	_, err = replica1.SaveDigest("cached:1.0", "sha256:abc")
+	assert.NoError(t, err)
+	m, err := replica1.FindByNameTag("cached:1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:abc", m.HashedIndex)
+	assert.Equal(t, 2, db1.lookups)
+
+	// The others once they checked the version.
+	m, _ = replica2.FindByNameTag("cached:1.0")
+	assert.Empty(t, m.HashedIndex)
+	now = now.Add(5 * time.Second)
+	m, _ = replica2.FindByNameTag("cached:1.0")
+	assert.Equal(t, "sha256:abc", m.HashedIndex)
+	assert.Equal(t, 2, db2.lookups)
+	// The replica saving knows the version it bumped to, its lookups
+	// made since are kept.
+	replica1.FindByNameTag("cached:1.0")
+	assert.Equal(t, 2, db1.lookups)
+
+	// Saving the same digest again changes nothing, so no replica drops
+	// its lookups.
+	changed, err := replica1.SaveDigest("cached:1.0", "sha256:abc")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	now = now.Add(5 * time.Second)
+	replica2.FindByNameTag("cached:1.0")
+	assert.Equal(t, 2, db2.lookups)
+	changed, err = replica1.SaveDigest("cached:1.0", "sha256:def")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	now = now.Add(5 * time.Second)
+	m, _ = replica2.FindByNameTag("cached:1.0")
+	assert.Equal(t, "sha256:def", m.HashedIndex)
+	assert.Equal(t, 3, db2.lookups)
+}
+
+func TestCachedStorageSaveDuringLookup(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	next := &countingStorage{Interface: NewStorage(db)}
+	s := NewCachedStorage(db, next, CacheOptions{Size: 10, TTL: time.Minute, VersionCheck: time.Hour}).(*CachedStorage)
+
+	// A digest saved while a lookup is in flight: the stale lookup is
+	// returned but not cached.
+	next.during = func() {
+		next.during = nil
+		_, err := s.SaveDigest("racing:1.0", "sha256:abc")
+		assert.NoError(t, err)
+	}
+	m, err := s.FindByNameTag("racing:1.0")
+	assert.NoError(t, err)
+	assert.Empty(t, m.HashedIndex)
+	m, err = s.FindByNameTag("racing:1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:abc", m.HashedIndex)
+	assert.Equal(t, 2, next.lookups)
+}
+
+func TestCachedStorageEviction(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	next := &countingStorage{Interface: NewStorage(db)}
+	s := NewCachedStorage(db, next, CacheOptions{Size: 2, TTL: time.Minute, VersionCheck: time.Hour}).(*CachedStorage)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+
+	for _, name := range []string{"a:1", "b:1", "a:1", "c:1", "a:1"} {
+		_, err := s.FindByNameTag(name)
+		assert.NoError(t, err)
+	}
+	// b was evicted as the least recently used, a is still there.
+	assert.Equal(t, 3, next.lookups)
+	_, _ = s.FindByNameTag("b:1")
+	assert.Equal(t, 4, next.lookups)
+
+	now = now.Add(time.Minute)
+	_, _ = s.FindByNameTag("b:1")
+	assert.Equal(t, 5, next.lookups)
+}
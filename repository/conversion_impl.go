@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ConversionStorage struct {
+	db *gorm.DB
+}
+
+func NewConversionStorage(db *gorm.DB) ConversionInterface {
+	return &ConversionStorage{
+		db,
+	}
+}
+
+func (s *ConversionStorage) SaveConversion(c model.ManifestConversion) error {
+	defer metrics.ObserveDBQuery("save_conversion", time.Now())
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&c).Error
+}
+
+func (s *ConversionStorage) FindConversion(repository, digest string) (*model.ManifestConversion, error) {
+	defer metrics.ObserveDBQuery("find_conversion", time.Now())
+	var c model.ManifestConversion
+	if err := s.db.Where("repository = ? AND digest = ?", repository, digest).Find(&c).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
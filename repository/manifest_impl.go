@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+)
+
+type ManifestStorage struct {
+	db *gorm.DB
+}
+
+func NewManifestStorage(db *gorm.DB) ManifestInterface {
+	return &ManifestStorage{
+		db,
+	}
+}
+
+func (s *ManifestStorage) SaveManifest(m model.Manifest) error {
+	defer metrics.ObserveDBQuery("save_manifest", time.Now())
+	return s.db.Save(&m).Error
+}
+
+func (s *ManifestStorage) FindManifest(repository, digest string) (*model.Manifest, error) {
+	defer metrics.ObserveDBQuery("find_manifest", time.Now())
+	var m model.Manifest
+	if err := s.db.Where("repository = ? AND digest = ?", repository, digest).Find(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *ManifestStorage) SaveTag(repository, tag, digest string) error {
+	defer metrics.ObserveDBQuery("save_tag", time.Now())
+	return s.db.Save(&model.ManifestTag{Repository: repository, Tag: tag, Digest: digest}).Error
+}
+
+func (s *ManifestStorage) FindTag(repository, tag string) (*model.ManifestTag, error) {
+	defer metrics.ObserveDBQuery("find_tag", time.Now())
+	var t model.ManifestTag
+	if err := s.db.Where("repository = ? AND tag = ?", repository, tag).Find(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *ManifestStorage) ListTags(repository string) ([]string, error) {
+	defer metrics.ObserveDBQuery("list_tags", time.Now())
+	var tags []string
+	err := s.db.Model(&model.ManifestTag{}).Where("repository = ?", repository).Order("tag").Pluck("tag", &tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *ManifestStorage) ListRepositories() ([]string, error) {
+	defer metrics.ObserveDBQuery("list_repositories", time.Now())
+	var repositories []string
+	err := s.db.Model(&model.ManifestTag{}).Distinct("repository").Order("repository").Pluck("repository", &repositories).Error
+	if err != nil {
+		return nil, err
+	}
+	return repositories, nil
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+)
+
+type OutboxStorage struct {
+	db *gorm.DB
+}
+
+func NewOutboxStorage(db *gorm.DB) OutboxInterface {
+	return &OutboxStorage{
+		db,
+	}
+}
+
+func (s *OutboxStorage) Enqueue(events []model.OutboxEvent) error {
+	defer metrics.ObserveDBQuery("outbox_enqueue", time.Now())
+	if len(events) == 0 {
+		return nil
+	}
+	return s.db.Create(&events).Error
+}
+
+func (s *OutboxStorage) ClaimDue(now time.Time, limit int, lease time.Duration) ([]model.OutboxEvent, error) {
+	defer metrics.ObserveDBQuery("outbox_claim_due", time.Now())
+	var candidates []model.OutboxEvent
+	query := s.db.Model(&model.OutboxEvent{})
+	query = query.Where("delivered_at IS NULL AND dead_at IS NULL AND next_attempt_at <= ?", now)
+	query = query.Where("locked_until IS NULL OR locked_until < ?", now)
+	err := query.Order("id").Limit(limit).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+	// Take the lease row by row, another dispatcher may have claimed some of
+	// the candidates in the meantime.
+	lockedUntil := now.Add(lease)
+	claimed := make([]model.OutboxEvent, 0, len(candidates))
+	for _, e := range candidates {
+		res := s.db.Model(&model.OutboxEvent{}).
+			Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", e.ID, now).
+			Update("locked_until", lockedUntil)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			e.LockedUntil = &lockedUntil
+			claimed = append(claimed, e)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *OutboxStorage) MarkDelivered(id uint, at time.Time) error {
+	defer metrics.ObserveDBQuery("outbox_mark_delivered", time.Now())
+	return s.db.Model(&model.OutboxEvent{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"delivered_at": at,
+		"locked_until": nil,
+		"last_error":   "",
+	}).Error
+}
+
+func (s *OutboxStorage) MarkFailed(id uint, attempts int, at, next time.Time, dead bool, lastErr string) error {
+	defer metrics.ObserveDBQuery("outbox_mark_failed", time.Now())
+	updates := map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": next,
+		"locked_until":    nil,
+		"last_error":      lastErr,
+	}
+	if dead {
+		updates["dead_at"] = at
+	}
+	return s.db.Model(&model.OutboxEvent{}).Where("id = ?", id).Updates(updates).Error
+}
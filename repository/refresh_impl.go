@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"gorm.io/gorm"
+)
+
+type RefreshStorage struct {
+	db *gorm.DB
+}
+
+func NewRefreshStorage(db *gorm.DB) RefreshInterface {
+	return &RefreshStorage{
+		db,
+	}
+}
+
+func (s *RefreshStorage) Request(image string, at time.Time) error {
+	defer metrics.ObserveDBQuery("refresh_request", time.Now())
+	var pending int64
+	err := s.db.Model(&model.RefreshRequest{}).Where("image = ?", image).Count(&pending).Error
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return nil
+	}
+	return s.db.Create(&model.RefreshRequest{Image: image, RequestedAt: at}).Error
+}
+
+func (s *RefreshStorage) ClaimPending(limit int) ([]model.RefreshRequest, error) {
+	defer metrics.ObserveDBQuery("refresh_claim_pending", time.Now())
+	var pending []model.RefreshRequest
+	err := s.db.Model(&model.RefreshRequest{}).Order("id").Limit(limit).Find(&pending).Error
+	if err != nil {
+		return nil, err
+	}
+	// Deleting is the claim, a request deleted by another fetcher replica
+	// is theirs.
+	claimed := make([]model.RefreshRequest, 0, len(pending))
+	for _, r := range pending {
+		res := s.db.Where("id = ?", r.ID).Delete(&model.RefreshRequest{})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			claimed = append(claimed, r)
+		}
+	}
+	return claimed, nil
+}
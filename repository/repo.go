@@ -1,9 +1,83 @@
 package repository
 
-import "github.com/nduyphuong/reverse-registry/model"
+import (
+	"context"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+)
 
 type Interface interface {
 	FindByNameTag(nameWithTag string) (*model.ImageModel, error)
 	FindByDigest(digest string) (*model.ImageModel, error)
-	SaveDigest(nameWithTag, digest string) error
+	// SaveDigest stores digest for nameWithTag, reporting whether it changed
+	// anything: false when the same digest was stored already.
+	SaveDigest(nameWithTag, digest string) (bool, error)
+	// ListImages returns the images with a recorded digest, without their
+	// tags, in lexical order.
+	ListImages() ([]string, error)
+	// WithContext returns a copy whose queries are traced as children of
+	// the span in ctx.
+	WithContext(ctx context.Context) Interface
+}
+
+type OutboxInterface interface {
+	Enqueue(events []model.OutboxEvent) error
+	// ClaimDue leases up to limit undelivered events whose next attempt is due.
+	ClaimDue(now time.Time, limit int, lease time.Duration) ([]model.OutboxEvent, error)
+	MarkDelivered(id uint, at time.Time) error
+	// MarkFailed records a failed attempt at at, and schedules the next one
+	// at next unless the event is dead.
+	MarkFailed(id uint, attempts int, at, next time.Time, dead bool, lastErr string) error
+}
+
+type RefreshInterface interface {
+	// Request queues a refresh of image, unless one is already pending.
+	Request(image string, at time.Time) error
+	// ClaimPending removes and returns the pending refresh requests.
+	ClaimPending(limit int) ([]model.RefreshRequest, error)
+}
+
+// ManifestInterface keeps the manifests and tags the proxy passed through.
+// Lookups of unknown digests and tags return an empty record.
+type ManifestInterface interface {
+	SaveManifest(m model.Manifest) error
+	FindManifest(repository, digest string) (*model.Manifest, error)
+	SaveTag(repository, tag, digest string) error
+	FindTag(repository, tag string) (*model.ManifestTag, error)
+	// ListTags returns the tags of repository in lexical order.
+	ListTags(repository string) ([]string, error)
+	// ListRepositories returns the repositories with a tag kept, in lexical
+	// order.
+	ListRepositories() ([]string, error)
+}
+
+// ArtifactInterface keeps the signatures, attestations and SBOMs of the
+// recorded images. Lookups of unknown artifacts and blobs return an empty
+// record.
+type ArtifactInterface interface {
+	// SaveArtifact stores a with the blobs its manifest references.
+	SaveArtifact(a model.Artifact, blobs []model.ArtifactBlob) error
+	FindArtifact(repository, tag string) (*model.Artifact, error)
+	FindArtifactByDigest(repository, digest string) (*model.Artifact, error)
+	FindBlob(repository, digest string) (*model.ArtifactBlob, error)
+	// LinkArtifact records that the artifact tagged tag in repository
+	// belongs to the image index recorded as index.
+	LinkArtifact(repository, tag, index string) error
+	// ListArtifacts returns the artifacts linked to the image index
+	// recorded as index.
+	ListArtifacts(index string) ([]model.Artifact, error)
+}
+
+// ConversionInterface keeps the manifests converted to another media type.
+// Lookups of unknown digests return an empty record.
+type ConversionInterface interface {
+	// SaveConversion stores c, keeping the record already stored for its
+	// digest.
+	SaveConversion(c model.ManifestConversion) error
+	FindConversion(repository, digest string) (*model.ManifestConversion, error)
+}
+
+type AccessRuleInterface interface {
+	List() ([]model.AccessRule, error)
 }
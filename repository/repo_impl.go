@@ -1,23 +1,43 @@
 package repository
 
 import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Storage struct {
-	db *gorm.DB
+	db  *gorm.DB
+	ctx context.Context
 }
 
 func NewStorage(db *gorm.DB) Interface {
 	return &Storage{
 		db,
+		context.Background(),
+	}
+}
+
+func (s *Storage) WithContext(ctx context.Context) Interface {
+	return &Storage{
+		s.db,
+		ctx,
 	}
 }
 
 func (s *Storage) FindByNameTag(nameWithTag string) (*model.ImageModel, error) {
+	defer metrics.ObserveDBQuery("find_by_name_tag", time.Now())
+	ctx, span := tracing.Start(s.ctx, "repository.FindByNameTag")
+	defer span.End()
 	var iM model.ImageModel
-	query := s.db.Model(&model.ImageModel{})
+	query := s.db.WithContext(ctx).Model(&model.ImageModel{})
 	query = query.Where("name=?", nameWithTag)
 	err := query.Find(&iM).Error
 	if err != nil {
@@ -27,8 +47,11 @@ func (s *Storage) FindByNameTag(nameWithTag string) (*model.ImageModel, error) {
 }
 
 func (s *Storage) FindByDigest(hashedIndex string) (*model.ImageModel, error) {
+	defer metrics.ObserveDBQuery("find_by_digest", time.Now())
+	ctx, span := tracing.Start(s.ctx, "repository.FindByDigest")
+	defer span.End()
 	var iM model.ImageModel
-	query := s.db.Model(&model.ImageModel{})
+	query := s.db.WithContext(ctx).Model(&model.ImageModel{})
 	query = query.Where("hashed_index=?", hashedIndex)
 	err := query.Find(&iM).Error
 	if err != nil {
@@ -37,13 +60,48 @@ func (s *Storage) FindByDigest(hashedIndex string) (*model.ImageModel, error) {
 	return &iM, nil
 }
 
-func (s *Storage) SaveDigest(nameWithTag string, hashedIndex string) error {
-	iM := model.ImageModel{
-		Name:         nameWithTag,
-		HashedIndex:  hashedIndex,
+func (s *Storage) ListImages() ([]string, error) {
+	defer metrics.ObserveDBQuery("list_images", time.Now())
+	ctx, span := tracing.Start(s.ctx, "repository.ListImages")
+	defer span.End()
+	var names []string
+	err := s.db.WithContext(ctx).Model(&model.ImageModel{}).Pluck("name", &names).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var images []string
+	for _, name := range names {
+		// cgr.dev/chainguard/nginx:1.25.1 -> cgr.dev/chainguard/nginx,
+		// minding registries with a port.
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			name = name[:i]
+		}
+		if !seen[name] {
+			seen[name] = true
+			images = append(images, name)
+		}
 	}
-	if err := s.db.Save(&iM).Error; err != nil {
-		return err
+	sort.Strings(images)
+	return images, nil
+}
+
+func (s *Storage) SaveDigest(nameWithTag string, hashedIndex string) (bool, error) {
+	defer metrics.ObserveDBQuery("save_digest", time.Now())
+	ctx, span := tracing.Start(s.ctx, "repository.SaveDigest")
+	defer span.End()
+	db := s.db.WithContext(ctx)
+	res := db.Model(&model.ImageModel{}).Where("name = ? AND hashed_index <> ?", nameWithTag, hashedIndex).Update("hashed_index", hashedIndex)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+	iM := model.ImageModel{
+		Name:        nameWithTag,
+		HashedIndex: hashedIndex,
 	}
-	return nil
+	res = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&iM)
+	return res.RowsAffected > 0, res.Error
 }
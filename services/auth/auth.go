@@ -0,0 +1,405 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/externalurl"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnauthenticated is returned when a request has no credentials or they
+// are wrong.
+var ErrUnauthenticated = errors.New("authentication required")
+
+// Authentication methods recorded on an Identity.
+const (
+	MethodBasic       = "basic"
+	MethodStaticToken = "token"
+	MethodClientCert  = "cert"
+)
+
+// Identity is the client a request was authenticated as.
+type Identity struct {
+	Name   string
+	Method string
+	Groups []string
+}
+
+type Interface interface {
+	// Authenticate returns the identity the credentials of req belong to.
+	Authenticate(req *http.Request) (Identity, error)
+	// Challenge is the Www-Authenticate value sent with 401 responses.
+	Challenge() string
+}
+
+type client struct {
+	realm  string
+	users  map[string][]byte
+	tokens map[string]config.StaticToken
+	groups map[string][]string
+	oidc   map[string]*oidcIssuer
+	certs  bool
+	log    *logrus.Logger
+
+	// bcrypt is slow on purpose and clients send basic auth on every
+	// request, so successful checks are remembered for a while.
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+	cacheTTL time.Duration
+	now      func() time.Time
+}
+
+type Options struct {
+	Config config.Auth
+	// Log receives why tokens were rejected, defaults to the standard
+	// logger.
+	Log *logrus.Logger
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		realm:    opt.Config.Realm,
+		users:    make(map[string][]byte),
+		tokens:   make(map[string]config.StaticToken),
+		groups:   make(map[string][]string),
+		oidc:     make(map[string]*oidcIssuer),
+		certs:    opt.Config.ClientCertificates,
+		log:      opt.Log,
+		verified: make(map[[sha256.Size]byte]time.Time),
+		cacheTTL: 5 * time.Minute,
+		now:      time.Now,
+	}
+	if c.realm == "" {
+		c.realm = "reverse-registry"
+	}
+	if c.log == nil {
+		c.log = logrus.StandardLogger()
+	}
+	if opt.Config.Htpasswd != "" {
+		users, err := readHtpasswd(opt.Config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		c.users = users
+	}
+	for _, t := range opt.Config.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("static token needs a name and a token")
+		}
+		c.tokens[t.Token] = t
+	}
+	jwksClient := &http.Client{Timeout: 10 * time.Second}
+	for _, conf := range opt.Config.OIDC {
+		issuer, err := newOIDCIssuer(conf, jwksClient)
+		if err != nil {
+			return nil, err
+		}
+		c.oidc[conf.Issuer] = issuer
+	}
+	for group, members := range opt.Config.Groups {
+		for _, m := range members {
+			c.groups[m] = append(c.groups[m], group)
+		}
+	}
+	return c, nil
+}
+
+func (c *client) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", c.realm)
+}
+
+func (c *client) Authenticate(req *http.Request) (Identity, error) {
+	header := req.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		if t, ok := c.lookupToken(credentials); ok {
+			return c.identity(t.Name, MethodStaticToken, t.Groups), nil
+		}
+		if id, ok := c.verifyOIDC(credentials); ok {
+			return id, nil
+		}
+	case "basic":
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			break
+		}
+		// docker login only speaks basic auth, so a static token is
+		// accepted as the password of any user name.
+		if t, ok := c.lookupToken(password); ok {
+			return c.identity(t.Name, MethodStaticToken, t.Groups), nil
+		}
+		if id, ok := c.verifyOIDC(password); ok {
+			return id, nil
+		}
+		if c.checkPassword(user, password) {
+			return c.identity(user, MethodBasic, nil), nil
+		}
+	case "":
+		if id, ok := c.clientCertificate(req); ok {
+			return id, nil
+		}
+	}
+	return Identity{}, ErrUnauthenticated
+}
+
+// identity adds the groups config puts name in to groups.
+func (c *client) identity(name, method string, groups []string) Identity {
+	id := Identity{Name: name, Method: method}
+	id.Groups = append(id.Groups, groups...)
+	id.Groups = append(id.Groups, c.groups[name]...)
+	return id
+}
+
+// clientCertificate accepts the TLS client certificate of req, the server
+// verified it against the client CAs during the handshake.
+func (c *client) clientCertificate(req *http.Request) (Identity, bool) {
+	if !c.certs || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return Identity{}, false
+	}
+	return c.identity(subject.CommonName, MethodClientCert, subject.OrganizationalUnit), true
+}
+
+// verifyOIDC accepts JWTs of the configured OIDC issuers.
+func (c *client) verifyOIDC(raw string) (Identity, bool) {
+	if len(c.oidc) == 0 {
+		return Identity{}, false
+	}
+	iss, ok := issuerOf(raw)
+	if !ok {
+		return Identity{}, false
+	}
+	issuer, ok := c.oidc[iss]
+	if !ok {
+		return Identity{}, false
+	}
+	id, err := issuer.verify(raw, c.now())
+	if err != nil {
+		c.log.Debugf("reject oidc token of %s: %v", iss, err)
+		return Identity{}, false
+	}
+	return c.identity(id.Name, id.Method, id.Groups), true
+}
+
+func (c *client) lookupToken(token string) (config.StaticToken, bool) {
+	if token == "" {
+		return config.StaticToken{}, false
+	}
+	var found config.StaticToken
+	ok := false
+	// Compare against every token so the time taken does not tell which
+	// one matched.
+	for t, st := range c.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found, ok = st, true
+		}
+	}
+	return found, ok
+}
+
+func (c *client) checkPassword(user, password string) bool {
+	hash, ok := c.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+	now := c.now()
+	c.mu.Lock()
+	expires, cached := c.verified[key]
+	c.mu.Unlock()
+	if cached && now.Before(expires) {
+		return true
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, exp := range c.verified {
+		if !now.Before(exp) {
+			delete(c.verified, k)
+		}
+	}
+	c.verified[key] = now.Add(c.cacheTTL)
+	return true
+}
+
+// readHtpasswd reads user:hash lines, only bcrypt hashes are supported.
+func readHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s is not a bcrypt hash, use htpasswd -B", path, line, user)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity stored in ctx by Middleware.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// Middleware rejects requests that do not authenticate with a 401 and a
+// challenge, and stores the identity of the others in the request context.
+func Middleware(a Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := a.Authenticate(ctx.Request)
+		if err != nil {
+			Unauthorized(ctx, a.Challenge())
+			return
+		}
+		ctx.Request = ctx.Request.WithContext(WithIdentity(ctx.Request.Context(), id))
+		ctx.Next()
+	}
+}
+
+// TokenMiddleware requires a token issued by ts granting the access the
+// request needs. Requests without one get a bearer challenge pointing to the
+// token service. Credentials accepted by fallback, e.g. static tokens for
+// scripts, are let through as well.
+func TokenMiddleware(ts TokenService, fallback Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		required := requiredAccess(ctx)
+		scheme, raw, _ := strings.Cut(ctx.GetHeader("Authorization"), " ")
+		if strings.EqualFold(scheme, "bearer") {
+			id, access, err := ts.Verify(raw)
+			if err == nil {
+				if required == nil || allowed(access, *required) {
+					ctx.Request = ctx.Request.WithContext(WithIdentity(ctx.Request.Context(), id))
+					ctx.Next()
+					return
+				}
+				Unauthorized(ctx, bearerChallenge(ctx, ts, required, "insufficient_scope"))
+				return
+			}
+		}
+		if fallback != nil {
+			if id, err := fallback.Authenticate(ctx.Request); err == nil {
+				ctx.Request = ctx.Request.WithContext(WithIdentity(ctx.Request.Context(), id))
+				ctx.Next()
+				return
+			}
+		}
+		reason := ""
+		if raw != "" {
+			reason = "invalid_token"
+		}
+		Unauthorized(ctx, bearerChallenge(ctx, ts, required, reason))
+	}
+}
+
+// requiredAccess is the scope a registry request needs, nil for the base
+// /v2/ endpoint. Paths that are not requests to a repository are rejected
+// by the handler, they need no more than a valid token.
+func requiredAccess(ctx *gin.Context) *Access {
+	p, err := registrypath.Parse(ctx.Request.URL.Path)
+	if err != nil {
+		return nil
+	}
+	repo := p.Repository
+	action := "pull"
+	if ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead {
+		action = "push"
+	}
+	return &Access{Type: "repository", Name: repo, Actions: []string{action}}
+}
+
+func allowed(granted []Access, required Access) bool {
+	for _, a := range granted {
+		if a.Allows(required.Type, required.Name, required.Actions[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerChallenge(ctx *gin.Context, ts TokenService, required *Access, reason string) string {
+	realm := ts.Realm()
+	if realm == "" {
+		realm = externalurl.From(ctx.Request) + "/token"
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", realm, ts.Service())
+	if required != nil {
+		challenge += fmt.Sprintf(",scope=%q", required.String())
+	}
+	if reason != "" {
+		challenge += fmt.Sprintf(",error=%q", reason)
+	}
+	return challenge
+}
+
+// Identify stores the identity of requests with valid credentials and lets
+// the others through, for endpoints that accept other credentials too.
+func Identify(a Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if id, err := a.Authenticate(ctx.Request); err == nil {
+			ctx.Request = ctx.Request.WithContext(WithIdentity(ctx.Request.Context(), id))
+		}
+		ctx.Next()
+	}
+}
+
+// Unauthorized aborts with the 401 a registry client expects.
+func Unauthorized(ctx *gin.Context, challenge string) {
+	ctx.Header("Www-Authenticate", challenge)
+	Error(ctx, http.StatusUnauthorized, "UNAUTHORIZED", ErrUnauthenticated.Error(), nil)
+}
+
+type registryError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail"`
+}
+
+// Error aborts with an error in the format of the distribution spec.
+func Error(ctx *gin.Context, status int, code, message string, detail interface{}) {
+	ctx.Header("Docker-Distribution-Api-Version", "registry/2.0")
+	ctx.AbortWithStatusJSON(status, gin.H{"errors": []registryError{{Code: code, Message: message, Detail: detail}}})
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0o600))
+
+	a, err := New(Options{Config: config.Auth{
+		Htpasswd: htpasswd,
+		Tokens:   []config.StaticToken{{Name: "ci", Token: "tok-123"}},
+	}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		setup    func(r *http.Request)
+		identity Identity
+		err      error
+	}{
+		{"anonymous", func(r *http.Request) {}, Identity{}, ErrUnauthenticated},
+		{"htpasswd", func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") }, Identity{Name: "alice", Method: MethodBasic}, nil},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, Identity{}, ErrUnauthenticated},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") }, Identity{}, ErrUnauthenticated},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-123") }, Identity{Name: "ci", Method: MethodStaticToken}, nil},
+		{"token as password", func(r *http.Request) { r.SetBasicAuth("anyone", "tok-123") }, Identity{Name: "ci", Method: MethodStaticToken}, nil},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-124") }, Identity{}, ErrUnauthenticated},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			tc.setup(req)
+			id, err := a.Authenticate(req)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.identity, id)
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	a, err := New(Options{Config: config.Auth{ClientCertificates: true, Groups: map[string][]string{"ops": {"builder"}}}})
+	assert.NoError(t, err)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "builder", OrganizationalUnit: []string{"ci"}}}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	id, err := a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "builder", Method: MethodClientCert, Groups: []string{"ci", "ops"}}, id)
+
+	// Certificates the handshake did not verify are ignored.
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	_, err = a.Authenticate(req)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestMiddlewareChallenges(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a, err := New(Options{Config: config.Auth{Tokens: []config.StaticToken{{Name: "ci", Token: "tok-123"}}}})
+	assert.NoError(t, err)
+	router := gin.New()
+	router.GET("/v2/", Middleware(a), func(ctx *gin.Context) {
+		id, _ := IdentityFrom(ctx.Request.Context())
+		ctx.String(http.StatusOK, id.Name)
+	})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, `Basic realm="reverse-registry"`, resp.Header().Get("Www-Authenticate"))
+	assert.JSONEq(t, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required","detail":null}]}`, resp.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("ci", "tok-123")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "ci", resp.Body.String())
+}
+
+func TestHtpasswdRejectsWeakHashes(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(htpasswd, []byte("alice:$apr1$abc$def\n"), 0o600))
+	_, err := New(Options{Config: config.Auth{Htpasswd: htpasswd}})
+	assert.ErrorContains(t, err, "not a bcrypt hash")
+}
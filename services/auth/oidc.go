@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nduyphuong/reverse-registry/config"
+)
+
+// MethodOIDC is recorded on identities authenticated with a workload
+// identity token.
+const MethodOIDC = "oidc"
+
+var claimRef = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type oidcIssuer struct {
+	conf   config.OIDCIssuer
+	keys   *keySet
+	leeway time.Duration
+}
+
+func newOIDCIssuer(conf config.OIDCIssuer, httpClient *http.Client) (*oidcIssuer, error) {
+	if conf.Issuer == "" {
+		return nil, fmt.Errorf("oidc issuer needs an issuer")
+	}
+	if len(conf.Audiences) == 0 {
+		return nil, fmt.Errorf("oidc issuer %s needs audiences", conf.Issuer)
+	}
+	if conf.Subject == "" {
+		conf.Subject = "{sub}"
+	}
+	return &oidcIssuer{
+		conf:   conf,
+		keys:   &keySet{issuer: conf.Issuer, url: conf.JWKSURL, file: conf.JWKSFile, client: httpClient, keys: make(map[string]crypto.PublicKey)},
+		leeway: time.Minute,
+	}, nil
+}
+
+// issuerOf returns the iss claim of raw without verifying it, to pick the
+// issuer that verifies it.
+func issuerOf(raw string) (string, bool) {
+	if strings.Count(raw, ".") != 2 {
+		return "", false
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, claims); err != nil {
+		return "", false
+	}
+	iss, ok := claims["iss"].(string)
+	return iss, ok
+}
+
+// verify checks the signature, audience, expiry and required claims of raw
+// and maps its claims to an identity.
+func (o *oidcIssuer) verify(raw string, now time.Time) (Identity, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithoutClaimsValidation(),
+	)
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return o.keys.key(kid, now)
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims["iss"] != o.conf.Issuer {
+		return Identity{}, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !o.audienceAllowed(claims) {
+		return Identity{}, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return Identity{}, fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-o.leeway).After(time.Unix(int64(exp), 0)) {
+		return Identity{}, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(o.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Identity{}, fmt.Errorf("token not valid yet")
+	}
+	for name, want := range o.conf.RequiredClaims {
+		if got, ok := claimValue(claims, name); !ok || got != want {
+			return Identity{}, fmt.Errorf("claim %s is %q, want %q", name, got, want)
+		}
+	}
+	name, ok := expand(o.conf.Subject, claims)
+	if !ok || name == "" {
+		return Identity{}, fmt.Errorf("token has no claims for subject %s", o.conf.Subject)
+	}
+	id := Identity{Name: name, Method: MethodOIDC}
+	for _, tmpl := range o.conf.Groups {
+		if group, ok := expand(tmpl, claims); ok {
+			id.Groups = append(id.Groups, group)
+		}
+	}
+	return id, nil
+}
+
+func (o *oidcIssuer) audienceAllowed(claims jwt.MapClaims) bool {
+	for _, aud := range o.conf.Audiences {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces the {claim} references of tmpl, it fails when a claim is
+// missing.
+func expand(tmpl string, claims jwt.MapClaims) (string, bool) {
+	ok := true
+	out := claimRef.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		v, found := claimValue(claims, ref[1:len(ref)-1])
+		if !found {
+			ok = false
+		}
+		return v
+	})
+	return out, ok
+}
+
+// claimValue looks up a claim by name, nested claims are separated with a
+// slash as claim names such as kubernetes.io contain dots.
+func claimValue(claims jwt.MapClaims, name string) (string, bool) {
+	var v interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(name, "/") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// keySet holds the signing keys of an issuer. They are reloaded every hour,
+// and at most once a minute when a token names a key that is not known yet
+// so rotated keys are picked up.
+type keySet struct {
+	issuer string
+	url    string
+	file   string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	loaded  time.Time
+	tried   time.Time
+	lastErr error
+}
+
+func (k *keySet) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.lookup(kid)
+	stale := now.Sub(k.loaded) > time.Hour
+	if (!ok || stale) && now.Sub(k.tried) > time.Minute {
+		k.tried = now
+		keys, err := k.load()
+		k.lastErr = err
+		if err == nil {
+			k.keys, k.loaded = keys, now
+			key, ok = k.lookup(kid)
+		}
+	}
+	if !ok {
+		if k.lastErr != nil {
+			return nil, fmt.Errorf("load keys of %s: %w", k.issuer, k.lastErr)
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup finds the key kid, a token without kid is accepted when the issuer
+// has a single key.
+func (k *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *keySet) load() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	switch {
+	case k.file != "":
+		data, err = os.ReadFile(k.file)
+	case k.url != "":
+		data, err = k.get(k.url)
+	default:
+		data, err = k.discover()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func (k *keySet) discover() ([]byte, error) {
+	data, err := k.get(strings.TrimSuffix(k.issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.JWKSURI == "" {
+		return nil, fmt.Errorf("openid-configuration has no jwks_uri")
+	}
+	return k.get(doc.JWKSURI)
+}
+
+func (k *keySet) get(url string) ([]byte, error) {
+	resp, err := k.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JSON web key set, other
+// keys are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse jwk %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
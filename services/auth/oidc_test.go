@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeJWKS(t *testing.T, kid string, key *ecdsa.PrivateKey) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	data, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC", "use": "sig", "kid": kid, "crv": "P-256",
+		"x": enc(key.X.FillBytes(make([]byte, 32))),
+		"y": enc(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestOIDC(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	issuer := "https://kubernetes.default.svc"
+	a, err := New(Options{Config: config.Auth{
+		OIDC: []config.OIDCIssuer{{
+			Issuer:         issuer,
+			Audiences:      []string{"reverse-registry"},
+			JWKSFile:       writeJWKS(t, "k1", key),
+			Subject:        "k8s:{kubernetes.io/namespace}/{kubernetes.io/serviceaccount/name}",
+			Groups:         []string{"k8s-ns:{kubernetes.io/namespace}", "team:{team}"},
+			RequiredClaims: map[string]string{"kubernetes.io/namespace": "builds"},
+		}},
+		Groups: map[string][]string{"builders": {"k8s:builds/kaniko"}},
+	}})
+	assert.NoError(t, err)
+
+	sign := func(signer *ecdsa.PrivateKey, edit func(jwt.MapClaims)) string {
+		claims := jwt.MapClaims{
+			"iss": issuer,
+			"sub": "system:serviceaccount:builds:kaniko",
+			"aud": []string{"reverse-registry"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+			"kubernetes.io": map[string]interface{}{
+				"namespace":      "builds",
+				"serviceaccount": map[string]interface{}{"name": "kaniko"},
+			},
+		}
+		if edit != nil {
+			edit(claims)
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		raw, err := token.SignedString(signer)
+		assert.NoError(t, err)
+		return raw
+	}
+
+	want := Identity{Name: "k8s:builds/kaniko", Method: MethodOIDC, Groups: []string{"k8s-ns:builds", "builders"}}
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(key, nil), true},
+		{"wrong key", sign(other, nil), false},
+		{"wrong audience", sign(key, func(c jwt.MapClaims) { c["aud"] = "cgr.dev" }), false},
+		{"expired", sign(key, func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }), false},
+		{"no expiry", sign(key, func(c jwt.MapClaims) { delete(c, "exp") }), false},
+		{"unknown issuer", sign(key, func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }), false},
+		{"required claim", sign(key, func(c jwt.MapClaims) {
+			c["kubernetes.io"] = map[string]interface{}{"namespace": "default", "serviceaccount": map[string]interface{}{"name": "kaniko"}}
+		}), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			id, err := a.Authenticate(req)
+			if !tc.ok {
+				assert.ErrorIs(t, err, ErrUnauthenticated)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, want, id)
+
+			// docker login sends the token as a password.
+			req = httptest.NewRequest(http.MethodGet, "/token", nil)
+			req.SetBasicAuth("kaniko", tc.token)
+			id, err = a.Authenticate(req)
+			assert.NoError(t, err)
+			assert.Equal(t, want, id)
+		})
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks, err := os.ReadFile(writeJWKS(t, "k1", key))
+	assert.NoError(t, err)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+		case "/keys":
+			_, _ = w.Write(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	a, err := New(Options{Config: config.Auth{OIDC: []config.OIDCIssuer{{
+		Issuer:    server.URL,
+		Audiences: []string{"reverse-registry"},
+		Subject:   "github:{repository}",
+	}}}})
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":        server.URL,
+		"aud":        "reverse-registry",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"repository": "acme/app",
+	})
+	token.Header["kid"] = "k1"
+	raw, err := token.SignedString(key)
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("Authorization", "Bearer "+raw)
+	id, err := a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "github:acme/app", Method: MethodOIDC}, id)
+}
+
+func TestOIDCNeedsAudiences(t *testing.T) {
+	_, err := New(Options{Config: config.Auth{OIDC: []config.OIDCIssuer{{Issuer: "https://token.actions.githubusercontent.com"}}}})
+	assert.ErrorContains(t, err, "needs audiences")
+}
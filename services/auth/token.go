@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInvalidToken is returned by Verify for tokens that were not issued by
+// this service or expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Access is an entry of the access claim of a registry token, as in
+// repository:nginx:pull.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// String formats a as a scope.
+func (a Access) String() string {
+	return a.Type + ":" + a.Name + ":" + strings.Join(a.Actions, ",")
+}
+
+// Allows reports whether a grants action on the resource typ/name.
+func (a Access) Allows(typ, name, action string) bool {
+	if a.Type != typ || a.Name != name {
+		return false
+	}
+	for _, act := range a.Actions {
+		if act == action || act == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScope parses a scope such as repository:nginx:pull,push. The name may
+// contain colons, e.g. when it has a registry port.
+func ParseScope(scope string) (Access, error) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+	if first <= 0 || first == last || last == len(scope)-1 {
+		return Access{}, fmt.Errorf("invalid scope %q", scope)
+	}
+	return Access{
+		Type:    scope[:first],
+		Name:    scope[first+1 : last],
+		Actions: strings.Split(scope[last+1:], ","),
+	}, nil
+}
+
+// Token is a signed registry token.
+type Token struct {
+	Raw       string
+	IssuedAt  time.Time
+	ExpiresIn time.Duration
+}
+
+type TokenService interface {
+	// Issue signs a token for id granting access.
+	Issue(id Identity, access []Access) (Token, error)
+	// Verify checks the signature, issuer, audience and expiry of a token
+	// and returns who it was issued to and what it grants.
+	Verify(raw string) (Identity, []Access, error)
+	// Service is the audience of the tokens, sent in challenges.
+	Service() string
+	// Realm is the configured token endpoint, empty when it is derived
+	// from the request.
+	Realm() string
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+	// Method is how the subject authenticated to get the token.
+	Method string   `json:"amr,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type tokenService struct {
+	issuer     string
+	service    string
+	realm      string
+	expiration time.Duration
+	key        crypto.Signer
+	keyID      string
+	method     jwt.SigningMethod
+	now        func() time.Time
+}
+
+type TokenOptions struct {
+	Config config.TokenService
+	Log    *logrus.Logger
+}
+
+func NewTokenService(opt TokenOptions) (TokenService, error) {
+	ts := &tokenService{
+		issuer:     opt.Config.Issuer,
+		service:    opt.Config.Service,
+		realm:      opt.Config.Realm,
+		expiration: 5 * time.Minute,
+		now:        time.Now,
+	}
+	if ts.issuer == "" {
+		ts.issuer = "reverse-registry"
+	}
+	if ts.service == "" {
+		ts.service = "reverse-registry"
+	}
+	if opt.Config.Expiration != "" {
+		d, err := time.ParseDuration(opt.Config.Expiration)
+		if err != nil {
+			return nil, err
+		}
+		ts.expiration = d
+	}
+	var err error
+	if opt.Config.Key != "" {
+		ts.key, err = readSigningKey(opt.Config.Key)
+	} else {
+		opt.Log.Warn("no token signing key configured, generated one that is only valid for this process")
+		ts.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := ts.key.(type) {
+	case *rsa.PrivateKey:
+		ts.method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			ts.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			ts.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			ts.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported ecdsa curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key %T", ts.key)
+	}
+	if ts.keyID, err = keyID(ts.key.Public()); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *tokenService) Service() string {
+	return ts.service
+}
+
+func (ts *tokenService) Realm() string {
+	return ts.realm
+}
+
+func (ts *tokenService) Issue(id Identity, access []Access) (Token, error) {
+	now := ts.now()
+	if access == nil {
+		access = []Access{}
+	}
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ts.issuer,
+			Subject:   id.Name,
+			Audience:  jwt.ClaimStrings{ts.service},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ts.expiration)),
+			NotBefore: jwt.NewNumericDate(now.Add(-time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		Access: access,
+		Method: id.Method,
+		Groups: id.Groups,
+	}
+	token := jwt.NewWithClaims(ts.method, claims)
+	token.Header["kid"] = ts.keyID
+	raw, err := token.SignedString(ts.key)
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{Raw: raw, IssuedAt: now, ExpiresIn: ts.expiration}, nil
+}
+
+func (ts *tokenService) Verify(raw string) (Identity, []Access, error) {
+	var claims tokenClaims
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{ts.method.Alg()}))
+	_, err := parser.ParseWithClaims(raw, &claims, func(*jwt.Token) (interface{}, error) {
+		return ts.key.Public(), nil
+	})
+	if err != nil {
+		return Identity{}, nil, ErrInvalidToken
+	}
+	if !claims.VerifyIssuer(ts.issuer, true) || !claims.VerifyAudience(ts.service, true) || claims.ExpiresAt == nil {
+		return Identity{}, nil, ErrInvalidToken
+	}
+	return Identity{Name: claims.Subject, Method: claims.Method, Groups: claims.Groups}, claims.Access, nil
+}
+
+func readSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key %T", path, key)
+	}
+	return signer, nil
+}
+
+// keyID derives the kid the way distribution's libtrust does: the first 240
+// bits of the sha256 of the DER public key, base32 in groups of four.
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	enc := base32.StdEncoding.EncodeToString(sum[:30])
+	groups := make([]string, 0, len(enc)/4)
+	for i := 0; i < len(enc); i += 4 {
+		groups = append(groups, enc[i:i+4])
+	}
+	return strings.Join(groups, ":"), nil
+}
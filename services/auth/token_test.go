@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScope(t *testing.T) {
+	cases := []struct {
+		scope   string
+		want    Access
+		wantErr bool
+	}{
+		{"repository:nginx:pull", Access{"repository", "nginx", []string{"pull"}}, false},
+		{"repository:chainguard/nginx:pull,push", Access{"repository", "chainguard/nginx", []string{"pull", "push"}}, false},
+		{"repository:localhost:5000/nginx:pull", Access{"repository", "localhost:5000/nginx", []string{"pull"}}, false},
+		{"registry:catalog:*", Access{"registry", "catalog", []string{"*"}}, false},
+		{"repository:nginx", Access{}, true},
+		{"repository:nginx:", Access{}, true},
+	}
+	for _, tc := range cases {
+		got, err := ParseScope(tc.scope)
+		if tc.wantErr {
+			assert.Error(t, err, tc.scope)
+			continue
+		}
+		assert.NoError(t, err, tc.scope)
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+func TestTokenService(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+
+	ts, err := NewTokenService(TokenOptions{Config: config.TokenService{Key: keyFile, Service: "proxy"}, Log: logrus.New()})
+	assert.NoError(t, err)
+	access := []Access{{Type: "repository", Name: "nginx", Actions: []string{"pull"}}}
+	token, err := ts.Issue(Identity{Name: "alice", Method: MethodBasic}, access)
+	assert.NoError(t, err)
+
+	id, got, err := ts.Verify(token.Raw)
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "alice", Method: MethodBasic}, id)
+	assert.Equal(t, access, got)
+
+	// Tokens of another audience, signed by another key or expired are
+	// rejected.
+	other, err := NewTokenService(TokenOptions{Config: config.TokenService{Key: keyFile, Service: "other"}, Log: logrus.New()})
+	assert.NoError(t, err)
+	_, _, err = other.Verify(token.Raw)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	generated, err := NewTokenService(TokenOptions{Config: config.TokenService{Service: "proxy"}, Log: logrus.New()})
+	assert.NoError(t, err)
+	_, _, err = generated.Verify(token.Raw)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	ts.(*tokenService).now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expired, err := ts.Issue(Identity{Name: "alice"}, access)
+	assert.NoError(t, err)
+	_, _, err = ts.Verify(expired.Raw)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -0,0 +1,228 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Actions rules can grant.
+const (
+	Pull  = "pull"
+	List  = "list"
+	Admin = "admin"
+)
+
+// ErrDenied is returned by Authorize when no rule grants the access.
+var ErrDenied = errors.New("requested access to the resource is denied")
+
+type Interface interface {
+	// Allowed reports whether a rule grants id action on repo.
+	Allowed(id auth.Identity, repo, action string) bool
+	// Authorize is Allowed, writing denials to the audit log.
+	Authorize(ctx context.Context, id auth.Identity, repo, action string) error
+}
+
+type rule struct {
+	subjects     []string
+	repositories []string
+	actions      []string
+}
+
+type client struct {
+	static   []rule
+	storage  repository.AccessRuleInterface
+	interval time.Duration
+	audit    *logrus.Logger
+	log      *logrus.Logger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	dbRules  []rule
+	loadedAt time.Time
+}
+
+type Options struct {
+	Config config.Authz
+	// Storage is read when Config.DB is set.
+	Storage repository.AccessRuleInterface
+	// Audit receives one JSON line per denial, defaults to stdout.
+	Audit io.Writer
+	Log   *logrus.Logger
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		interval: 30 * time.Second,
+		log:      opt.Log,
+		now:      time.Now,
+	}
+	for _, r := range opt.Config.Rules {
+		if len(r.Subjects) == 0 || len(r.Repositories) == 0 || len(r.Actions) == 0 {
+			return nil, fmt.Errorf("access rule needs subjects, repositories and actions")
+		}
+		if err := validActions(r.Actions); err != nil {
+			return nil, err
+		}
+		c.static = append(c.static, rule{subjects: r.Subjects, repositories: r.Repositories, actions: r.Actions})
+	}
+	if opt.Config.DB {
+		if opt.Storage == nil {
+			return nil, fmt.Errorf("authz.db needs a database")
+		}
+		c.storage = opt.Storage
+	}
+	if opt.Config.ReloadInterval != "" {
+		d, err := time.ParseDuration(opt.Config.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		c.interval = d
+	}
+	c.audit = logrus.New()
+	c.audit.SetOutput(os.Stdout)
+	if opt.Audit != nil {
+		c.audit.SetOutput(opt.Audit)
+	}
+	c.audit.SetFormatter(&logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"},
+	})
+	return c, nil
+}
+
+func (c *client) Allowed(id auth.Identity, repo, action string) bool {
+	for _, r := range c.static {
+		if r.matches(id, repo, action) {
+			return true
+		}
+	}
+	for _, r := range c.loadDBRules() {
+		if r.matches(id, repo, action) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) Authorize(ctx context.Context, id auth.Identity, repo, action string) error {
+	if c.Allowed(id, repo, action) {
+		return nil
+	}
+	logging.FromContext(ctx, c.audit).WithFields(logrus.Fields{
+		"user":       id.Name,
+		"groups":     id.Groups,
+		"method":     id.Method,
+		"repository": repo,
+		"action":     action,
+		"decision":   "denied",
+	}).Warn("access denied")
+	return ErrDenied
+}
+
+// loadDBRules returns the rules of the database, reading them again once
+// they are older than the reload interval. The previous rules are kept when
+// the database can not be read.
+func (c *client) loadDBRules() []rule {
+	if c.storage == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if !c.loadedAt.IsZero() && now.Sub(c.loadedAt) < c.interval {
+		return c.dbRules
+	}
+	c.loadedAt = now
+	rows, err := c.storage.List()
+	if err != nil {
+		c.log.Errorf("load access rules %v", err)
+		return c.dbRules
+	}
+	rules := make([]rule, 0, len(rows))
+	for _, row := range rows {
+		actions := strings.Split(row.Actions, ",")
+		for i := range actions {
+			actions[i] = strings.TrimSpace(actions[i])
+		}
+		if err := validActions(actions); err != nil {
+			c.log.Errorf("access rule %d %v", row.ID, err)
+			continue
+		}
+		rules = append(rules, rule{subjects: []string{row.Subject}, repositories: []string{row.Repository}, actions: actions})
+	}
+	c.dbRules = rules
+	return rules
+}
+
+func (r rule) matches(id auth.Identity, repo, action string) bool {
+	return contains(r.actions, action) && r.matchesSubject(id) && r.matchesRepository(repo)
+}
+
+func (r rule) matchesSubject(id auth.Identity) bool {
+	for _, s := range r.subjects {
+		if s == "*" || s == id.Name {
+			return true
+		}
+		if group, ok := strings.CutPrefix(s, "group:"); ok && contains(id.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matchesRepository(repo string) bool {
+	for _, pattern := range r.repositories {
+		if MatchRepository(pattern, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRepository matches repo against a pattern where * matches within a
+// path segment and a trailing ** matches anything, e.g. team/** matches
+// team/app and team/app/debug.
+func MatchRepository(pattern, repo string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "**"); ok {
+		return strings.HasPrefix(repo, prefix)
+	}
+	ok, _ := path.Match(pattern, repo)
+	return ok
+}
+
+func validActions(actions []string) error {
+	for _, a := range actions {
+		if a != Pull && a != List && a != Admin {
+			return fmt.Errorf("unknown action %q, expected pull, list or admin", a)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Deny aborts with the DENIED error of the distribution spec.
+func Deny(ctx *gin.Context, repo, action string) {
+	auth.Error(ctx, http.StatusForbidden, "DENIED", ErrDenied.Error(), gin.H{"repository": repo, "action": action})
+}
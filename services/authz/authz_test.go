@@ -0,0 +1,92 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRules struct {
+	rules []model.AccessRule
+	calls int
+}
+
+func (f *fakeRules) List() ([]model.AccessRule, error) {
+	f.calls++
+	return f.rules, nil
+}
+
+func TestAllowed(t *testing.T) {
+	a, err := New(Options{Config: config.Authz{Rules: []config.AccessRule{
+		{Subjects: []string{"*"}, Repositories: []string{"public/**", "nginx"}, Actions: []string{"pull", "list"}},
+		{Subjects: []string{"group:platform"}, Repositories: []string{"**"}, Actions: []string{"pull", "list", "admin"}},
+		{Subjects: []string{"ci"}, Repositories: []string{"team-*/app"}, Actions: []string{"pull"}},
+	}}, Log: logrus.New()})
+	assert.NoError(t, err)
+
+	alice := auth.Identity{Name: "alice"}
+	ops := auth.Identity{Name: "bob", Groups: []string{"platform"}}
+	ci := auth.Identity{Name: "ci"}
+	cases := []struct {
+		id     auth.Identity
+		repo   string
+		action string
+		want   bool
+	}{
+		{alice, "nginx", Pull, true},
+		{alice, "public/tools/jq", List, true},
+		{alice, "nginx", Admin, false},
+		{alice, "private", Pull, false},
+		{ops, "private", Admin, true},
+		{ci, "team-a/app", Pull, true},
+		{ci, "team-a/app", List, false},
+		{ci, "team-a/sub/app", Pull, false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, a.Allowed(tc.id, tc.repo, tc.action), "%s %s %s", tc.id.Name, tc.action, tc.repo)
+	}
+}
+
+func TestDBRulesAndAudit(t *testing.T) {
+	storage := &fakeRules{rules: []model.AccessRule{{ID: 1, Subject: "alice", Repository: "nginx", Actions: "pull, list"}}}
+	audit := new(bytes.Buffer)
+	a, err := New(Options{Config: config.Authz{DB: true, ReloadInterval: "1m"}, Storage: storage, Audit: audit, Log: logrus.New()})
+	assert.NoError(t, err)
+	c := a.(*client)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	alice := auth.Identity{Name: "alice", Method: auth.MethodBasic}
+	assert.NoError(t, a.Authorize(context.Background(), alice, "nginx", List))
+	assert.Equal(t, 0, audit.Len())
+
+	// Rules are cached until the reload interval passed.
+	storage.rules = nil
+	assert.True(t, a.Allowed(alice, "nginx", Pull))
+	assert.Equal(t, 1, storage.calls)
+	now = now.Add(time.Minute)
+	assert.ErrorIs(t, a.Authorize(context.Background(), alice, "nginx", Pull), ErrDenied)
+	assert.Equal(t, 2, storage.calls)
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(audit.Bytes(), &line))
+	assert.Equal(t, "alice", line["user"])
+	assert.Equal(t, "nginx", line["repository"])
+	assert.Equal(t, "pull", line["action"])
+	assert.Equal(t, "denied", line["decision"])
+}
+
+func TestNewRejectsUnknownActions(t *testing.T) {
+	_, err := New(Options{Config: config.Authz{Rules: []config.AccessRule{
+		{Subjects: []string{"*"}, Repositories: []string{"**"}, Actions: []string{"push"}},
+	}}})
+	assert.ErrorContains(t, err, "unknown action")
+}
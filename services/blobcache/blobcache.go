@@ -0,0 +1,239 @@
+package blobcache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// Interface keeps blobs once by digest, linked to the repositories they were
+// fetched for: a blob is only found through a repository it is linked to.
+type Interface interface {
+	// Open returns the cached blob dgst of repo, an error satisfying
+	// errors.Is(err, fs.ErrNotExist) when it is not cached for repo.
+	Open(repo string, dgst digest.Digest) (*os.File, error)
+	// Create returns a Writer for dgst of repo. The blob is only visible
+	// to Open once committed.
+	Create(repo string, dgst digest.Digest) (Writer, error)
+}
+
+// Writer receives a blob while it streams to a client.
+type Writer interface {
+	Write(p []byte) (int, error)
+	// Commit stores the blob, the caller verified its digest.
+	Commit() error
+	// Abort drops the blob, it is a no-op after Commit.
+	Abort()
+}
+
+type client struct {
+	dir     string
+	maxSize int64
+	log     *logrus.Logger
+
+	mu   sync.Mutex
+	size int64
+}
+
+type Options struct {
+	Config config.BlobCache
+	Log    *logrus.Logger
+}
+
+func New(opt Options) (Interface, error) {
+	if opt.Config.Dir == "" {
+		return nil, fmt.Errorf("blob cache needs a dir")
+	}
+	c := &client{dir: opt.Config.Dir, maxSize: opt.Config.MaxSize, log: opt.Log}
+	if c.log == nil {
+		c.log = logrus.StandardLogger()
+	}
+	// Leftovers of writes interrupted by a restart.
+	if err := os.RemoveAll(filepath.Join(c.dir, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"tmp", "blobs", "repositories"} {
+		if err := os.MkdirAll(filepath.Join(c.dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	blobs, err := c.blobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blobs {
+		c.size += b.size
+	}
+	return c, nil
+}
+
+func (c *client) path(dgst digest.Digest) string {
+	hex := dgst.Encoded()
+	return filepath.Join(c.dir, "blobs", dgst.Algorithm().String(), hex[:2], hex)
+}
+
+// link is the file linking dgst to repo, e.g.
+// repositories/chainguard/nginx/_layers/sha256/<hex>.
+func (c *client) link(repo string, dgst digest.Digest) (string, error) {
+	clean := path.Clean("/" + repo)
+	if clean != "/"+repo || repo == "" {
+		return "", fmt.Errorf("invalid repository %q", repo)
+	}
+	return filepath.Join(c.dir, "repositories", filepath.FromSlash(repo), "_layers", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+func (c *client) Open(repo string, dgst digest.Digest) (*os.File, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	link, err := c.link(repo, dgst)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(link); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(c.path(dgst))
+	if err != nil {
+		return nil, err
+	}
+	// The modification time orders blobs for eviction.
+	now := time.Now()
+	_ = os.Chtimes(f.Name(), now, now)
+	return f, nil
+}
+
+func (c *client) Create(repo string, dgst digest.Digest) (Writer, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	link, err := c.link(repo, dgst)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), dgst.Encoded()+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{cache: c, file: f, path: c.path(dgst), link: link}, nil
+}
+
+type writer struct {
+	cache *client
+	file  *os.File
+	path  string
+	link  string
+	size  int64
+	done  bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *writer) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if _, err := os.Stat(w.path); err == nil {
+		// Already cached for another repository.
+		os.Remove(w.file.Name())
+	} else {
+		if err := os.Rename(w.file.Name(), w.path); err != nil {
+			os.Remove(w.file.Name())
+			return err
+		}
+		w.cache.added(w.size)
+	}
+	if err := os.MkdirAll(filepath.Dir(w.link), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(w.link, nil, 0o644)
+}
+
+func (w *writer) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// added accounts for a new blob and evicts the least recently used blobs
+// when the cache grew over its size.
+func (c *client) added(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += size
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+	blobs, err := c.blobs()
+	if err != nil {
+		c.log.Errorf("list cached blobs %v", err)
+		return
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].used.Before(blobs[j].used) })
+	c.size = 0
+	for _, b := range blobs {
+		c.size += b.size
+	}
+	for _, b := range blobs {
+		if c.size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.log.Errorf("evict cached blob %v", err)
+			continue
+		}
+		c.size -= b.size
+	}
+}
+
+type blob struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func (c *client) blobs() ([]blob, error) {
+	var blobs []blob
+	root := filepath.Join(c.dir, "blobs")
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Evicted meanwhile.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		blobs = append(blobs, blob{path: path, size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
@@ -0,0 +1,75 @@
+package blobcache
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func put(t *testing.T, c Interface, repo, content string) digest.Digest {
+	dgst := digest.FromString(content)
+	w, err := c.Create(repo, dgst)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Commit())
+	return dgst
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(Options{Config: config.BlobCache{Dir: dir, MaxSize: 10}})
+	assert.NoError(t, err)
+
+	// Aborted blobs are not visible.
+	aborted := digest.FromString("aborted")
+	w, err := c.Create("nginx", aborted)
+	assert.NoError(t, err)
+	_, _ = w.Write([]byte("abort"))
+	w.Abort()
+	_, err = c.Open("nginx", aborted)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	first := put(t, c, "nginx", "aaaa")
+	second := put(t, c, "nginx", "bbbb")
+	f, err := c.Open("nginx", first)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "aaaa", string(data))
+
+	// Opening first made second the least recently used one.
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(c.(*client).path(second), old, old))
+	third := put(t, c, "nginx", "cccc")
+	_, err = c.Open("nginx", second)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	for _, d := range []digest.Digest{first, third} {
+		f, err := c.Open("nginx", d)
+		assert.NoError(t, err)
+		f.Close()
+	}
+
+	// Blobs are only found through the repositories they were cached for,
+	// and stored once.
+	_, err = c.Open("redis", first)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, first, put(t, c, "team/redis", "aaaa"))
+	f, err = c.Open("team/redis", first)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, int64(8), c.(*client).size)
+	_, err = c.Open("../nginx", first)
+	assert.Error(t, err)
+
+	// The size of the blobs on disk is picked up on start.
+	c, err = New(Options{Config: config.BlobCache{Dir: dir, MaxSize: 10}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), c.(*client).size)
+}
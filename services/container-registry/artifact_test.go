@@ -0,0 +1,48 @@
+package containerregistry
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifact(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := strings.TrimPrefix(server.URL, "http://") + "/chainguard/nginx"
+	img, err := random.Image(64, 2)
+	assert.NoError(t, err)
+	ref, err := name.NewTag(repo + ":sha256-abc.sig")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+
+	c := New(Options{})
+	a, err := c.Artifact(repo, "sha256-abc.sig")
+	assert.NoError(t, err)
+	manifest, _ := img.RawManifest()
+	dgst, _ := img.Digest()
+	assert.Equal(t, manifest, a.Manifest)
+	assert.Equal(t, dgst.String(), a.Digest)
+	layers, _ := img.Layers()
+	assert.Len(t, a.Blobs, len(layers)+1)
+	config, _ := img.RawConfigFile()
+	configName, _ := img.ConfigName()
+	assert.Equal(t, config, a.Blobs[configName.String()])
+
+	head, err := c.ArtifactDigest(repo, "sha256-abc.sig")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst.String(), head)
+
+	a, err = c.Artifact(repo, "sha256-abc.att")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+	head, err = c.ArtifactDigest(repo, "sha256-abc.att")
+	assert.NoError(t, err)
+	assert.Empty(t, head)
+}
@@ -1,10 +1,14 @@
 package containerregistry
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"regexp"
 	"strings"
 
@@ -12,29 +16,103 @@ import (
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
 	"github.com/sigstore/cosign/v2/cmd/cosign/cli/options"
 	"github.com/sigstore/cosign/v2/pkg/cosign"
 	"github.com/sigstore/cosign/v2/pkg/oci"
 	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
 )
 
+// ErrAttestation is wrapped by VersionFromSbom when the signed provenance
+// attestation can not be fetched or decoded.
+var ErrAttestation = errors.New("attestation")
+
 type Interface interface {
 	Head(imageName string) error
 	ManifestOrIndex(repoName string) ([]byte, error)
 	ListTagsWithConstraint(repoName, constraint string) ([]string, error)
 	VersionFromSbom(mainPkg, repo string) (string, error)
+	// Artifact downloads the manifest tagged tag in repo with the blobs it
+	// references, nil when there is no such tag.
+	Artifact(repo, tag string) (*Artifact, error)
+	// ArtifactDigest returns the digest of the manifest tagged tag in repo,
+	// empty when there is no such tag.
+	ArtifactDigest(repo, tag string) (string, error)
+	// VerifySignature checks that image, a reference by digest, has a
+	// cosign signature matching Options.Verification. Signatures that do
+	// not verify give an error wrapping ErrSignature.
+	VerifySignature(image string) error
+	// WithContext returns a copy whose requests are bound to ctx.
+	WithContext(ctx context.Context) Interface
+}
+
+// maxArtifactBlobSize bounds the blobs of an artifact, SBOMs being the
+// largest.
+const maxArtifactBlobSize = 32 << 20
+
+// Artifact is a signature, attestation or SBOM manifest and its blobs.
+type Artifact struct {
+	MediaType string
+	Digest    string
+	Manifest  []byte
+	// Blobs by digest.
+	Blobs map[string][]byte
 }
 
 type Client struct {
+	transport http.RoundTripper
+	keychain  authn.Keychain
+	verifier  *verifier
+	ctx       context.Context
+}
+
+type Options struct {
+	// Keychain resolves upstream credentials, defaults to
+	// authn.DefaultKeychain.
+	Keychain authn.Keychain
+	// Transport used for upstream requests, defaults to an instrumented and
+	// traced remote.DefaultTransport.
+	Transport http.RoundTripper
+	// Verification is the policy of VerifySignature.
+	Verification config.SignatureVerification
 }
 
-func New() Interface {
-	return &Client{}
+func New(opt Options) Interface {
+	keychain := opt.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	transport := opt.Transport
+	if transport == nil {
+		transport = tracing.Transport(metrics.InstrumentRoundTripper(remote.DefaultTransport))
+	}
+	c := &Client{
+		transport: transport,
+		keychain:  keychain,
+		ctx:       context.Background(),
+	}
+	if opt.Verification.Enabled {
+		c.verifier = &verifier{conf: opt.Verification}
+	}
+	return c
+}
+
+func (c *Client) WithContext(ctx context.Context) Interface {
+	return &Client{
+		transport: c.transport,
+		keychain:  c.keychain,
+		verifier:  c.verifier,
+		ctx:       ctx,
+	}
 }
 
 func (c *Client) Head(imageName string) error {
 	opts := c.getAuthOpt()
-	if _, err := crane.Head(imageName, opts); err != nil {
+	if _, err := crane.Head(imageName, opts, crane.WithTransport(c.transport), crane.WithContext(c.ctx)); err != nil {
 		return err
 	}
 	return nil
@@ -42,12 +120,12 @@ func (c *Client) Head(imageName string) error {
 
 func (c *Client) ManifestOrIndex(image string) ([]byte, error) {
 	opts := c.getAuthOpt()
-	return crane.Manifest(image, opts)
+	return crane.Manifest(image, opts, crane.WithTransport(c.transport), crane.WithContext(c.ctx))
 }
 
 func (c *Client) ListTagsWithConstraint(repoName string, constraint string) ([]string, error) {
 	result := make([]string, 0)
-	tags, err := crane.ListTags(repoName)
+	tags, err := crane.ListTags(repoName, c.getAuthOpt(), crane.WithTransport(c.transport), crane.WithContext(c.ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +139,35 @@ func (c *Client) ListTagsWithConstraint(repoName string, constraint string) ([]s
 }
 
 func (c *Client) VersionFromSbom(mainPkg string, imageRef string) (string, error) {
-	ctx := context.TODO()
+	attestations, err := c.downloadAttestations(imageRef)
+	if err != nil {
+		return "", err
+	}
+	_, span := tracing.Start(c.ctx, "containerregistry.AttestationExtract")
+	defer span.End()
+	if len(attestations) == 0 {
+		return "", fmt.Errorf("%w: no attestation found", ErrAttestation)
+	}
+	if len(attestations) > 1 {
+		return "", fmt.Errorf("%w: filtered attestation list is more than one", ErrAttestation)
+	}
+	var a attestationPayload
+	att := attestations[0]
+	pB, err := base64.StdEncoding.DecodeString(att.PayLoad)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAttestation, err)
+	}
+	if err := json.Unmarshal(pB, &a); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAttestation, err)
+	}
+	return a.Predicate.BuildDefinition.InternalParameters[mainPkg], nil
+}
+
+// downloadAttestations fetches the SLSA provenance attestations of the
+// linux/amd64 image of imageRef.
+func (c *Client) downloadAttestations(imageRef string) (attestations []cosign.AttestationPayload, err error) {
+	ctx, span := tracing.Start(c.ctx, "containerregistry.AttestationDownload")
+	defer func() { tracing.End(span, err) }()
 	// type Package struct {
 	// 	Name        string `json:"name"`
 	// 	VersionInfo string `json:"versionInfo"`
@@ -70,15 +176,19 @@ func (c *Client) VersionFromSbom(mainPkg string, imageRef string) (string, error
 	// 	Packages []Package `json:"packages"`
 	// }
 	// buf := new(bytes.Buffer)
-	kc := authn.NewMultiKeychain(
-		authn.DefaultKeychain,
-	)
+	kc := c.keychain
 
-	regOpts := options.RegistryOptions{Keychain: kc}
+	regOpts := options.RegistryOptions{
+		Keychain: kc,
+		RegistryClientOpts: []remote.Option{
+			remote.WithAuthFromKeychain(kc),
+			remote.WithTransport(c.transport),
+		},
+	}
 	// do := &options.SBOMDownloadOptions{Platform: "linux/amd64"}
 	// sboms, err := cdl.SBOMCmd(context.TODO(), *o, *do, repo, buf)
 	// if err != nil {
-	// 	return "", err
+	// 	return nil, err
 	// }
 	// var ps Packages
 
@@ -96,47 +206,47 @@ func (c *Client) VersionFromSbom(mainPkg string, imageRef string) (string, error
 	}
 	ref, err := name.ParseReference(imageRef, regOpts.NameOptions()...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	ociremoteOpts, err := regOpts.ClientOpts(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var predicateType string
 	predicateType, err = options.ParsePredicateType(attOptions.PredicateType)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	se, err := ociremote.SignedEntity(ref, ociremoteOpts...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	idx, isIndex := se.(oci.SignedImageIndex)
 
 	// We only allow --platform on multiarch indexes
 	if attOptions.Platform != "" && !isIndex {
-		return "", fmt.Errorf("specified reference is not a multiarch image")
+		return nil, fmt.Errorf("specified reference is not a multiarch image")
 	}
 
 	if attOptions.Platform != "" && isIndex {
 		targetPlatform, err := v1.ParsePlatform(attOptions.Platform)
 		if err != nil {
-			return "", fmt.Errorf("parsing platform: %w", err)
+			return nil, fmt.Errorf("parsing platform: %w", err)
 		}
 		platforms, err := getIndexPlatforms(idx)
 		if err != nil {
-			return "", fmt.Errorf("getting available platforms: %w", err)
+			return nil, fmt.Errorf("getting available platforms: %w", err)
 		}
 
 		platforms = matchPlatform(targetPlatform, platforms)
 		if len(platforms) == 0 {
-			return "", fmt.Errorf("unable to find an attestation for %s", targetPlatform.String())
+			return nil, fmt.Errorf("unable to find an attestation for %s", targetPlatform.String())
 		}
 		if len(platforms) > 1 {
-			return "nil", fmt.Errorf(
+			return nil, fmt.Errorf(
 				"platform spec matches more than one image architecture: %s",
 				platforms.String(),
 			)
@@ -144,31 +254,96 @@ func (c *Client) VersionFromSbom(mainPkg string, imageRef string) (string, error
 
 		nse, err := idx.SignedImage(platforms[0].hash)
 		if err != nil {
-			return "", fmt.Errorf("searching for %s image: %w", platforms[0].hash.String(), err)
+			return nil, fmt.Errorf("searching for %s image: %w", platforms[0].hash.String(), err)
 		}
 		if nse == nil {
-			return "", fmt.Errorf("unable to find image %s", platforms[0].hash.String())
+			return nil, fmt.Errorf("unable to find image %s", platforms[0].hash.String())
 		}
 		se = nse
 	}
 
-	attestations, err := cosign.FetchAttestations(se, predicateType)
+	attestations, err = cosign.FetchAttestations(se, predicateType)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %v", ErrAttestation, err)
 	}
-	if len(attestations) > 1 {
-		return "", fmt.Errorf("filtered attestation list is more than one")
+	return attestations, nil
+}
+
+func (c *Client) Artifact(repo, tag string) (artifact *Artifact, err error) {
+	_, span := tracing.Start(c.ctx, "containerregistry.ArtifactDownload")
+	defer func() { tracing.End(span, err) }()
+	ref, err := name.NewTag(repo + ":" + tag)
+	if err != nil {
+		return nil, err
+	}
+	opts := []remote.Option{
+		remote.WithAuthFromKeychain(c.keychain),
+		remote.WithTransport(c.transport),
+		remote.WithContext(c.ctx),
+	}
+	desc, err := remote.Get(ref, opts...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, nil
 	}
-	var a attestationPayload
-	att := attestations[0]
-	pB, err := base64.StdEncoding.DecodeString(att.PayLoad)
+	if err != nil {
+		return nil, err
+	}
+	artifact = &Artifact{
+		MediaType: string(desc.MediaType),
+		Digest:    desc.Digest.String(),
+		Manifest:  desc.Manifest,
+		Blobs:     make(map[string][]byte),
+	}
+	if desc.MediaType.IsIndex() {
+		return artifact, nil
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		if d.Size > maxArtifactBlobSize {
+			return nil, fmt.Errorf("blob %s of %s is too large", d.Digest, ref)
+		}
+		layer, err := remote.Layer(ref.Context().Digest(d.Digest.String()), opts...)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		blob, err := io.ReadAll(io.LimitReader(rc, maxArtifactBlobSize))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		artifact.Blobs[d.Digest.String()] = blob
+	}
+	return artifact, nil
+}
+
+func (c *Client) ArtifactDigest(repo, tag string) (dgst string, err error) {
+	_, span := tracing.Start(c.ctx, "containerregistry.ArtifactHead")
+	defer func() { tracing.End(span, err) }()
+	ref, err := name.NewTag(repo + ":" + tag)
 	if err != nil {
 		return "", err
 	}
-	if err := json.Unmarshal(pB, &a); err != nil {
+	desc, err := remote.Head(ref,
+		remote.WithAuthFromKeychain(c.keychain),
+		remote.WithTransport(c.transport),
+		remote.WithContext(c.ctx),
+	)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if err != nil {
 		return "", err
 	}
-	return a.Predicate.BuildDefinition.InternalParameters[mainPkg], nil
+	return desc.Digest.String(), nil
 }
 
 type attestationPayload struct {
@@ -186,10 +361,7 @@ type buildDefinition struct {
 //  cosign download attestation cgr.dev/chainguard/redis --predicate-type https://slsa.dev/provenance/v1  | jq '.payload | @base64d | fromjson | .predicate.buildDefinition.internalParameters.redis'
 
 func (c *Client) getAuthOpt() crane.Option {
-	kc := authn.NewMultiKeychain(
-		authn.DefaultKeychain,
-	)
-	return crane.WithAuthFromKeychain(kc)
+	return crane.WithAuthFromKeychain(c.keychain)
 }
 
 func getIndexPlatforms(idx oci.SignedImageIndex) (platformList, error) {
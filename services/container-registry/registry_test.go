@@ -8,34 +8,34 @@ import (
 )
 
 func TestHead(t *testing.T) {
-	c := New()
+	c := New(Options{})
 	err := c.Head("997193205088.dkr.ecr.us-east-1.amazonaws.com/source")
 	assert.NoError(t, err)
 }
 
 func TestGetManifest(t *testing.T) {
-	c := New()
+	c := New(Options{})
 	b, err := c.ManifestOrIndex("997193205088.dkr.ecr.us-east-1.amazonaws.com/source")
 	assert.NoError(t, err)
 	fmt.Printf("string(b): %v\n", string(b))
 }
 
 func TestGetIndex(t *testing.T) {
-	c := New()
+	c := New(Options{})
 	b, err := c.ManifestOrIndex("cgr.dev/chainguard/nginx")
 	assert.NoError(t, err)
 	fmt.Printf("string(b): %v\n", string(b))
 }
 
 func TestListTag(t *testing.T) {
-	c := New()
+	c := New(Options{})
 	tags, err := c.ListTagsWithConstraint("997193205088.dkr.ecr.us-east-1.amazonaws.com/dest", "^1.2.*")
 	assert.NoError(t, err)
 	fmt.Printf("tags: %v\n", tags)
 }
 
 func TestVersionFromSbom(t *testing.T) {
-	c := New()
+	c := New(Options{})
 	v, err := c.VersionFromSbom("nginx", "cgr.dev/chainguard/nginx:1.25.1-r0")
 	assert.NoError(t, err)
 	fmt.Printf("version: %v\n", v)
@@ -0,0 +1,121 @@
+package containerregistry
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// ErrSignature is wrapped by VerifySignature when the image has no
+// signature matching the verification policy.
+var ErrSignature = errors.New("signature")
+
+// verifier holds the trust roots signatures are checked against. They are
+// loaded on first use, the keyless ones from the Sigstore TUF repository,
+// and loaded again after a failure.
+type verifier struct {
+	conf config.SignatureVerification
+
+	mu   sync.Mutex
+	opts *cosign.CheckOpts
+}
+
+func (v *verifier) checkOpts(ctx context.Context) (*cosign.CheckOpts, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.opts != nil {
+		return v.opts, nil
+	}
+	co := &cosign.CheckOpts{IgnoreTlog: v.conf.IgnoreTlog}
+	var err error
+	if v.conf.Key != "" {
+		pem, err := os.ReadFile(v.conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := cryptoutils.UnmarshalPEMToPublicKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("signature key %w", err)
+		}
+		if co.SigVerifier, err = signature.LoadVerifier(pub, crypto.SHA256); err != nil {
+			return nil, err
+		}
+	} else {
+		if v.conf.CertificateIdentity == "" || v.conf.CertificateOIDCIssuer == "" {
+			return nil, errors.New("keyless signature verification needs a certificate identity and issuer")
+		}
+		co.Identities = []cosign.Identity{{Subject: v.conf.CertificateIdentity, Issuer: v.conf.CertificateOIDCIssuer}}
+		if co.RootCerts, err = fulcioroots.Get(); err != nil {
+			return nil, err
+		}
+		if co.IntermediateCerts, err = fulcioroots.GetIntermediates(); err != nil {
+			return nil, err
+		}
+		if co.CTLogPubKeys, err = cosign.GetCTLogPubs(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if !v.conf.IgnoreTlog {
+		if co.RekorPubKeys, err = cosign.GetRekorPubs(ctx); err != nil {
+			return nil, err
+		}
+	}
+	v.opts = co
+	return co, nil
+}
+
+func (c *Client) VerifySignature(image string) (err error) {
+	ctx, span := tracing.Start(c.ctx, "containerregistry.SignatureVerify")
+	defer func() { tracing.End(span, err) }()
+	if c.verifier == nil {
+		return errors.New("signature verification is not configured")
+	}
+	ref, err := name.NewDigest(image)
+	if err != nil {
+		return err
+	}
+	co, err := c.verifier.checkOpts(ctx)
+	if err != nil {
+		return err
+	}
+	opts := *co
+	opts.RegistryClientOpts = []ociremote.Option{ociremote.WithRemoteOptions(
+		remote.WithAuthFromKeychain(c.keychain),
+		remote.WithTransport(c.transport),
+		remote.WithContext(ctx),
+	)}
+	if _, _, err := cosign.VerifyImageSignatures(ctx, ref, &opts); err != nil {
+		if signatureFailure(err) {
+			return fmt.Errorf("%w: %v", ErrSignature, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// signatureFailure reports whether err says the signatures of an image do
+// not verify, rather than that they could not be fetched.
+func signatureFailure(err error) bool {
+	var (
+		noMatching    *cosign.ErrNoMatchingSignatures
+		noSignatures  *cosign.ErrNoSignaturesFound
+		noCertificate *cosign.ErrNoCertificateFoundOnSignature
+		failure       *cosign.VerificationFailure
+		verification  *cosign.VerificationError
+	)
+	return errors.As(err, &noMatching) || errors.As(err, &noSignatures) || errors.As(err, &noCertificate) ||
+		errors.As(err, &failure) || errors.As(err, &verification)
+}
@@ -0,0 +1,84 @@
+package containerregistry
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/sigstore/cosign/v2/pkg/oci/mutate"
+	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+	"github.com/sigstore/cosign/v2/pkg/oci/static"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/chainguard/nginx")
+	assert.NoError(t, err)
+	push := func(tag string) (*ecdsa.PrivateKey, name.Digest) {
+		img, err := random.Image(64, 1)
+		assert.NoError(t, err)
+		assert.NoError(t, remote.Write(repo.Tag(tag), img))
+		dgst, _ := img.Digest()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		return key, repo.Digest(dgst.String())
+	}
+	sign := func(key *ecdsa.PrivateKey, ref name.Digest) {
+		body, err := payload.Cosign{Image: ref}.MarshalJSON()
+		assert.NoError(t, err)
+		signer, err := signature.LoadECDSASignerVerifier(key, crypto.SHA256)
+		assert.NoError(t, err)
+		sig, err := signer.SignMessage(bytes.NewReader(body))
+		assert.NoError(t, err)
+		ociSig, err := static.NewSignature(body, base64.StdEncoding.EncodeToString(sig))
+		assert.NoError(t, err)
+		img, err := remote.Image(ref)
+		assert.NoError(t, err)
+		se, err := mutate.AttachSignatureToImage(signed.Image(img), ociSig)
+		assert.NoError(t, err)
+		assert.NoError(t, ociremote.WriteSignatures(repo, se))
+	}
+	client := func(key *ecdsa.PrivateKey) Interface {
+		pem, err := cryptoutils.MarshalPublicKeyToPEM(key.Public())
+		assert.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "cosign.pub")
+		assert.NoError(t, os.WriteFile(path, pem, 0o600))
+		return New(Options{Verification: config.SignatureVerification{Enabled: true, Key: path, IgnoreTlog: true}})
+	}
+
+	key, ref := push("signed")
+	sign(key, ref)
+	assert.NoError(t, client(key).VerifySignature(ref.String()))
+
+	other, _ := push("other")
+	err = client(other).VerifySignature(ref.String())
+	assert.True(t, errors.Is(err, ErrSignature), "%v", err)
+
+	key, unsigned := push("unsigned")
+	err = client(key).VerifySignature(unsigned.String())
+	assert.True(t, errors.Is(err, ErrSignature), "%v", err)
+
+	err = New(Options{}).VerifySignature(ref.String())
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrSignature))
+}
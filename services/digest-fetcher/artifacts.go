@@ -0,0 +1,144 @@
+package digestfetcher
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
+)
+
+// artifactKinds are the suffixes of the tags cosign attaches signatures,
+// attestations and SBOMs to an image digest with.
+var artifactKinds = []string{"sig", "att", "sbom"}
+
+// artifactState is what keepArtifacts knows of the artifacts of a
+// repository since it last looked: the index it looked for and the tags it
+// did not find.
+type artifactState struct {
+	index  string
+	absent map[string]absentArtifact
+}
+
+// absentArtifact is a tag not found upstream, or that could not be looked
+// at, looked for again at next.
+type absentArtifact struct {
+	next time.Time
+	wait time.Duration
+}
+
+// absentBackoff is the wait before looking for an absent tag again after
+// having waited wait, doubled every time up to a day.
+func absentBackoff(wait time.Duration) time.Duration {
+	if wait == 0 {
+		return 10 * time.Minute
+	}
+	if wait *= 2; wait > 24*time.Hour {
+		return 24 * time.Hour
+	}
+	return wait
+}
+
+// keepArtifacts stores the artifacts of the image index of repo recorded as
+// index and of its platform images, and links them to index. The tags are
+// looked at when the recorded index changes, an index sharing platform
+// images with the previous one getting their artifacts linked, and the
+// stored ones downloaded again when their tag moved, e.g. after the image
+// was signed again. While the index stays the same, only the tags that were
+// absent are looked for again, backing off every time they are still absent.
+// Images keep being verifiable from the proxy once the upstream dropped them.
+func (c *client) keepArtifacts(ctx context.Context, repo, index string, i Index) {
+	if c.artifacts == nil {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "fetcher.KeepArtifacts")
+	defer span.End()
+	c.muArtifacts.Lock()
+	state := c.artifactStates[repo]
+	changed := state == nil || state.index != index
+	if changed {
+		state = &artifactState{index: index, absent: make(map[string]absentArtifact)}
+		c.artifactStates[repo] = state
+	}
+	c.muArtifacts.Unlock()
+
+	subjects := map[string]string{index: ""}
+	for _, m := range i.Manifests {
+		subjects[m.Digest] = ""
+		if m.Platform.Os != "" {
+			subjects[m.Digest] = m.Platform.Os + "/" + m.Platform.Architecture
+		}
+	}
+	now := c.now()
+	registry := c.registry.WithContext(ctx)
+	for subject, platform := range subjects {
+		for _, kind := range artifactKinds {
+			tag := strings.Replace(subject, ":", "-", 1) + "." + kind
+			absent, wasAbsent := state.absent[tag]
+			if !changed && (!wasAbsent || now.Before(absent.next)) {
+				continue
+			}
+			lookLater := func() {
+				wait := absentBackoff(absent.wait)
+				state.absent[tag] = absentArtifact{next: now.Add(wait), wait: wait}
+			}
+			stored, err := c.artifacts.FindArtifact(repo, tag)
+			if err != nil {
+				c.log.Errorf("find artifact %s:%s %v", repo, tag, err)
+				lookLater()
+				continue
+			}
+			if stored.Digest != "" {
+				current, err := registry.ArtifactDigest(repo, tag)
+				if err != nil {
+					c.log.Errorf("head artifact %s:%s %v", repo, tag, err)
+					lookLater()
+					continue
+				}
+				// Gone upstream, or unchanged: what is kept stays.
+				if current == "" || current == stored.Digest {
+					c.linkArtifact(repo, tag, index)
+					continue
+				}
+			}
+			a, err := registry.Artifact(repo, tag)
+			if err != nil {
+				c.log.Errorf("download artifact %s:%s %v", repo, tag, err)
+				lookLater()
+				continue
+			}
+			if a == nil {
+				lookLater()
+				continue
+			}
+			delete(state.absent, tag)
+			blobs := make([]model.ArtifactBlob, 0, len(a.Blobs))
+			for dgst, content := range a.Blobs {
+				blobs = append(blobs, model.ArtifactBlob{Repository: repo, Digest: dgst, Content: content})
+			}
+			err = c.artifacts.SaveArtifact(model.Artifact{
+				Repository: repo,
+				Tag:        tag,
+				Subject:    subject,
+				Platform:   platform,
+				Kind:       kind,
+				Digest:     a.Digest,
+				MediaType:  a.MediaType,
+				Manifest:   a.Manifest,
+			}, blobs)
+			if err != nil {
+				c.log.Errorf("save artifact %s:%s %v", repo, tag, err)
+				lookLater()
+				continue
+			}
+			c.linkArtifact(repo, tag, index)
+		}
+	}
+}
+
+func (c *client) linkArtifact(repo, tag, index string) {
+	if err := c.artifacts.LinkArtifact(repo, tag, index); err != nil {
+		c.log.Errorf("link artifact %s:%s %v", repo, tag, err)
+	}
+}
@@ -0,0 +1,125 @@
+package digestfetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/repository"
+	containerregistry "github.com/nduyphuong/reverse-registry/services/container-registry"
+	"github.com/sirupsen/logrus"
+	"github.com/test-go/testify/assert"
+)
+
+// fakeRegistry serves the artifacts it has by tag.
+type fakeRegistry struct {
+	containerregistry.Interface
+	artifacts map[string]*containerregistry.Artifact
+	downloads int
+	heads     int
+}
+
+func (r *fakeRegistry) WithContext(context.Context) containerregistry.Interface {
+	return r
+}
+
+func (r *fakeRegistry) Artifact(repo, tag string) (*containerregistry.Artifact, error) {
+	r.downloads++
+	return r.artifacts[repo+":"+tag], nil
+}
+
+func (r *fakeRegistry) ArtifactDigest(repo, tag string) (string, error) {
+	r.heads++
+	if a, ok := r.artifacts[repo+":"+tag]; ok {
+		return a.Digest, nil
+	}
+	return "", nil
+}
+
+func TestKeepArtifacts(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	artifacts := repository.NewArtifactStorage(db)
+	const (
+		repo     = "cgr.dev/chainguard/keep"
+		index    = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		platform = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	registry := &fakeRegistry{artifacts: map[string]*containerregistry.Artifact{
+		repo + ":sha256-1111111111111111111111111111111111111111111111111111111111111111.sig": {
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    "sha256:sig",
+			Manifest:  []byte(`{}`),
+			Blobs:     map[string][]byte{"sha256:payload": []byte("payload")},
+		},
+		repo + ":sha256-2222222222222222222222222222222222222222222222222222222222222222.att": {
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    "sha256:att",
+			Manifest:  []byte(`{}`),
+		},
+	}}
+	c := New(Options{Log: logrus.New(), Registry: registry, Artifacts: artifacts}).(*client)
+	i := Index{Manifests: []Manifest{{Digest: platform, Platform: Platform{Architecture: "amd64", Os: "linux"}}}}
+
+	c.keepArtifacts(context.Background(), repo, index, i)
+	assert.Equal(t, 6, registry.downloads)
+	kept, err := artifacts.ListArtifacts(index)
+	assert.NoError(t, err)
+	assert.Len(t, kept, 2)
+	assert.Equal(t, "sig", kept[0].Kind)
+	assert.Equal(t, "", kept[0].Platform)
+	assert.Equal(t, "att", kept[1].Kind)
+	assert.Equal(t, "linux/amd64", kept[1].Platform)
+	blob, err := artifacts.FindBlob(repo, "sha256:payload")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), blob.Content)
+
+	// While the index stays the same, nothing is looked at again but the
+	// absent tags, once their backoff is over.
+	c.keepArtifacts(context.Background(), repo, index, i)
+	assert.Equal(t, 6, registry.downloads)
+	assert.Equal(t, 0, registry.heads)
+	now := time.Now()
+	c.now = func() time.Time { return now.Add(11 * time.Minute) }
+	registry.artifacts[repo+":sha256-1111111111111111111111111111111111111111111111111111111111111111.sbom"] = &containerregistry.Artifact{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Digest:    "sha256:sbom",
+		Manifest:  []byte(`{}`),
+	}
+	c.keepArtifacts(context.Background(), repo, index, i)
+	assert.Equal(t, 10, registry.downloads)
+	assert.Equal(t, 0, registry.heads)
+	kept, err = artifacts.ListArtifacts(index)
+	assert.NoError(t, err)
+	assert.Len(t, kept, 3)
+	// Still absent, they wait twice as long.
+	c.now = func() time.Time { return now.Add(25 * time.Minute) }
+	c.keepArtifacts(context.Background(), repo, index, i)
+	assert.Equal(t, 10, registry.downloads)
+	c.now = func() time.Time { return now.Add(32 * time.Minute) }
+	c.keepArtifacts(context.Background(), repo, index, i)
+	assert.Equal(t, 13, registry.downloads)
+
+	// A new index sharing the platform image gets its artifacts linked,
+	// stored ones downloaded again when their tag moved, and the previous
+	// index keeps its own.
+	const next = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	registry.artifacts[repo+":sha256-2222222222222222222222222222222222222222222222222222222222222222.att"].Digest = "sha256:reattested"
+	c.keepArtifacts(context.Background(), repo, next, i)
+	assert.Equal(t, 1, registry.heads)
+	assert.Equal(t, 19, registry.downloads)
+	kept, err = artifacts.ListArtifacts(next)
+	assert.NoError(t, err)
+	if assert.Len(t, kept, 1) {
+		assert.Equal(t, "att", kept[0].Kind)
+		assert.Equal(t, "sha256:reattested", kept[0].Digest)
+	}
+	kept, err = artifacts.ListArtifacts(index)
+	assert.NoError(t, err)
+	if assert.Len(t, kept, 3) {
+		assert.Equal(t, "sbom", kept[0].Kind)
+		assert.Equal(t, "sig", kept[1].Kind)
+		assert.Equal(t, "att", kept[2].Kind)
+	}
+}
@@ -1,8 +1,10 @@
 package digestfetcher
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -10,8 +12,13 @@ import (
 	"github.com/nduyphuong/reverse-registry/config"
 	repository "github.com/nduyphuong/reverse-registry/repository"
 	containerregistry "github.com/nduyphuong/reverse-registry/services/container-registry"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/notifier"
+	"github.com/nduyphuong/reverse-registry/services/tracing"
 	"github.com/nduyphuong/reverse-registry/utils"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Interface interface {
@@ -23,6 +30,19 @@ type client struct {
 	log           *logrus.Logger
 	registry      containerregistry.Interface
 	fetchInterval time.Duration
+	notifier      notifier.Interface
+	refresh       repository.RefreshInterface
+	refreshPoll   time.Duration
+	artifacts     repository.ArtifactInterface
+	verify        bool
+	now           func() time.Time
+	// artifactStates holds by repository what keepArtifacts looked at.
+	artifactStates map[string]*artifactState
+	muArtifacts    sync.Mutex
+	// failing holds the images whose last fetch failed, so fetch failing
+	// is only published when an image starts failing.
+	failing   map[string]bool
+	muFailing sync.Mutex
 }
 
 type Options struct {
@@ -30,14 +50,41 @@ type Options struct {
 	Registry      containerregistry.Interface
 	Log           *logrus.Logger
 	FetchInterval time.Duration
+	Notifier      notifier.Interface
+	// Refresh is polled every RefreshPoll between cycles for images to
+	// fetch right away, it is optional.
+	Refresh     repository.RefreshInterface
+	RefreshPoll time.Duration
+	// Artifacts keeps the signatures, attestations and SBOMs of the
+	// recorded digests, it is optional.
+	Artifacts repository.ArtifactInterface
+	// VerifySignatures checks the signature of an index with the registry
+	// before recording its digest.
+	VerifySignatures bool
 }
 
 func New(opt Options) Interface {
+	n := opt.Notifier
+	if n == nil {
+		n = notifier.Noop{}
+	}
+	refreshPoll := opt.RefreshPoll
+	if refreshPoll <= 0 {
+		refreshPoll = time.Second
+	}
 	return &client{
-		storage:       opt.Storage,
-		registry:      opt.Registry,
-		log:           opt.Log,
-		fetchInterval: opt.FetchInterval,
+		storage:        opt.Storage,
+		registry:       opt.Registry,
+		log:            opt.Log,
+		fetchInterval:  opt.FetchInterval,
+		notifier:       n,
+		refresh:        opt.Refresh,
+		refreshPoll:    refreshPoll,
+		artifacts:      opt.Artifacts,
+		verify:         opt.VerifySignatures,
+		now:            time.Now,
+		failing:        make(map[string]bool),
+		artifactStates: make(map[string]*artifactState),
 	}
 }
 
@@ -57,51 +104,168 @@ type Platform struct {
 
 func (c *client) Fetch(images []config.Image) error {
 	for {
+		start := time.Now()
 		var wg sync.WaitGroup
 		for _, v := range images {
 			v := v
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				idx, err := c.registry.ManifestOrIndex(v.Name)
-				if err != nil {
-					c.log.Errorf("fetching manifest or index %v", err)
-				}
-				var i Index
-				json.Unmarshal(idx, &i)
-				c.log.Debugf("unmarshalled index: %s", i)
-				for _, k := range i.Manifests {
-					if k.Platform.Architecture == "amd64" {
-						c.log.Info("begin loop")
-
-						nameFromRepo := utils.SplitAndGetLast("/", v.Name)
-						mainPkgName, err := utils.SelectNotEmpty(nameFromRepo, v.MainPackage)
-						if err != nil {
-							c.log.Errorf("can not construct main package name %v", err)
-						}
-						tag, err := c.registry.VersionFromSbom(mainPkgName, v.Name)
-						if err != nil {
-							c.log.Errorf("version from sbom %v", err)
-							return
-						}
-
-						img := utils.MakeImageName(v.Name, tag)
-
-						digest := sha256.Sum256(idx)
-						if err != nil {
-							c.log.Errorf("hash index %v", err)
-						}
-						if err := c.storage.SaveDigest(img, "sha256:"+fmt.Sprintf("%x", digest)); err != nil {
-							c.log.Errorf("save digest to db %v", err)
-							break
-						}
-						c.log.Infof("saved to db %s %s", v.Name, tag)
-					}
-				}
+				c.fetchImage(v)
 			}()
 		}
 		wg.Wait()
+		metrics.FetcherCycleDuration.Observe(time.Since(start).Seconds())
 		c.log.Infof("sleep for %v", c.fetchInterval)
-		time.Sleep(c.fetchInterval)
+		c.sleep(images)
+	}
+}
+
+// sleep waits for the next fetch cycle, fetching the images a refresh was
+// requested for in the meantime.
+func (c *client) sleep(images []config.Image) {
+	next := time.NewTimer(c.fetchInterval)
+	defer next.Stop()
+	if c.refresh == nil {
+		<-next.C
+		return
+	}
+	poll := time.NewTicker(c.refreshPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-next.C:
+			return
+		case <-poll.C:
+			requests, err := c.refresh.ClaimPending(100)
+			if err != nil {
+				c.log.Errorf("claim refresh requests %v", err)
+				continue
+			}
+			for _, r := range requests {
+				for _, v := range images {
+					if v.Name == r.Image {
+						c.log.Infof("refresh requested for %s", v.Name)
+						c.fetchImage(v)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (c *client) fetchImage(v config.Image) {
+	ctx, span := tracing.Start(context.Background(), "fetcher.FetchImage", trace.WithAttributes(attribute.String("image", v.Name)))
+	defer span.End()
+	indexCtx, indexSpan := tracing.Start(ctx, "fetcher.IndexFetch")
+	idx, err := c.registry.WithContext(indexCtx).ManifestOrIndex(v.Name)
+	tracing.End(indexSpan, err)
+	if err != nil {
+		c.log.Errorf("fetching manifest or index %v", err)
+		c.fetchFailed(v.Name, err)
+		span.RecordError(err)
+		return
+	}
+	var i Index
+	json.Unmarshal(idx, &i)
+	c.log.Debugf("unmarshalled index: %s", i)
+	for _, k := range i.Manifests {
+		if k.Platform.Architecture == "amd64" {
+			c.log.Info("begin loop")
+
+			nameFromRepo := utils.SplitAndGetLast("/", v.Name)
+			mainPkgName, err := utils.SelectNotEmpty(nameFromRepo, v.MainPackage)
+			if err != nil {
+				c.log.Errorf("can not construct main package name %v", err)
+			}
+			tag, err := c.registry.WithContext(ctx).VersionFromSbom(mainPkgName, v.Name)
+			if err != nil {
+				span.RecordError(err)
+				c.log.Errorf("version from sbom %v", err)
+				if errors.Is(err, containerregistry.ErrAttestation) {
+					c.publish(notifier.AttestationFetchFailed, v.Name, notifier.ImageEvent{Image: v.Name, Error: err.Error()})
+				}
+				c.fetchFailed(v.Name, err)
+				return
+			}
+
+			img := utils.MakeImageName(v.Name, tag)
+
+			digest := sha256.Sum256(idx)
+			if err != nil {
+				c.log.Errorf("hash index %v", err)
+			}
+			hashedIndex := "sha256:" + fmt.Sprintf("%x", digest)
+			if err := c.verifySignature(ctx, v.Name, hashedIndex); err != nil {
+				span.RecordError(err)
+				c.log.Errorf("verify signature %v", err)
+				c.fetchFailed(v.Name, err)
+				return
+			}
+			saveCtx, saveSpan := tracing.Start(ctx, "fetcher.Save")
+			storage := c.storage.WithContext(saveCtx)
+			previous, err := storage.FindByNameTag(img)
+			if err != nil {
+				c.log.Errorf("find previous digest %v", err)
+			}
+			if _, err := storage.SaveDigest(img, hashedIndex); err != nil {
+				c.log.Errorf("save digest to db %v", err)
+				tracing.End(saveSpan, err)
+				break
+			}
+			saveSpan.End()
+			c.log.Infof("saved to db %s %s", v.Name, tag)
+			c.fetchSucceeded(v.Name)
+			c.keepArtifacts(ctx, v.Name, hashedIndex, i)
+			event := notifier.ImageEvent{Image: v.Name, Tag: tag, Digest: hashedIndex}
+			// previous is nil when the lookup failed, in which case
+			// we can not tell what changed.
+			if previous != nil && previous.HashedIndex == "" {
+				metrics.FetcherVersionChanges.WithLabelValues(v.Name, "added").Inc()
+				c.publish(notifier.VersionAdded, img, event)
+			} else if previous != nil && previous.HashedIndex != hashedIndex {
+				event.PreviousDigest = previous.HashedIndex
+				metrics.FetcherVersionChanges.WithLabelValues(v.Name, "moved").Inc()
+				c.publish(notifier.TagMoved, img, event)
+			}
+		}
+	}
+}
+
+// verifySignature checks the signature of the index digest of image, when
+// enabled, publishing SignatureVerificationFailed when it does not verify.
+func (c *client) verifySignature(ctx context.Context, image, digest string) error {
+	if !c.verify {
+		return nil
+	}
+	verifyCtx, span := tracing.Start(ctx, "fetcher.SignatureVerify")
+	err := c.registry.WithContext(verifyCtx).VerifySignature(image + "@" + digest)
+	tracing.End(span, err)
+	if errors.Is(err, containerregistry.ErrSignature) {
+		c.publish(notifier.SignatureVerificationFailed, image, notifier.ImageEvent{Image: image, Digest: digest, Error: err.Error()})
 	}
+	return err
+}
+
+func (c *client) publish(eventType, subject string, event notifier.ImageEvent) {
+	if err := c.notifier.Publish(eventType, subject, event); err != nil {
+		c.log.Errorf("publish %s %v", eventType, err)
+	}
+}
+
+func (c *client) fetchFailed(image string, err error) {
+	c.muFailing.Lock()
+	wasFailing := c.failing[image]
+	c.failing[image] = true
+	c.muFailing.Unlock()
+	if !wasFailing {
+		c.publish(notifier.FetchFailing, image, notifier.ImageEvent{Image: image, Error: err.Error()})
+	}
+}
+
+func (c *client) fetchSucceeded(image string) {
+	metrics.FetcherLastSuccess.WithLabelValues(image).SetToCurrentTime()
+	c.muFailing.Lock()
+	delete(c.failing, image)
+	c.muFailing.Unlock()
 }
@@ -1,11 +1,16 @@
 package digestfetcher
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/nduyphuong/reverse-registry/config"
 	"github.com/nduyphuong/reverse-registry/inject"
+	containerregistry "github.com/nduyphuong/reverse-registry/services/container-registry"
+	"github.com/nduyphuong/reverse-registry/services/notifier"
 	"github.com/sirupsen/logrus"
 	"github.com/test-go/testify/assert"
 )
@@ -34,7 +39,7 @@ func TestFetch(t *testing.T) {
 	assert.NoError(t, err)
 	storage, err := inject.GetStorage(conf)
 	assert.NoError(t, err)
-	registryClient, err := inject.GetContainerRegistryClient()
+	registryClient, err := inject.GetContainerRegistryClient(conf)
 	assert.NoError(t, err)
 	assert.NoError(t, err)
 	fetcher := New(Options{
@@ -45,3 +50,49 @@ func TestFetch(t *testing.T) {
 	})
 	fetcher.Fetch(conf.Images)
 }
+
+// signingRegistry fails the verification of the images it has no signature
+// for.
+type signingRegistry struct {
+	containerregistry.Interface
+	signed map[string]bool
+}
+
+func (r *signingRegistry) WithContext(context.Context) containerregistry.Interface {
+	return r
+}
+
+func (r *signingRegistry) VerifySignature(image string) error {
+	if !r.signed[image] {
+		return fmt.Errorf("%w: no matching signatures", containerregistry.ErrSignature)
+	}
+	return nil
+}
+
+type recordingNotifier struct {
+	notifier.Noop
+	events []string
+}
+
+func (n *recordingNotifier) Publish(eventType, subject string, data interface{}) error {
+	n.events = append(n.events, eventType+" "+subject)
+	return nil
+}
+
+func TestVerifySignature(t *testing.T) {
+	const (
+		image  = "cgr.dev/chainguard/nginx"
+		digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	)
+	registry := &signingRegistry{signed: map[string]bool{image + "@" + digest: true}}
+	n := &recordingNotifier{}
+	c := New(Options{Log: logrus.New(), Registry: registry, Notifier: n}).(*client)
+	assert.NoError(t, c.verifySignature(context.Background(), image, "sha256:other"))
+
+	c = New(Options{Log: logrus.New(), Registry: registry, Notifier: n, VerifySignatures: true}).(*client)
+	assert.NoError(t, c.verifySignature(context.Background(), image, digest))
+	assert.Empty(t, n.events)
+	err := c.verifySignature(context.Background(), image, "sha256:other")
+	assert.True(t, errors.Is(err, containerregistry.ErrSignature))
+	assert.Equal(t, []string{notifier.SignatureVerificationFailed + " " + image}, n.events)
+}
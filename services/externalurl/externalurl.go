@@ -0,0 +1,151 @@
+package externalurl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Interface interface {
+	// BaseURL returns the URL clients reach the proxy at, without a
+	// trailing slash, e.g. https://registry.example.com.
+	BaseURL(req *http.Request) string
+}
+
+type client struct {
+	publicURL string
+	trusted   []*net.IPNet
+}
+
+type Options struct {
+	// PublicURL is used as is when set.
+	PublicURL string
+	// TrustedProxies are the IPs and CIDRs whose Forwarded and
+	// X-Forwarded-Proto/Host headers are honored.
+	TrustedProxies []string
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{publicURL: strings.TrimSuffix(opt.PublicURL, "/")}
+	if c.publicURL != "" {
+		u, err := url.Parse(c.publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("public url %q must be an absolute http or https URL", opt.PublicURL)
+		}
+	}
+	for _, p := range opt.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", p, err)
+		}
+		c.trusted = append(c.trusted, cidr)
+	}
+	return c, nil
+}
+
+func (c *client) BaseURL(req *http.Request) string {
+	if c.publicURL != "" {
+		return c.publicURL
+	}
+	scheme, host := requestScheme(req), req.Host
+	if c.fromTrustedProxy(req) {
+		proto, fwdHost := forwarded(lastValue(req.Header.Values("Forwarded")))
+		if proto == "" && fwdHost == "" {
+			proto = lastValue(req.Header.Values("X-Forwarded-Proto"))
+			fwdHost = lastValue(req.Header.Values("X-Forwarded-Host"))
+		}
+		if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+func (c *client) fromTrustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range c.trusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded returns the proto and host of an element of a Forwarded header
+// (RFC 7239).
+func forwarded(element string) (proto, host string) {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "proto":
+			proto = value
+		case "host":
+			host = value
+		}
+	}
+	return proto, host
+}
+
+// lastValue returns the last element of a comma separated header, the one
+// appended by the trusted proxy in front of the api. Earlier ones come from
+// further away, possibly from the client itself.
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	header := values[len(values)-1]
+	return strings.TrimSpace(header[strings.LastIndex(header, ",")+1:])
+}
+
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+type baseURLKey struct{}
+
+// Middleware stores the base URL of each request in its context for From.
+func Middleware(i Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		base := i.BaseURL(ctx.Request)
+		ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), baseURLKey{}, base))
+		ctx.Next()
+	}
+}
+
+// From returns the base URL Middleware stored for req, or the scheme and
+// host req was received with.
+func From(req *http.Request) string {
+	if base, ok := req.Context().Value(baseURLKey{}).(string); ok {
+		return base
+	}
+	return requestScheme(req) + "://" + req.Host
+}
@@ -0,0 +1,55 @@
+package externalurl
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBaseURL(t *testing.T) {
+	proxied, err := New(Options{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}})
+	assert.NoError(t, err)
+	public, err := New(Options{PublicURL: "https://registry.example.com/", TrustedProxies: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name   string
+		c      Interface
+		remote string
+		tls    bool
+		header http.Header
+		want   string
+	}{
+		{"direct", proxied, "203.0.113.7:4000", false, nil, "http://registry.local"},
+		{"direct tls", proxied, "203.0.113.7:4000", true, nil, "https://registry.local"},
+		{"untrusted headers", proxied, "203.0.113.7:4000", false, http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"evil.example"}}, "http://registry.local"},
+		{"x-forwarded", proxied, "10.1.2.3:4000", false, http.Header{"X-Forwarded-Proto": {"http, https"}, "X-Forwarded-Host": {"registry.example.com"}}, "https://registry.example.com"},
+		{"forwarded", proxied, "192.168.1.1:4000", false, http.Header{"Forwarded": {`for=203.0.113.7`, `for=10.1.2.3;proto=https;host="registry.example.com:8443"`}}, "https://registry.example.com:8443"},
+		{"spoofed x-forwarded", proxied, "10.1.2.3:4000", false, http.Header{"X-Forwarded-Proto": {"http, https"}, "X-Forwarded-Host": {"evil.example, registry.example.com"}}, "https://registry.example.com"},
+		{"spoofed forwarded", proxied, "192.168.1.1:4000", false, http.Header{"Forwarded": {`for=203.0.113.7;proto=http;host=evil.example, for=10.1.2.3;proto=https;host=registry.example.com`}}, "https://registry.example.com"},
+		{"public url wins", public, "10.1.2.3:4000", false, http.Header{"X-Forwarded-Host": {"other.example"}}, "https://registry.example.com"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://registry.local/v2/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			assert.Equal(t, tc.want, tc.c.BaseURL(req))
+		})
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	_, err := New(Options{PublicURL: "registry.example.com"})
+	assert.ErrorContains(t, err, "absolute http or https URL")
+	_, err = New(Options{TrustedProxies: []string{"10.0.0.0/33"}})
+	assert.ErrorContains(t, err, "trusted proxy")
+}
@@ -0,0 +1,320 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream whose circuit is
+// open, without sending them.
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// Circuit states, as reported by the upstream_circuit_state metric.
+const (
+	closed = iota
+	open
+	halfOpen
+)
+
+type settings struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	maxAttempts           int
+	retryBackoff          time.Duration
+	failures              int
+	openFor               time.Duration
+}
+
+func parse(conf config.UpstreamClient) (settings, error) {
+	s := settings{maxAttempts: conf.MaxAttempts, failures: conf.Breaker.Failures}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = 3
+	}
+	if s.failures == 0 {
+		s.failures = 5
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		def   time.Duration
+		dst   *time.Duration
+	}{
+		{"dialTimeout", conf.DialTimeout, 10 * time.Second, &s.dialTimeout},
+		{"tlsHandshakeTimeout", conf.TLSHandshakeTimeout, 10 * time.Second, &s.tlsHandshakeTimeout},
+		{"responseHeaderTimeout", conf.ResponseHeaderTimeout, 30 * time.Second, &s.responseHeaderTimeout},
+		{"retryBackoff", conf.RetryBackoff, 200 * time.Millisecond, &s.retryBackoff},
+		{"breaker.openFor", conf.Breaker.OpenFor, 30 * time.Second, &s.openFor},
+	} {
+		*d.dst = d.def
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return settings{}, fmt.Errorf("upstreamClient.%s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	return s, nil
+}
+
+// NewTransport returns a copy of http.DefaultTransport with the timeouts of
+// conf.
+func NewTransport(conf config.UpstreamClient) (*http.Transport, error) {
+	s, err := parse(conf)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: s.dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = s.tlsHandshakeTimeout
+	t.ResponseHeaderTimeout = s.responseHeaderTimeout
+	return t, nil
+}
+
+type Options struct {
+	Config config.UpstreamClient
+	// Transport sends every attempt, defaults to NewTransport(Config).
+	Transport http.RoundTripper
+	Log       *logrus.Logger
+}
+
+type Interface interface {
+	http.RoundTripper
+	// Circuits returns the state of the circuit of every upstream requests
+	// were sent to: closed, open or half open.
+	Circuits() map[string]string
+}
+
+// New returns a transport that retries idempotent requests with backoff and
+// fails fast for upstreams whose circuit is open.
+func New(opt Options) (Interface, error) {
+	s, err := parse(opt.Config)
+	if err != nil {
+		return nil, err
+	}
+	next := opt.Transport
+	if next == nil {
+		if next, err = NewTransport(opt.Config); err != nil {
+			return nil, err
+		}
+	}
+	log := opt.Log
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+	c := &client{
+		next:     next,
+		settings: s,
+		log:      log,
+		now:      time.Now,
+		sleep:    sleep,
+		circuits: make(map[string]*circuit),
+	}
+	return c, nil
+}
+
+type client struct {
+	next http.RoundTripper
+	settings
+	log   *logrus.Logger
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func (c *client) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	for attempt := 1; ; attempt++ {
+		if err := c.allow(host); err != nil {
+			metrics.UpstreamCircuitRejections.WithLabelValues(host).Inc()
+			return nil, err
+		}
+		resp, err := c.next.RoundTrip(req)
+		failed := c.failed(req, resp, err)
+		c.record(host, failed, err != nil && !failed)
+		if err != nil && isTimeout(err) && req.Context().Err() == nil {
+			metrics.UpstreamTimeouts.WithLabelValues(host).Inc()
+		}
+		if !failed || attempt >= c.maxAttempts || !idempotent(req) {
+			return resp, err
+		}
+		wait := c.backoff(attempt)
+		reason := "status"
+		if err != nil {
+			reason = "error"
+			if isTimeout(err) {
+				reason = "timeout"
+			}
+		} else {
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+			// Let the connection be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		metrics.UpstreamRetries.WithLabelValues(host, reason).Inc()
+		c.log.WithFields(logrus.Fields{
+			"upstream": host,
+			"attempt":  attempt,
+			"reason":   reason,
+			"wait":     wait.String(),
+		}).Warn("retrying upstream request")
+		if err := c.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// failed reports whether an attempt counts as an upstream failure. Requests
+// the client gave up on do not.
+func (c *client) failed(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func idempotent(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// backoff doubles the wait for every attempt, with jitter so clients
+// retrying together spread out.
+func (c *client) backoff(attempt int) time.Duration {
+	d := c.retryBackoff << (attempt - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the Retry-After of resp in seconds, capped so a retry
+// does not hold the client longer than it would wait for a failure.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return min(time.Duration(secs)*time.Second, 10*time.Second)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow fails fast while the circuit of host is open. Once it was open for
+// openFor a single request is let through to probe the upstream.
+func (c *client) allow(host string) error {
+	if c.failures < 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cb := c.circuit(host)
+	switch cb.state {
+	case open:
+		if c.now().Sub(cb.openedAt) < c.openFor {
+			return fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+		}
+		c.setState(host, cb, halfOpen)
+		return nil
+	case halfOpen:
+		// The probe is in flight.
+		return fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+	return nil
+}
+
+// record updates the circuit of host with the outcome of a request. When
+// the client gave up on it nothing was learned about the upstream, a probe
+// is then left to the next request.
+func (c *client) record(host string, failed, abandoned bool) {
+	if c.failures < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cb := c.circuit(host)
+	if abandoned {
+		if cb.state == halfOpen {
+			c.setState(host, cb, open)
+		}
+		return
+	}
+	if !failed {
+		cb.failures = 0
+		if cb.state != closed {
+			c.setState(host, cb, closed)
+		}
+		return
+	}
+	cb.failures++
+	if cb.state == halfOpen || (cb.state == closed && cb.failures >= c.failures) {
+		cb.openedAt = c.now()
+		c.setState(host, cb, open)
+	}
+}
+
+func (c *client) circuit(host string) *circuit {
+	cb, ok := c.circuits[host]
+	if !ok {
+		cb = &circuit{}
+		c.circuits[host] = cb
+		metrics.UpstreamCircuitState.WithLabelValues(host).Set(closed)
+	}
+	return cb
+}
+
+var stateNames = map[int]string{closed: "closed", open: "open", halfOpen: "half open"}
+
+func (c *client) setState(host string, cb *circuit, state int) {
+	cb.state = state
+	metrics.UpstreamCircuitState.WithLabelValues(host).Set(float64(state))
+	c.log.WithField("upstream", host).Warnf("upstream circuit %s", stateNames[state])
+}
+
+func (c *client) Circuits() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]string, len(c.circuits))
+	for host, cb := range c.circuits {
+		states[host] = stateNames[cb.state]
+	}
+	return states
+}
@@ -0,0 +1,132 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubTransport struct {
+	statuses []int
+	errs     []error
+	calls    int
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := s.calls
+	s.calls++
+	if i < len(s.errs) && s.errs[i] != nil {
+		return nil, s.errs[i]
+	}
+	status := http.StatusOK
+	if i < len(s.statuses) {
+		status = s.statuses[i]
+	}
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func newClient(t *testing.T, conf config.UpstreamClient, next http.RoundTripper) *client {
+	rt, err := New(Options{Config: conf, Transport: next})
+	assert.NoError(t, err)
+	c := rt.(*client)
+	c.sleep = func(context.Context, time.Duration) error { return nil }
+	return c
+}
+
+func TestRetries(t *testing.T) {
+	reset := errors.New("connection reset by peer")
+	cases := []struct {
+		name       string
+		method     string
+		stub       *stubTransport
+		wantStatus int
+		wantErr    bool
+		wantCalls  int
+	}{
+		{"5xx then ok", http.MethodGet, &stubTransport{statuses: []int{503, 502}}, 200, false, 3},
+		{"reset then ok", http.MethodHead, &stubTransport{errs: []error{reset}}, 200, false, 2},
+		{"gives up", http.MethodGet, &stubTransport{statuses: []int{500, 500, 500, 500}}, 500, false, 3},
+		{"not found is final", http.MethodGet, &stubTransport{statuses: []int{404}}, 404, false, 1},
+		{"not idempotent", http.MethodPost, &stubTransport{statuses: []int{503}}, 503, false, 1},
+		{"error not idempotent", http.MethodPost, &stubTransport{errs: []error{reset}}, 0, true, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newClient(t, config.UpstreamClient{Breaker: config.CircuitBreaker{Failures: -1}}, tc.stub)
+			req, _ := http.NewRequest(tc.method, "https://cgr.dev/v2/", nil)
+			resp, err := c.RoundTrip(req)
+			assert.Equal(t, tc.wantCalls, tc.stub.calls)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	stub := &stubTransport{statuses: []int{503, 503, 503}}
+	c := newClient(t, config.UpstreamClient{MaxAttempts: 1, Breaker: config.CircuitBreaker{Failures: 3, OpenFor: "1m"}}, stub)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	get := func(host string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/v2/", nil)
+		return c.RoundTrip(req)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := get("cgr.dev")
+		assert.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+	}
+	// Open: requests fail fast without reaching the upstream.
+	_, err := get("cgr.dev")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 3, stub.calls)
+	// Other upstreams have their own circuit.
+	_, err = get("ghcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"cgr.dev": "open", "ghcr.io": "closed"}, c.Circuits())
+
+	// After openFor a probe goes through and closes the circuit.
+	now = now.Add(time.Minute)
+	resp, err := get("cgr.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = get("cgr.dev")
+	assert.NoError(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	conf := config.UpstreamClient{ResponseHeaderTimeout: "50ms", MaxAttempts: 2}
+	transport, err := NewTransport(conf)
+	assert.NoError(t, err)
+	c := newClient(t, conf, transport)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	_, err = c.RoundTrip(req)
+	assert.Error(t, err)
+	assert.True(t, isTimeout(err))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNewRejectsBadDurations(t *testing.T) {
+	_, err := New(Options{Config: config.UpstreamClient{DialTimeout: "soon"}})
+	assert.True(t, err != nil && strings.Contains(err.Error(), "upstreamClient.dialTimeout"))
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// Incoming request ids are reused when they look sane, so a caller can
+// correlate its own logs with ours.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9\-_.:]{1,128}$`)
+
+// New returns a logger with the configured level and format (text or json).
+func New(conf config.Logging) (*logrus.Logger, error) {
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	if conf.Level != "" {
+		level, err := logrus.ParseLevel(conf.Level)
+		if err != nil {
+			return nil, err
+		}
+		log.SetLevel(level)
+	}
+	if conf.Format == "json" {
+		log.SetFormatter(&logrus.JSONFormatter{})
+	}
+	return log, nil
+}
+
+// RequestID assigns every request an id, taken from the X-Request-Id header
+// when present, and echoes it in the response.
+func RequestID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		ctx.Header(RequestIDHeader, id)
+		ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), requestIDKey{}, id))
+		ctx.Next()
+	}
+}
+
+// RequestIDFrom returns the request id stored in ctx by RequestID.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns log with the request id and trace id of ctx, so every
+// line logged while serving a request can be correlated.
+func FromContext(ctx context.Context, log *logrus.Logger) *logrus.Entry {
+	fields := logrus.Fields{}
+	if id := RequestIDFrom(ctx); id != "" {
+		fields["request_id"] = id
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	return log.WithContext(ctx).WithFields(fields)
+}
+
+// AccessLog writes one JSON line per request once it is served.
+func AccessLog(policy *utils.RedactionPolicy) gin.HandlerFunc {
+	access := logrus.New()
+	access.SetOutput(os.Stdout)
+	access.SetFormatter(&logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"},
+	})
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		entry := FromContext(ctx.Request.Context(), access).WithFields(logrus.Fields{
+			"method":      ctx.Request.Method,
+			"url":         policy.URL(ctx.Request.URL),
+			"route":       ctx.FullPath(),
+			"status":      ctx.Writer.Status(),
+			"bytes":       ctx.Writer.Size(),
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":   ctx.ClientIP(),
+			"user_agent":  ctx.Request.UserAgent(),
+		})
+		if id, ok := auth.IdentityFrom(ctx.Request.Context()); ok {
+			entry = entry.WithField("user", id.Name)
+		}
+		if len(ctx.Errors) > 0 {
+			entry = entry.WithField("errors", ctx.Errors.String())
+		}
+		entry.Info("access")
+	}
+}
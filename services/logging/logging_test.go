@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID())
+	var seen string
+	router.GET("/v2/", func(ctx *gin.Context) {
+		seen = RequestIDFrom(ctx.Request.Context())
+	})
+
+	// A sane incoming id is kept.
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, "abc-123", resp.Header().Get(RequestIDHeader))
+
+	// Anything else is replaced.
+	req = httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.NotEqual(t, "bad id\n", seen)
+	assert.Len(t, seen, 36)
+	assert.Equal(t, seen, resp.Header().Get(RequestIDHeader))
+}
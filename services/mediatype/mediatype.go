@@ -0,0 +1,77 @@
+package mediatype
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Manifest media types.
+const (
+	OCIIndex           = "application/vnd.oci.image.index.v1+json"
+	OCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	DockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	DockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Accepts reports whether a client sending the Accept headers accept takes
+// mediaType. Clients sending none take anything.
+func Accepts(accept []string, mediaType string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, header := range accept {
+		for _, value := range strings.Split(header, ",") {
+			t, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+				continue
+			}
+			if t == mediaType || t == "*/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Counterpart returns the media type a manifest of mediaType converts to:
+// OCI indexes and Docker manifest lists describe the same thing.
+func Counterpart(mediaType string) (string, bool) {
+	switch mediaType {
+	case OCIIndex:
+		return DockerManifestList, true
+	case DockerManifestList:
+		return OCIIndex, true
+	}
+	return "", false
+}
+
+// Convert rewrites an OCI index into a Docker manifest list or the other
+// way around, changing the media type of the list only. Entries keep their
+// media types, as they keep their digests: the platform manifests they point
+// to are served unchanged, and must be described as what they are.
+func Convert(body []byte, to string) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	var from string
+	if raw, ok := m["mediaType"]; ok {
+		if err := json.Unmarshal(raw, &from); err != nil {
+			return nil, err
+		}
+	} else if to == DockerManifestList {
+		// The media type is optional in OCI indexes.
+		from = OCIIndex
+	}
+	if counterpart, ok := Counterpart(from); !ok || counterpart != to {
+		return nil, fmt.Errorf("can not convert %q to %q", from, to)
+	}
+	m["mediaType"], _ = json.Marshal(to)
+	return json.Marshal(m)
+}
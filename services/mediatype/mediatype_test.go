@@ -0,0 +1,74 @@
+package mediatype
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{OCIIndex}, true},
+		{[]string{DockerManifest + ", " + OCIIndex}, true},
+		{[]string{DockerManifest, OCIIndex + "; q=0.5"}, true},
+		{[]string{"*/*"}, true},
+		{[]string{DockerManifestList}, false},
+		{[]string{OCIIndex + ";q=0"}, false},
+		{[]string{"not a media type"}, false},
+	} {
+		assert.Equal(t, tc.want, Accepts(tc.accept, OCIIndex), "%v", tc.accept)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		to   string
+		want string
+	}{
+		{
+			"index to list",
+			`{"schemaVersion":2,"mediaType":"` + OCIIndex + `","manifests":[{"mediaType":"` + OCIManifest + `","digest":"sha256:abc","size":1}]}`,
+			DockerManifestList,
+			`{"manifests":[{"mediaType":"` + OCIManifest + `","digest":"sha256:abc","size":1}],"mediaType":"` + DockerManifestList + `","schemaVersion":2}`,
+		},
+		{
+			"entries are kept",
+			`{"schemaVersion":2,"mediaType":"` + DockerManifestList + `","manifests":[{"mediaType":"` + DockerManifest + `","digest":"sha256:abc","size":1},{"mediaType":"application/vnd.example+json","digest":"sha256:def","size":1}]}`,
+			OCIIndex,
+			`{"manifests":[{"mediaType":"` + DockerManifest + `","digest":"sha256:abc","size":1},{"mediaType":"application/vnd.example+json","digest":"sha256:def","size":1}],"mediaType":"` + OCIIndex + `","schemaVersion":2}`,
+		},
+		{
+			"index without media type",
+			`{"schemaVersion":2,"manifests":[]}`,
+			DockerManifestList,
+			`{"manifests":[],"mediaType":"` + DockerManifestList + `","schemaVersion":2}`,
+		},
+		{
+			"list to index",
+			`{"schemaVersion":2,"mediaType":"` + DockerManifestList + `","manifests":[]}`,
+			OCIIndex,
+			`{"manifests":[],"mediaType":"` + OCIIndex + `","schemaVersion":2}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Convert([]byte(tc.body), tc.to)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+
+	for _, body := range []string{
+		`{"schemaVersion":2,"mediaType":"` + DockerManifest + `"}`,
+		`{"schemaVersion":2,"mediaType":"` + DockerManifestList + `"}`,
+		`not json`,
+	} {
+		_, err := Convert([]byte(body), DockerManifestList)
+		assert.Error(t, err, body)
+	}
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "reverse_registry"
+
+// Where ProxyHandler answered a manifest request from.
+const (
+	LookupLocal    = "local"
+	LookupUpstream = "upstream"
+	// LookupOffline is counted on top of LookupUpstream when the upstream
+	// failed and the request was answered from local state.
+	LookupOffline = "offline"
+	// LookupArtifact is counted on top of LookupUpstream when the upstream
+	// no longer has a signature, attestation or SBOM kept locally.
+	LookupArtifact = "artifact"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests served, by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	ProxyLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_lookups_total",
+		Help:      "Proxied requests answered from the local database or passed through to upstream.",
+	}, []string{"result"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of the requests sent to upstream registries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream", "method", "status"})
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_errors_total",
+		Help:      "Requests to upstream registries that failed without a response.",
+	}, []string{"upstream"})
+
+	FetcherCycleDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fetcher_cycle_duration_seconds",
+		Help:      "Time taken to fetch every watched image once.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	FetcherLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fetcher_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful fetch of each image.",
+	}, []string{"image"})
+	FetcherVersionChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fetcher_version_changes_total",
+		Help:      "Versions recorded by the fetcher, by image and kind of change (added, moved).",
+	}, []string{"image", "change"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected with 429, by request class (manifest, blob).",
+	}, []string{"class"})
+	UpstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_in_flight_requests",
+		Help:      "Requests in flight to each upstream, responses count until their body is closed.",
+	}, []string{"upstream"})
+
+	UpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream requests retried, by upstream and reason (error, timeout, status).",
+	}, []string{"upstream", "reason"})
+	UpstreamTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_timeouts_total",
+		Help:      "Upstream requests that timed out dialing, in the TLS handshake or waiting for headers.",
+	}, []string{"upstream"})
+	UpstreamCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_circuit_state",
+		Help:      "State of the circuit breaker of each upstream: 0 closed, 1 open, 2 half open.",
+	}, []string{"upstream"})
+	UpstreamCircuitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_circuit_rejections_total",
+		Help:      "Upstream requests failed fast because the circuit of the upstream was open.",
+	}, []string{"upstream"})
+	UpstreamCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_coalesced_requests_total",
+		Help:      "Requests that waited for an identical upstream request in flight instead of sending their own, by kind (manifest, tags, blob).",
+	}, []string{"kind"})
+
+	BlobCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_cache_lookups_total",
+		Help:      "Blob requests looked up in the local blob cache, by result (hit, miss).",
+	}, []string{"result"})
+	ResponseCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_cache_lookups_total",
+		Help:      "Manifest by tag and tag list requests looked up in the response cache, by kind (manifest, tags) and result (hit, miss).",
+	}, []string{"kind", "result"})
+	ManifestConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "manifest_conversions_total",
+		Help:      "Manifests converted to the media type the client accepts, by source and target media type.",
+	}, []string{"from", "to"})
+	BlobDigestMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_digest_mismatches_total",
+		Help:      "Blobs streamed from upstream whose content did not match their digest.",
+	})
+
+	RepositoryCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "repository_cache_lookups_total",
+		Help:      "Repository lookups answered from memory or the database, by query and result (hit, miss).",
+	}, []string{"query", "result"})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of the repository queries.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"query"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the request count and latency of every request. Routes
+// are labelled with their pattern so path parameters do not blow up the
+// cardinality.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(ctx.Writer.Status())
+		httpRequests.WithLabelValues(route, ctx.Request.Method, status).Inc()
+		httpDuration.WithLabelValues(route, ctx.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveDBQuery records the latency of a repository query, it is meant to
+// be deferred at the top of the query: defer metrics.ObserveDBQuery("x", time.Now())
+func ObserveDBQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+// InstrumentRoundTripper records the latency and errors of the requests sent
+// through next, labelled by upstream host.
+func InstrumentRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		upstreamErrors.WithLabelValues(req.URL.Host).Inc()
+		return nil, err
+	}
+	upstreamDuration.WithLabelValues(req.URL.Host, req.Method, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	return resp, nil
+}
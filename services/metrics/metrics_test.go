@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/v2/:repo/*rest", func(ctx *gin.Context) {
+		ctx.Status(http.StatusTeapot)
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/nginx/manifests/latest", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	out := scrape(t)
+	assert.Contains(t, out, `reverse_registry_http_requests_total{method="GET",route="/v2/:repo/*rest",status="418"} 1`)
+	assert.Contains(t, out, `reverse_registry_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+}
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	transport := InstrumentRoundTripper(http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodHead, srv.URL, nil)
+	resp, err := transport.RoundTrip(req)
+	assert.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	down, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil)
+	_, err = transport.RoundTrip(down)
+	assert.Error(t, err)
+
+	out := scrape(t)
+	assert.Contains(t, out, `reverse_registry_upstream_request_duration_seconds_count{method="HEAD",status="307",upstream="`+req.URL.Host)
+	assert.Contains(t, out, `reverse_registry_upstream_request_errors_total{upstream="127.0.0.1:1"} 1`)
+}
@@ -0,0 +1,261 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types, used as the CloudEvents type attribute and in the endpoint
+// event filters.
+const (
+	VersionAdded = "dev.reverse-registry.version.added"
+	TagMoved     = "dev.reverse-registry.tag.moved"
+	FetchFailing = "dev.reverse-registry.fetch.failing"
+	// SignatureVerificationFailed is published when the cosign signature
+	// of an image index does not verify, its digest is then not recorded.
+	SignatureVerificationFailed = "dev.reverse-registry.signature.verification-failed"
+	// AttestationFetchFailed is published when the provenance attestation
+	// of an image can not be downloaded or decoded.
+	AttestationFetchFailed = "dev.reverse-registry.attestation.fetch-failed"
+)
+
+const (
+	SignatureHeader    = "X-Reverse-Registry-Signature"
+	cloudEventsSource  = "/reverse-registry/fetcher"
+	cloudEventsVersion = "1.0"
+)
+
+type Interface interface {
+	// Publish stores an event in the outbox for every endpoint subscribed to
+	// eventType. subject is the image the event is about.
+	Publish(eventType, subject string, data interface{}) error
+	// Run delivers outbox events until ctx is done.
+	Run(ctx context.Context) error
+}
+
+// ImageEvent is the data of the events published by the fetcher.
+type ImageEvent struct {
+	Image          string `json:"image"`
+	Tag            string `json:"tag,omitempty"`
+	Digest         string `json:"digest,omitempty"`
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+type client struct {
+	outbox       repository.OutboxInterface
+	endpoints    map[string]config.WebhookEndpoint
+	maxAttempts  int
+	pollInterval time.Duration
+	httpClient   *http.Client
+	log          *logrus.Logger
+	now          func() time.Time
+}
+
+type Options struct {
+	Outbox     repository.OutboxInterface
+	Config     config.Notifications
+	HTTPClient *http.Client
+	Log        *logrus.Logger
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		outbox:       opt.Outbox,
+		endpoints:    make(map[string]config.WebhookEndpoint),
+		maxAttempts:  opt.Config.MaxAttempts,
+		pollInterval: 5 * time.Second,
+		httpClient:   opt.HTTPClient,
+		log:          opt.Log,
+		now:          time.Now,
+	}
+	for _, e := range opt.Config.Endpoints {
+		if e.Name == "" || e.URL == "" {
+			return nil, fmt.Errorf("webhook endpoint needs a name and an url")
+		}
+		if _, ok := c.endpoints[e.Name]; ok {
+			return nil, fmt.Errorf("duplicate webhook endpoint %s", e.Name)
+		}
+		c.endpoints[e.Name] = e
+	}
+	if c.maxAttempts <= 0 {
+		c.maxAttempts = 10
+	}
+	if opt.Config.PollInterval != "" {
+		d, err := time.ParseDuration(opt.Config.PollInterval)
+		if err != nil {
+			return nil, err
+		}
+		c.pollInterval = d
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return c, nil
+}
+
+func (c *client) Publish(eventType, subject string, data interface{}) error {
+	if len(c.endpoints) == 0 {
+		return nil
+	}
+	now := c.now().UTC()
+	payload, err := json.Marshal(cloudEvent{
+		SpecVersion:     cloudEventsVersion,
+		ID:              uuid.NewString(),
+		Source:          cloudEventsSource,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            now,
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		return err
+	}
+	events := make([]model.OutboxEvent, 0, len(c.endpoints))
+	for name, e := range c.endpoints {
+		if !subscribed(e, eventType) {
+			continue
+		}
+		events = append(events, model.OutboxEvent{
+			Endpoint:      name,
+			Payload:       string(payload),
+			Type:          eventType,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+	return c.outbox.Enqueue(events)
+}
+
+func subscribed(e config.WebhookEndpoint, eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) Run(ctx context.Context) error {
+	if len(c.endpoints) == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.dispatch(ctx); err != nil {
+			c.log.Errorf("dispatch notifications %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch sends one batch of due events.
+func (c *client) dispatch(ctx context.Context) error {
+	events, err := c.outbox.ClaimDue(c.now(), 100, time.Minute)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		endpoint, ok := c.endpoints[e.Endpoint]
+		if !ok {
+			// The endpoint was removed from config, nobody will ever take it.
+			err = c.outbox.MarkFailed(e.ID, e.Attempts, c.now(), c.now(), true, "endpoint no longer configured")
+		} else if sendErr := c.send(ctx, endpoint, []byte(e.Payload)); sendErr != nil {
+			attempts := e.Attempts + 1
+			dead := attempts >= c.maxAttempts
+			c.log.WithFields(logrus.Fields{
+				"endpoint": e.Endpoint,
+				"type":     e.Type,
+				"attempts": attempts,
+				"dead":     dead,
+			}).Warnf("deliver notification %v", sendErr)
+			err = c.outbox.MarkFailed(e.ID, attempts, c.now(), c.now().Add(backoff(attempts)), dead, sendErr.Error())
+		} else {
+			err = c.outbox.MarkDelivered(e.ID, c.now())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) send(ctx context.Context, e config.WebhookEndpoint, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	if e.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(e.Secret, body))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body, receivers recompute it
+// with the shared secret and compare.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff doubles the delay from 2s up to one hour.
+func backoff(attempts int) time.Duration {
+	d := 2 * time.Second
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= time.Hour {
+			return time.Hour
+		}
+	}
+	return d
+}
+
+// Noop drops every event, for callers built without notifications.
+type Noop struct{}
+
+func (Noop) Publish(eventType, subject string, data interface{}) error { return nil }
+
+func (Noop) Run(ctx context.Context) error { return nil }
@@ -0,0 +1,114 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/driver"
+	"github.com/nduyphuong/reverse-registry/model"
+	"github.com/nduyphuong/reverse-registry/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishAndDispatch(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	db.Where("1 = 1").Delete(&model.OutboxEvent{})
+
+	var mu sync.Mutex
+	var received []cloudEvent
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, Sign("s3cret", body), r.Header.Get(SignatureHeader))
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var e cloudEvent
+		assert.NoError(t, json.Unmarshal(body, &e))
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	n, err := New(Options{
+		Outbox: repository.NewOutboxStorage(db),
+		Config: config.Notifications{Endpoints: []config.WebhookEndpoint{
+			{Name: "all", URL: srv.URL, Secret: "s3cret"},
+			{Name: "moves", URL: srv.URL, Secret: "s3cret", Events: []string{TagMoved}},
+		}},
+		Log: logrus.New(),
+	})
+	assert.NoError(t, err)
+	c := n.(*client)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	assert.NoError(t, n.Publish(VersionAdded, "cgr.dev/chainguard/nginx:1.25.1", ImageEvent{Image: "cgr.dev/chainguard/nginx", Tag: "1.25.1"}))
+
+	// The first delivery fails and is retried after the backoff.
+	assert.NoError(t, c.dispatch(context.Background()))
+	assert.Empty(t, received)
+	assert.NoError(t, c.dispatch(context.Background()))
+	assert.Empty(t, received)
+
+	now = now.Add(backoff(1))
+	assert.NoError(t, c.dispatch(context.Background()))
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, VersionAdded, received[0].Type)
+		assert.Equal(t, "1.0", received[0].SpecVersion)
+		assert.Equal(t, "cgr.dev/chainguard/nginx:1.25.1", received[0].Subject)
+	}
+
+	// Delivered events are not sent twice.
+	now = now.Add(time.Hour)
+	assert.NoError(t, c.dispatch(context.Background()))
+	assert.Len(t, received, 1)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, backoff(1))
+	assert.Equal(t, 8*time.Second, backoff(3))
+	assert.Equal(t, time.Hour, backoff(30))
+}
+
+func TestDeadEvent(t *testing.T) {
+	db, err := driver.NewSqliteDB()
+	assert.NoError(t, err)
+	db.Where("1 = 1").Delete(&model.OutboxEvent{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n, err := New(Options{
+		Outbox: repository.NewOutboxStorage(db),
+		Config: config.Notifications{MaxAttempts: 1, Endpoints: []config.WebhookEndpoint{{Name: "dead", URL: srv.URL}}},
+		Log:    logrus.New(),
+	})
+	assert.NoError(t, err)
+	c := n.(*client)
+	now := time.Now().Truncate(time.Second)
+	c.now = func() time.Time { return now }
+
+	assert.NoError(t, n.Publish(FetchFailing, "cgr.dev/chainguard/nginx", ImageEvent{Image: "cgr.dev/chainguard/nginx"}))
+	assert.NoError(t, c.dispatch(context.Background()))
+
+	// The event died when its last attempt failed, not at the next one.
+	var e model.OutboxEvent
+	assert.NoError(t, db.Where("endpoint = ?", "dead").First(&e).Error)
+	if assert.NotNil(t, e.DeadAt) {
+		assert.True(t, now.Equal(*e.DeadAt), "dead at %v, want %v", e.DeadAt, now)
+	}
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+)
+
+type concurrencyLimit struct {
+	next http.RoundTripper
+	max  int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// LimitConcurrency caps the requests in flight through next to max per
+// upstream host. A request holds its slot until its response body is
+// closed, so streamed blobs count for as long as they stream. Requests over
+// the cap wait for a slot until their context is done.
+func LimitConcurrency(next http.RoundTripper, max int) http.RoundTripper {
+	if max <= 0 {
+		return next
+	}
+	return &concurrencyLimit{next: next, max: max, slots: make(map[string]chan struct{})}
+}
+
+func (t *concurrencyLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	t.mu.Lock()
+	slots, ok := t.slots[host]
+	if !ok {
+		slots = make(chan struct{}, t.max)
+		t.slots[host] = slots
+	}
+	t.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	metrics.UpstreamInFlight.WithLabelValues(host).Inc()
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			metrics.UpstreamInFlight.WithLabelValues(host).Dec()
+			<-slots
+		})
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
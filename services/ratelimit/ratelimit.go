@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/nduyphuong/reverse-registry/services/metrics"
+	"github.com/nduyphuong/reverse-registry/services/registrypath"
+	"golang.org/x/time/rate"
+)
+
+// Request classes with their own budget.
+const (
+	Manifest = "manifest"
+	Blob     = "blob"
+)
+
+type Interface interface {
+	// Allow takes one request of class from the budget of the client key
+	// and subject. When the budget is spent it returns false and how long
+	// to wait before retrying.
+	Allow(key, subject, class string) (bool, time.Duration)
+}
+
+type budgets map[string]config.Budget
+
+type entry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type client struct {
+	defaults  budgets
+	overrides map[string]budgets
+	idle      time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[string]*entry
+	lastSweep time.Time
+}
+
+type Options struct {
+	Config config.RateLimit
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		defaults:  budgets{Manifest: opt.Config.Manifest, Blob: opt.Config.Blob},
+		overrides: make(map[string]budgets),
+		idle:      10 * time.Minute,
+		now:       time.Now,
+		limiters:  make(map[string]*entry),
+	}
+	for _, o := range opt.Config.Overrides {
+		if o.Subject == "" {
+			return nil, fmt.Errorf("rate limit override needs a subject")
+		}
+		b := budgets{Manifest: c.defaults[Manifest], Blob: c.defaults[Blob]}
+		if o.Manifest != (config.Budget{}) {
+			b[Manifest] = o.Manifest
+		}
+		if o.Blob != (config.Budget{}) {
+			b[Blob] = o.Blob
+		}
+		c.overrides[o.Subject] = b
+	}
+	return c, nil
+}
+
+func (c *client) Allow(key, subject, class string) (bool, time.Duration) {
+	b, ok := c.overrides[subject]
+	if !ok || subject == "" {
+		b = c.defaults
+	}
+	budget := b[class]
+	if budget.PerSecond <= 0 {
+		return true, 0
+	}
+	now := c.now()
+	limiter := c.limiter(key+" "+class, budget, now)
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Second
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		// Give the token back, the request is rejected rather than
+		// delayed.
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (c *client) limiter(key string, budget config.Budget, now time.Time) *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget the clients that went quiet so the map does not grow with
+	// every ip ever seen.
+	if now.Sub(c.lastSweep) > c.idle {
+		for k, e := range c.limiters {
+			if now.Sub(e.lastSeen) > c.idle {
+				delete(c.limiters, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	e, ok := c.limiters[key]
+	if !ok || e.limiter.Limit() != rate.Limit(budget.PerSecond) || e.limiter.Burst() != burst(budget) {
+		e = &entry{limiter: rate.NewLimiter(rate.Limit(budget.PerSecond), burst(budget))}
+		c.limiters[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+func burst(b config.Budget) int {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return int(math.Max(1, math.Ceil(b.PerSecond)))
+}
+
+// Middleware answers 429 with Retry-After to clients over their budget.
+// It runs after authentication so authenticated clients are limited by name
+// wherever they connect from.
+func Middleware(l Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		class := classify(ctx)
+		if class == "" {
+			ctx.Next()
+			return
+		}
+		key, subject := "ip:"+ctx.ClientIP(), ""
+		if id, ok := auth.IdentityFrom(ctx.Request.Context()); ok {
+			key, subject = "user:"+id.Name, id.Name
+		}
+		if ok, wait := l.Allow(key, subject, class); !ok {
+			metrics.RateLimited.WithLabelValues(class).Inc()
+			ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			auth.Error(ctx, http.StatusTooManyRequests, "TOOMANYREQUESTS", "too many requests", gin.H{"class": class})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// classify returns the budget a request is taken from, none for the ping.
+// Invalid paths are rejected cheaply but still count against the budget
+// they look like.
+func classify(ctx *gin.Context) string {
+	path := ctx.Request.URL.Path
+	if path == "/v2" || path == "/v2/" {
+		return ""
+	}
+	p, err := registrypath.Parse(path)
+	if (err == nil && p.Endpoint == registrypath.Blobs) || (err != nil && strings.Contains(path, "/blobs/")) {
+		return Blob
+	}
+	return Manifest
+}
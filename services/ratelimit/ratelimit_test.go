@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/services/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, err := New(Options{Config: config.RateLimit{
+		Manifest:  config.Budget{PerSecond: 1, Burst: 2},
+		Blob:      config.Budget{PerSecond: 1, Burst: 1},
+		Overrides: []config.RateLimitOverride{{Subject: "ci", Manifest: config.Budget{PerSecond: 100, Burst: 100}}},
+	}})
+	assert.NoError(t, err)
+	now := time.Now()
+	l.(*client).now = func() time.Time { return now }
+
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		if user := ctx.GetHeader("X-User"); user != "" {
+			ctx.Request = ctx.Request.WithContext(auth.WithIdentity(ctx.Request.Context(), auth.Identity{Name: user}))
+		}
+	}, Middleware(l))
+	router.GET("/v2/", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	router.GET("/v2/:repo/*rest", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Manifests and blobs have separate budgets.
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/manifests/latest", "").Code)
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/manifests/latest", "").Code)
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/blobs/sha256:abc", "").Code)
+	resp := get("/v2/nginx/manifests/latest", "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"errors":[{"code":"TOOMANYREQUESTS","message":"too many requests","detail":{"class":"manifest"}}]}`, resp.Body.String())
+	assert.Equal(t, http.StatusTooManyRequests, get("/v2/nginx/blobs/sha256:abc", "").Code)
+
+	// The ping is never limited.
+	assert.Equal(t, http.StatusOK, get("/v2/", "").Code)
+
+	// Authenticated clients have their own budget, overrides apply by name
+	// and only replace the budgets they set.
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/manifests/latest", "alice").Code)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, get("/v2/nginx/manifests/latest", "ci").Code)
+	}
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/blobs/sha256:abc", "ci").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("/v2/nginx/blobs/sha256:abc", "ci").Code)
+
+	// The budget refills over time.
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, get("/v2/nginx/manifests/latest", "").Code)
+}
+
+type blockingTransport struct {
+	started chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.started <- struct{}{}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("blob"))}, nil
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	next := &blockingTransport{started: make(chan struct{}, 10)}
+	rt := LimitConcurrency(next, 1)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://cgr.dev/v2/nginx/blobs/sha256:abc", nil)
+	first, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	<-next.started
+
+	// The slot is held until the body of the first response is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rt.RoundTrip(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Other upstreams are not affected.
+	other, _ := http.NewRequest(http.MethodGet, "https://ghcr.io/v2/", nil)
+	resp, err := rt.RoundTrip(other)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	<-next.started
+
+	assert.NoError(t, first.Body.Close())
+	resp, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
@@ -0,0 +1,116 @@
+package registrypath
+
+import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Endpoints of the distribution API under /v2/<name>.
+const (
+	Manifests = "manifests"
+	Blobs     = "blobs"
+	Tags      = "tags"
+	Referrers = "referrers"
+)
+
+// Distribution error codes of the paths Parse rejects.
+const (
+	CodeNameInvalid   = "NAME_INVALID"
+	CodeTagInvalid    = "TAG_INVALID"
+	CodeDigestInvalid = "DIGEST_INVALID"
+	CodeUnsupported   = "UNSUPPORTED"
+)
+
+var (
+	anchoredName = regexp.MustCompile(`^` + reference.NameRegexp.String() + `$`)
+	anchoredTag  = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+)
+
+// Path is a request to a repository of the distribution API.
+type Path struct {
+	// Repository name, e.g. team/nginx.
+	Repository string
+	// Endpoint is Manifests, Blobs, Tags or Referrers.
+	Endpoint string
+	// Reference is the tag or digest of a manifest, the digest of a blob
+	// or of the subject of referrers, and empty for tags.
+	Reference string
+}
+
+// Rest is the path after the repository, e.g. /manifests/latest.
+func (p Path) Rest() string {
+	if p.Endpoint == Tags {
+		return "/tags/list"
+	}
+	return "/" + p.Endpoint + "/" + p.Reference
+}
+
+// Digest returns the reference when it is a digest.
+func (p Path) Digest() (digest.Digest, bool) {
+	d, err := digest.Parse(p.Reference)
+	return d, err == nil
+}
+
+// Tag returns the reference of a manifest when it is a tag.
+func (p Path) Tag() (string, bool) {
+	if p.Endpoint != Manifests || !anchoredTag.MatchString(p.Reference) {
+		return "", false
+	}
+	return p.Reference, true
+}
+
+// Error is a path Parse rejects, with its distribution error code.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Parse parses a request path of the distribution API:
+//
+//	/v2/<name>/manifests/<reference>
+//	/v2/<name>/blobs/<digest>
+//	/v2/<name>/tags/list
+//	/v2/<name>/referrers/<digest>
+//
+// Names may have several components, e.g. team/nginx, and even components
+// named like endpoints, so the path is parsed from its end.
+func Parse(path string) (Path, error) {
+	segments := strings.Split(strings.TrimPrefix(path, "/v2/"), "/")
+	n := len(segments)
+	if !strings.HasPrefix(path, "/v2/") || n < 3 {
+		return Path{}, &Error{CodeUnsupported, "unsupported endpoint"}
+	}
+	p := Path{Repository: strings.Join(segments[:n-2], "/"), Endpoint: segments[n-2], Reference: segments[n-1]}
+	switch {
+	case p.Endpoint == Tags && p.Reference == "list":
+		p.Reference = ""
+	case p.Endpoint == Manifests, p.Endpoint == Blobs, p.Endpoint == Referrers:
+	default:
+		return Path{}, &Error{CodeUnsupported, "unsupported endpoint"}
+	}
+	if !anchoredName.MatchString(p.Repository) {
+		return Path{}, &Error{CodeNameInvalid, "invalid repository name"}
+	}
+	if p.Endpoint == Tags {
+		return p, nil
+	}
+	if _, ok := p.Digest(); ok {
+		return p, nil
+	}
+	if p.Endpoint == Manifests && !strings.Contains(p.Reference, ":") {
+		if anchoredTag.MatchString(p.Reference) {
+			return p, nil
+		}
+		return Path{}, &Error{CodeTagInvalid, "invalid tag"}
+	}
+	return Path{}, &Error{CodeDigestInvalid, "invalid digest"}
+}
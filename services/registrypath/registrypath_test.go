@@ -0,0 +1,78 @@
+package registrypath
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	sha := "sha256:" + strings.Repeat("a", 64)
+	cases := []struct {
+		path string
+		want Path
+		code string
+	}{
+		{"/v2/nginx/manifests/1.25", Path{"nginx", Manifests, "1.25"}, ""},
+		{"/v2/team/nginx/manifests/1.25", Path{"team/nginx", Manifests, "1.25"}, ""},
+		{"/v2/a/b/c/d/manifests/latest", Path{"a/b/c/d", Manifests, "latest"}, ""},
+		{"/v2/team/nginx/manifests/" + sha, Path{"team/nginx", Manifests, sha}, ""},
+		{"/v2/team/nginx/blobs/" + sha, Path{"team/nginx", Blobs, sha}, ""},
+		{"/v2/team/nginx/tags/list", Path{"team/nginx", Tags, ""}, ""},
+		{"/v2/team/nginx/referrers/" + sha, Path{"team/nginx", Referrers, sha}, ""},
+		// Components named like endpoints.
+		{"/v2/manifests/manifests/latest", Path{"manifests", Manifests, "latest"}, ""},
+		{"/v2/blobs/tags/list", Path{"blobs", Tags, ""}, ""},
+		{"/v2/tags/list/manifests/v1", Path{"tags/list", Manifests, "v1"}, ""},
+		// Separators of the name grammar.
+		{"/v2/my-org/my_app.v2/manifests/v1", Path{"my-org/my_app.v2", Manifests, "v1"}, ""},
+		{"/v2/a__b/c---d/manifests/v1", Path{"a__b/c---d", Manifests, "v1"}, ""},
+		{"/v2/localhost:5000/nginx/manifests/v1", Path{"localhost:5000/nginx", Manifests, "v1"}, ""},
+		// The first component may be a domain, the others are lowercase.
+		{"/v2/Team/nginx/manifests/v1", Path{"Team/nginx", Manifests, "v1"}, ""},
+		{"/v2/team/Nginx/manifests/v1", Path{}, CodeNameInvalid},
+		{"/v2/team//nginx/manifests/v1", Path{}, CodeNameInvalid},
+		{"/v2/-team/nginx/manifests/v1", Path{}, CodeNameInvalid},
+		{"/v2/team/nginx./manifests/v1", Path{}, CodeNameInvalid},
+		{"/v2/a...b/manifests/v1", Path{}, CodeNameInvalid},
+		{"/v2//manifests/v1", Path{}, CodeNameInvalid},
+		// References.
+		{"/v2/nginx/manifests/.hidden", Path{}, CodeTagInvalid},
+		{"/v2/nginx/manifests/" + strings.Repeat("a", 129), Path{}, CodeTagInvalid},
+		{"/v2/nginx/manifests/sha256:abc", Path{}, CodeDigestInvalid},
+		{"/v2/nginx/blobs/latest", Path{}, CodeDigestInvalid},
+		{"/v2/nginx/referrers/latest", Path{}, CodeDigestInvalid},
+		// Not a request to a repository.
+		{"/v2/", Path{}, CodeUnsupported},
+		{"/v2/nginx/tags/all", Path{}, CodeUnsupported},
+		{"/v2/nginx/blobs/uploads/", Path{}, CodeUnsupported},
+		{"/v2/_catalog", Path{}, CodeUnsupported},
+		{"/v1/nginx/manifests/v1", Path{}, CodeUnsupported},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			got, err := Parse(tc.path)
+			if tc.code != "" {
+				var perr *Error
+				if assert.ErrorAs(t, err, &perr) {
+					assert.Equal(t, tc.code, perr.Code)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.path, "/v2/"+got.Repository+got.Rest())
+		})
+	}
+}
+
+func TestTag(t *testing.T) {
+	tag, ok := Path{"nginx", Manifests, "1.25"}.Tag()
+	assert.True(t, ok)
+	assert.Equal(t, "1.25", tag)
+	_, ok = Path{"nginx", Manifests, "sha256:" + strings.Repeat("a", 64)}.Tag()
+	assert.False(t, ok)
+	_, ok = Path{"nginx", Blobs, "sha256:" + strings.Repeat("a", 64)}.Tag()
+	assert.False(t, ok)
+}
@@ -0,0 +1,158 @@
+package responsecache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+)
+
+// Kinds of responses, each with its own TTL.
+const (
+	Manifest = "manifest"
+	Tags     = "tags"
+)
+
+type Interface interface {
+	// Get returns the live entry stored under key.
+	Get(key string) (Entry, bool)
+	// Set stores e under key for the TTL of its kind and status. Responses
+	// whose TTL is 0 are not stored.
+	Set(key string, e Entry)
+}
+
+// Entry is an upstream response to a manifest or tag list request.
+type Entry struct {
+	Kind        string
+	Status      int
+	ContentType string
+	Digest      string
+	// Link is the pagination header of tag lists.
+	Link string
+	Body []byte
+}
+
+// Response returns a response for e as if it came from upstream.
+func (e Entry) Response() *http.Response {
+	header := http.Header{}
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	for k, v := range map[string]string{"Content-Type": e.ContentType, "Docker-Content-Digest": e.Digest, "Link": e.Link} {
+		if v != "" {
+			header.Set(k, v)
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+	}
+}
+
+type item struct {
+	key     string
+	entry   Entry
+	expires time.Time
+}
+
+type client struct {
+	ttls     map[string]time.Duration
+	notFound time.Duration
+	maxSize  int64
+	now      func() time.Time
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type Options struct {
+	Config config.ResponseCache
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		maxSize: opt.Config.MaxSize,
+		now:     time.Now,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	var manifest, tags time.Duration
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"manifestTTL", opt.Config.ManifestTTL, &manifest},
+		{"tagsTTL", opt.Config.TagsTTL, &tags},
+		{"notFoundTTL", opt.Config.NotFoundTTL, &c.notFound},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("responseCache.%s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	c.ttls = map[string]time.Duration{Manifest: manifest, Tags: tags}
+	return c, nil
+}
+
+func (c *client) ttl(e Entry) time.Duration {
+	switch {
+	case e.Status == http.StatusNotFound:
+		return c.notFound
+	case e.Status == http.StatusOK:
+		return c.ttls[e.Kind]
+	}
+	return 0
+}
+
+func (c *client) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	it := el.Value.(*item)
+	if !c.now().Before(it.expires) {
+		c.remove(el)
+		return Entry{}, false
+	}
+	c.lru.MoveToFront(el)
+	return it.entry, true
+}
+
+func (c *client) Set(key string, e Entry) {
+	ttl := c.ttl(e)
+	if ttl <= 0 || (c.maxSize > 0 && int64(len(e.Body)) > c.maxSize) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&item{key: key, entry: e, expires: c.now().Add(ttl)})
+	c.size += int64(len(e.Body))
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *client) remove(el *list.Element) {
+	it := c.lru.Remove(el).(*item)
+	delete(c.items, it.key)
+	c.size -= int64(len(it.entry.Body))
+}
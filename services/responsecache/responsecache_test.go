@@ -0,0 +1,82 @@
+package responsecache
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCache(t *testing.T, conf config.ResponseCache) (*client, *time.Time) {
+	i, err := New(Options{Config: conf})
+	assert.NoError(t, err)
+	c := i.(*client)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestTTLs(t *testing.T) {
+	c, now := newCache(t, config.ResponseCache{ManifestTTL: "30s", TagsTTL: "10s", NotFoundTTL: "5s"})
+	c.Set("manifest", Entry{Kind: Manifest, Status: http.StatusOK, Body: []byte("{}")})
+	c.Set("tags", Entry{Kind: Tags, Status: http.StatusOK, Body: []byte("{}")})
+	c.Set("missing", Entry{Kind: Manifest, Status: http.StatusNotFound})
+	c.Set("error", Entry{Kind: Manifest, Status: http.StatusUnauthorized})
+
+	for key, live := range map[string]bool{"manifest": true, "tags": true, "missing": true, "error": false} {
+		_, ok := c.Get(key)
+		assert.Equal(t, live, ok, key)
+	}
+	*now = now.Add(6 * time.Second)
+	_, ok := c.Get("missing")
+	assert.False(t, ok)
+	*now = now.Add(5 * time.Second)
+	_, ok = c.Get("tags")
+	assert.False(t, ok)
+	_, ok = c.Get("manifest")
+	assert.True(t, ok)
+}
+
+func TestDisabledKind(t *testing.T) {
+	c, _ := newCache(t, config.ResponseCache{TagsTTL: "10s"})
+	c.Set("manifest", Entry{Kind: Manifest, Status: http.StatusOK})
+	c.Set("missing", Entry{Kind: Tags, Status: http.StatusNotFound})
+	assert.Empty(t, c.items)
+}
+
+func TestMaxSize(t *testing.T) {
+	c, _ := newCache(t, config.ResponseCache{ManifestTTL: "1m", MaxSize: 10})
+	c.Set("a", Entry{Kind: Manifest, Status: http.StatusOK, Body: []byte("aaaa")})
+	c.Set("b", Entry{Kind: Manifest, Status: http.StatusOK, Body: []byte("bbbb")})
+	// a is used, so b is the one evicted.
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	c.Set("c", Entry{Kind: Manifest, Status: http.StatusOK, Body: []byte("cccc")})
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), c.size)
+
+	c.Set("huge", Entry{Kind: Manifest, Status: http.StatusOK, Body: make([]byte, 11)})
+	_, ok = c.Get("huge")
+	assert.False(t, ok)
+}
+
+func TestEntryResponse(t *testing.T) {
+	resp := Entry{Status: http.StatusOK, ContentType: "application/json", Digest: "sha256:abc", Body: []byte("{}")}.Response()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "sha256:abc", resp.Header.Get("Docker-Content-Digest"))
+	assert.Empty(t, resp.Header.Values("Link"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "{}", string(body))
+}
+
+func TestBadTTL(t *testing.T) {
+	_, err := New(Options{Config: config.ResponseCache{NotFoundTTL: "a while"}})
+	assert.ErrorContains(t, err, "responseCache.notFoundTTL")
+}
@@ -0,0 +1,162 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Client certificate policies.
+const (
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+type Interface interface {
+	// Config returns the server tls.Config. Every handshake picks up the
+	// certificate and CA files as they are on disk.
+	Config() *tls.Config
+}
+
+type client struct {
+	conf  config.TLS
+	log   *logrus.Logger
+	check time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	checked   time.Time
+	modTimes  [3]time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+type Options struct {
+	Config config.TLS
+	Log    *logrus.Logger
+}
+
+// New loads the certificate of opt.Config, so a broken configuration fails
+// at start rather than on the first handshake.
+func New(opt Options) (Interface, error) {
+	if opt.Config.CertFile == "" || opt.Config.KeyFile == "" {
+		return nil, fmt.Errorf("tls needs certFile and keyFile")
+	}
+	switch opt.Config.ClientAuth {
+	case "", ClientAuthOptional, ClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("unknown tls clientAuth %q, use optional or require", opt.Config.ClientAuth)
+	}
+	if opt.Config.ClientAuth != "" && opt.Config.ClientCAFile == "" {
+		return nil, fmt.Errorf("tls clientAuth needs clientCAFile")
+	}
+	c := &client{conf: opt.Config, log: opt.Log, check: 10 * time.Second, now: time.Now}
+	if c.log == nil {
+		c.log = logrus.StandardLogger()
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	c.checked = c.now()
+	return c, nil
+}
+
+func (c *client) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := c.current()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if clientCAs != nil {
+				conf.ClientCAs = clientCAs
+				conf.ClientAuth = tls.VerifyClientCertIfGiven
+				if c.conf.ClientAuth == ClientAuthRequire {
+					conf.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return conf, nil
+		},
+	}
+}
+
+// current returns the loaded files, reloading them when they changed. A
+// failed reload keeps serving the previous ones.
+func (c *client) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); now.Sub(c.checked) >= c.check {
+		c.checked = now
+		if c.changed() {
+			if err := c.reload(); err != nil {
+				c.log.Errorf("reload tls files %v", err)
+			} else {
+				c.log.Infof("reloaded tls certificate %s", c.conf.CertFile)
+			}
+		}
+	}
+	return c.cert, c.clientCAs
+}
+
+func (c *client) files() [3]string {
+	return [3]string{c.conf.CertFile, c.conf.KeyFile, c.conf.ClientCAFile}
+}
+
+func (c *client) changed() bool {
+	for i, f := range c.files() {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			// Mid rotation, try again at the next check.
+			return false
+		}
+		if !info.ModTime().Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads all files, the mod times are taken first so a write during
+// the reload is picked up by the next check.
+func (c *client) reload() error {
+	var modTimes [3]time.Time
+	for i, f := range c.files() {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(c.conf.CertFile, c.conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if c.conf.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.conf.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s has no PEM certificates", c.conf.ClientCAFile)
+		}
+	}
+	c.cert, c.clientCAs, c.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
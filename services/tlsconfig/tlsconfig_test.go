@@ -0,0 +1,145 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	der  []byte
+}
+
+// issue creates a certificate for name signed by parent, self signed when
+// parent is nil.
+func issue(t *testing.T, name string, parent *keyPair) keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerCert := key, tmpl
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return keyPair{cert: cert, key: key, der: der, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (k keyPair) write(t *testing.T, dir string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(k.key)
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	assert.NoError(t, os.WriteFile(certFile, k.pem, 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	first := issue(t, "registry.local", nil)
+	certFile, keyFile := first.write(t, dir)
+	c, err := New(Options{Config: config.TLS{CertFile: certFile, KeyFile: keyFile}})
+	assert.NoError(t, err)
+	now := time.Now()
+	c.(*client).now = func() time.Time { return now }
+
+	served := func() []byte {
+		conf, err := c.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+		assert.NoError(t, err)
+		return conf.Certificates[0].Certificate[0]
+	}
+	assert.Equal(t, first.der, served())
+
+	second := issue(t, "registry.local", nil)
+	second.write(t, dir)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	// Files are checked at most every 10 seconds.
+	assert.Equal(t, first.der, served())
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, second.der, served())
+
+	// A broken file keeps the last good certificate.
+	assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	broken := later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(keyFile, broken, broken))
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, second.der, served())
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "clients", nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	serverCert := issue(t, "registry.local", nil)
+	certFile, keyFile := serverCert.write(t, dir)
+	c, err := New(Options{Config: config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: ClientAuthRequire}})
+	assert.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	server.TLS = c.Config()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "registry.local",
+			Certificates: certs,
+		}}}
+	}
+
+	_, err = newClient().Get(server.URL)
+	assert.Error(t, err)
+
+	builder := issue(t, "builder", &ca)
+	resp, err := newClient(tls.Certificate{Certificate: [][]byte{builder.der}, PrivateKey: builder.key}).Get(server.URL)
+	assert.NoError(t, err)
+	if err == nil {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	_, err := New(Options{Config: config.TLS{CertFile: "tls.crt"}})
+	assert.ErrorContains(t, err, "needs certFile and keyFile")
+	_, err = New(Options{Config: config.TLS{CertFile: "tls.crt", KeyFile: "tls.key", ClientAuth: "always"}})
+	assert.ErrorContains(t, err, "unknown tls clientAuth")
+}
@@ -0,0 +1,184 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/nduyphuong/reverse-registry/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/nduyphuong/reverse-registry"
+
+var (
+	muSetup  sync.Mutex
+	shutdown func(context.Context) error
+)
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. It is safe to call once per role, the provider of the first
+// call is kept. Without an exporter the default no-op provider stays in place.
+func Setup(conf config.Tracing) (func(context.Context) error, error) {
+	muSetup.Lock()
+	defer muSetup.Unlock()
+	if shutdown != nil {
+		return shutdown, nil
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	var exporter sdktrace.SpanExporter
+	switch conf.Exporter {
+	case "":
+		shutdown = func(context.Context) error { return nil }
+		return shutdown, nil
+	case "stdout":
+		e, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	case "otlp":
+		e, err := newOTLPExporter(context.Background(), conf)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", conf.Exporter)
+	}
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = "reverse-registry"
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(5*time.Second)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	shutdown = tp.Shutdown
+	return shutdown, nil
+}
+
+// newOTLPExporter returns an exporter to the OTLP collector of conf, over
+// HTTP with protobuf encoding or over gRPC.
+func newOTLPExporter(ctx context.Context, conf config.Tracing) (sdktrace.SpanExporter, error) {
+	switch conf.Protocol {
+	case "", "http/protobuf":
+		endpoint := conf.Endpoint
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint), otlptracehttp.WithHeaders(conf.Headers))
+	case "grpc":
+		endpoint := conf.Endpoint
+		if endpoint == "" {
+			endpoint = "http://localhost:4317"
+		}
+		return otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint), otlptracegrpc.WithHeaders(conf.Headers))
+	}
+	return nil, fmt.Errorf("unknown tracing protocol %q", conf.Protocol)
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of the caller when it sent a traceparent header.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		parent := otel.GetTextMapPropagator().Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		spanCtx, span := Start(parent, ctx.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(ctx.Request.URL.Path),
+			),
+		)
+		defer span.End()
+		ctx.Request = ctx.Request.WithContext(spanCtx)
+		ctx.Next()
+		status := ctx.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// redaction masks the credentials of the URLs recorded on spans, such as
+// the signatures of presigned blob URLs.
+var redaction = utils.NewRedactionPolicy(nil)
+
+type transport struct {
+	next http.RoundTripper
+}
+
+// Transport starts a client span for every request sent through next and
+// propagates the trace context to upstream.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Host),
+			attribute.String("url.full", redaction.URL(req.URL)),
+		),
+	)
+	defer span.End()
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTransportPropagatesAndExports(t *testing.T) {
+	var exported coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, proto.Unmarshal(body, &exported))
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	exporter, err := newOTLPExporter(context.Background(), config.Tracing{Endpoint: collector.URL, Headers: map[string]string{"X-Api-Key": "secret"}})
+	assert.NoError(t, err)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer tp.Shutdown(context.Background())
+
+	ctx, parent := Start(context.Background(), "parent")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL+"/v2/?X-Amz-Signature=secret&sig=secret", nil)
+	resp, err := Transport(http.DefaultTransport).RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	traceID := parent.SpanContext().TraceID().String()
+	assert.Contains(t, traceparent, traceID)
+
+	// The client span is exported on end with its parent and error status.
+	if assert.Len(t, exported.ResourceSpans, 1) && assert.Len(t, exported.ResourceSpans[0].ScopeSpans, 1) {
+		spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, "upstream GET", spans[0].Name)
+			assert.Equal(t, traceID, hex.EncodeToString(spans[0].TraceId))
+			assert.Equal(t, parent.SpanContext().SpanID().String(), hex.EncodeToString(spans[0].ParentSpanId))
+			assert.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, spans[0].Kind)
+			assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, spans[0].Status.Code)
+			for _, a := range spans[0].Attributes {
+				if a.Key == "url.full" {
+					assert.Equal(t, upstream.URL+"/v2/?X-Amz-Signature=REDACTED&sig=REDACTED", a.Value.GetStringValue())
+				}
+			}
+		}
+	}
+	parent.End()
+}
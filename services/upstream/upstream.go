@@ -0,0 +1,263 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/nduyphuong/reverse-registry/config"
+)
+
+type Interface interface {
+	// Keychain resolves the configured credentials of an upstream, and the
+	// docker config for the registries that have none.
+	Keychain() authn.Keychain
+	// Configured reports whether credentials are configured for registry.
+	Configured(registry string) bool
+	// FollowRedirects reports whether blob redirects of registry are
+	// followed by the proxy rather than handed to clients.
+	FollowRedirects(registry string) bool
+	// Transport returns a transport authenticated for scopes on repo. The
+	// upstream token is reused until it expires.
+	Transport(ctx context.Context, repo name.Repository, scopes ...string) (http.RoundTripper, error)
+}
+
+type client struct {
+	upstreams map[string]config.Upstream
+	transport http.RoundTripper
+	now       func() time.Time
+
+	mu         sync.Mutex
+	challenges map[string]*transport.Challenge
+	tokens     map[string]cachedToken
+}
+
+type cachedToken struct {
+	transport http.RoundTripper
+	expires   time.Time
+}
+
+type Options struct {
+	Upstreams []config.Upstream
+	// Transport used to reach the upstreams, defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+func New(opt Options) (Interface, error) {
+	c := &client{
+		upstreams:  make(map[string]config.Upstream),
+		transport:  opt.Transport,
+		now:        time.Now,
+		challenges: make(map[string]*transport.Challenge),
+		tokens:     make(map[string]cachedToken),
+	}
+	if c.transport == nil {
+		c.transport = http.DefaultTransport
+	}
+	for _, u := range opt.Upstreams {
+		if u.Registry == "" {
+			return nil, fmt.Errorf("upstream needs a registry")
+		}
+		if credentials(u) > 1 {
+			return nil, fmt.Errorf("upstream %s needs at most one of username/password, identityTokenFile or credentialHelper", u.Registry)
+		}
+		reg, err := name.NewRegistry(u.Registry)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.upstreams[reg.RegistryStr()]; ok {
+			return nil, fmt.Errorf("duplicate upstream %s", u.Registry)
+		}
+		c.upstreams[reg.RegistryStr()] = u
+	}
+	return c, nil
+}
+
+func (c *client) Keychain() authn.Keychain {
+	return authn.NewMultiKeychain(configuredKeychain{c.upstreams}, authn.DefaultKeychain)
+}
+
+func (c *client) Configured(registry string) bool {
+	u, ok := c.lookup(registry)
+	return ok && credentials(u) > 0
+}
+
+func (c *client) FollowRedirects(registry string) bool {
+	u, ok := c.lookup(registry)
+	return ok && u.FollowRedirects
+}
+
+func (c *client) lookup(registry string) (config.Upstream, bool) {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return config.Upstream{}, false
+	}
+	u, ok := c.upstreams[reg.RegistryStr()]
+	return u, ok
+}
+
+// credentials counts the kinds of credentials configured for u.
+func credentials(u config.Upstream) int {
+	set := 0
+	for _, v := range []bool{u.Username != "" || u.Password != "", u.IdentityTokenFile != "", u.CredentialHelper != ""} {
+		if v {
+			set++
+		}
+	}
+	return set
+}
+
+func (c *client) Transport(ctx context.Context, repo name.Repository, scopes ...string) (http.RoundTripper, error) {
+	key := repo.RegistryStr() + " " + strings.Join(scopes, " ")
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		return cached.transport, nil
+	}
+
+	auth, err := c.Keychain().Resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := c.challenge(ctx, repo.Registry)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(challenge.Scheme, "bearer") {
+		// Anonymous or basic auth, there is no token to cache.
+		return transport.FromToken(repo.Registry, auth, c.transport, challenge, &transport.Token{})
+	}
+	token, err := transport.Exchange(ctx, repo.Registry, auth, c.transport, scopes, challenge)
+	if err != nil {
+		return nil, err
+	}
+	t, err := transport.FromToken(repo.Registry, auth, c.transport, challenge, token)
+	if err != nil {
+		return nil, err
+	}
+	// Registries that do not say default to 60 seconds, see the token
+	// spec. Tokens are dropped a little early so they do not expire in
+	// flight.
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = 60 * time.Second
+	}
+	t = &invalidating{inner: t, invalidate: func() { c.forget(key) }}
+	c.mu.Lock()
+	c.tokens[key] = cachedToken{transport: t, expires: c.now().Add(lifetime * 9 / 10)}
+	c.mu.Unlock()
+	return t, nil
+}
+
+// challenge pings the registry once and remembers how it wants clients to
+// authenticate.
+func (c *client) challenge(ctx context.Context, reg name.Registry) (*transport.Challenge, error) {
+	c.mu.Lock()
+	challenge, ok := c.challenges[reg.RegistryStr()]
+	c.mu.Unlock()
+	if ok {
+		return challenge, nil
+	}
+	challenge, err := transport.Ping(ctx, reg, c.transport)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.challenges[reg.RegistryStr()] = challenge
+	c.mu.Unlock()
+	return challenge, nil
+}
+
+func (c *client) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+}
+
+// invalidating drops a cached token the upstream no longer accepts, e.g.
+// because it was revoked before its expiry.
+type invalidating struct {
+	inner      http.RoundTripper
+	invalidate func()
+}
+
+func (t *invalidating) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.invalidate()
+	}
+	return resp, err
+}
+
+// configuredKeychain resolves the credentials of the configured upstreams,
+// and anonymous for the others so the next keychain is tried.
+type configuredKeychain struct {
+	upstreams map[string]config.Upstream
+}
+
+func (k configuredKeychain) Resolve(r authn.Resource) (authn.Authenticator, error) {
+	u, ok := k.upstreams[r.RegistryStr()]
+	if !ok || credentials(u) == 0 {
+		return authn.Anonymous, nil
+	}
+	switch {
+	case u.IdentityTokenFile != "":
+		return identityTokenFile(u.IdentityTokenFile), nil
+	case u.CredentialHelper != "":
+		return credentialHelper{name: u.CredentialHelper, server: r.RegistryStr()}, nil
+	}
+	return &authn.Basic{Username: u.Username, Password: u.Password}, nil
+}
+
+// identityTokenFile reads an identity token from a file on every use.
+type identityTokenFile string
+
+func (f identityTokenFile) Authorization() (*authn.AuthConfig, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return &authn.AuthConfig{IdentityToken: strings.TrimSpace(string(data))}, nil
+}
+
+// credentialHelper runs docker-credential-<name> get as described in
+// https://github.com/docker/docker-credential-helpers.
+type credentialHelper struct {
+	name   string
+	server string
+}
+
+func (h credentialHelper) Authorization() (*authn.AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+h.name, "get")
+	cmd.Stdin = strings.NewReader(h.server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s: %v: %s", h.name, err, strings.TrimSpace(stderr.String()))
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s: %w", h.name, err)
+	}
+	// Identity tokens are stored with <token> as the user name.
+	if creds.Username == "<token>" {
+		return &authn.AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return &authn.AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
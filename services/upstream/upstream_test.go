@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/nduyphuong/reverse-registry/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportCachesTokens(t *testing.T) {
+	exchanges := 0
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			assert.Equal(t, "puller", user)
+			assert.Equal(t, "s3cret", pass)
+			assert.Equal(t, "repository:chainguard/nginx:pull", r.URL.Query().Get("scope"))
+			exchanges++
+			fmt.Fprintf(w, `{"token":"tok-%d","expires_in":300}`, exchanges)
+		default:
+			if r.Header.Get("Authorization") == "" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, registry.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+		}
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	u, err := New(Options{Upstreams: []config.Upstream{{Registry: host, Username: "puller", Password: "s3cret"}}})
+	assert.NoError(t, err)
+	assert.True(t, u.Configured(host))
+	assert.False(t, u.Configured("cgr.dev"))
+	c := u.(*client)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	repo, err := name.NewRepository(host+"/chainguard/nginx", name.Insecure)
+	assert.NoError(t, err)
+	get := func() string {
+		rt, err := u.Transport(context.Background(), repo, repo.Scope("pull"))
+		assert.NoError(t, err)
+		resp, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, registry.URL+"/v2/chainguard/nginx/tags/list", nil))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "Bearer tok-1", get())
+	assert.Equal(t, "Bearer tok-1", get())
+	assert.Equal(t, 1, exchanges)
+
+	// The token is renewed before it expires.
+	now = now.Add(290 * time.Second)
+	assert.Equal(t, "Bearer tok-2", get())
+	assert.Equal(t, 2, exchanges)
+}
+
+func TestKeychain(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("refresh-1\n"), 0o600))
+
+	helperDir := t.TempDir()
+	helper := "#!/bin/sh\nread server\necho \"{\\\"Username\\\":\\\"robot\\\",\\\"Secret\\\":\\\"for-$server\\\"}\"\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(helperDir, "docker-credential-fake"), []byte(helper), 0o755))
+	t.Setenv("PATH", helperDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	u, err := New(Options{Upstreams: []config.Upstream{
+		{Registry: "cgr.dev", Username: "puller", Password: "s3cret"},
+		{Registry: "ghcr.io", IdentityTokenFile: tokenFile},
+		{Registry: "quay.io", CredentialHelper: "fake"},
+	}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		image string
+		want  authn.AuthConfig
+	}{
+		{"cgr.dev/chainguard/nginx", authn.AuthConfig{Username: "puller", Password: "s3cret"}},
+		{"ghcr.io/org/app", authn.AuthConfig{IdentityToken: "refresh-1"}},
+		{"quay.io/org/app", authn.AuthConfig{Username: "robot", Password: "for-quay.io"}},
+	}
+	for _, tc := range cases {
+		repo, err := name.NewRepository(tc.image)
+		assert.NoError(t, err)
+		auth, err := u.Keychain().Resolve(repo)
+		assert.NoError(t, err)
+		got, err := auth.Authorization()
+		assert.NoError(t, err, tc.image)
+		assert.Equal(t, tc.want, *got, tc.image)
+	}
+
+	// The token file is read on every use so it can be rotated.
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("refresh-2"), 0o600))
+	repo, _ := name.NewRepository("ghcr.io/org/app")
+	auth, _ := u.Keychain().Resolve(repo)
+	got, err := auth.Authorization()
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-2", got.IdentityToken)
+}
+
+func TestNewRejectsAmbiguousUpstreams(t *testing.T) {
+	_, err := New(Options{Upstreams: []config.Upstream{{Registry: "cgr.dev", Username: "a", CredentialHelper: "gcr"}}})
+	assert.Error(t, err)
+
+	// Upstreams may only change settings and keep the docker config.
+	u, err := New(Options{Upstreams: []config.Upstream{{Registry: "cgr.dev", FollowRedirects: true}}})
+	assert.NoError(t, err)
+	assert.False(t, u.Configured("cgr.dev"))
+	assert.True(t, u.FollowRedirects("cgr.dev"))
+	assert.False(t, u.FollowRedirects("ghcr.io"))
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// Headers whose whole value is a credential.
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Registry-Auth",
+}
+
+// Query parameters that carry credentials, compared case insensitively.
+var defaultRedactedParams = []string{
+	"token",
+	"access_token",
+	"refresh_token",
+	"password",
+	"client_secret",
+	"sig",
+	"signature",
+	"x-amz-signature",
+	"x-amz-credential",
+	"x-amz-security-token",
+}
+
+// A bearer token in a header value, the trailing group keeps auth-params
+// like Bearer realm="..." from being taken for a token.
+var bearerToken = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*(\s*(,|$))`)
+
+// RedactionPolicy decides what is masked before headers and urls are logged.
+type RedactionPolicy struct {
+	headers map[string]bool
+	params  map[string]bool
+}
+
+// NewRedactionPolicy returns the default policy extended with extraHeaders.
+func NewRedactionPolicy(extraHeaders []string) *RedactionPolicy {
+	p := &RedactionPolicy{
+		headers: make(map[string]bool),
+		params:  make(map[string]bool),
+	}
+	for _, h := range append(defaultRedactedHeaders, extraHeaders...) {
+		p.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, q := range defaultRedactedParams {
+		p.params[q] = true
+	}
+	return p
+}
+
+var defaultPolicy = NewRedactionPolicy(nil)
+
+// Redact masks the headers of the default policy.
+func Redact(in http.Header) http.Header {
+	return defaultPolicy.Header(in)
+}
+
+// Header returns a copy of in with credentials masked. Bearer tokens are
+// also masked inside other headers, e.g. Www-Authenticate.
+func (p *RedactionPolicy) Header(in http.Header) http.Header {
+	h := in.Clone()
+	for k, vs := range h {
+		if p.headers[http.CanonicalHeaderKey(k)] {
+			for i := range vs {
+				vs[i] = redacted
+			}
+			continue
+		}
+		for i, v := range vs {
+			vs[i] = bearerToken.ReplaceAllString(v, "Bearer "+redacted+"$1")
+		}
+	}
+	return h
+}
+
+// URL returns u as a string with credential query parameters and user info
+// masked.
+func (p *RedactionPolicy) URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	out := *u
+	if out.User != nil {
+		out.User = url.User(redacted)
+	}
+	if out.RawQuery != "" {
+		q := out.Query()
+		for k := range q {
+			if p.params[strings.ToLower(k)] {
+				q.Set(k, redacted)
+			}
+		}
+		out.RawQuery = q.Encode()
+	}
+	return out.String()
+}
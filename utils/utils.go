@@ -2,18 +2,9 @@ package utils
 
 import (
 	"errors"
-	"net/http"
 	"strings"
 )
 
-func Redact(in http.Header) http.Header {
-	h := in.Clone()
-	if h.Get("Authorization") != "" {
-		h.Set("Authorization", "REDACTED")
-	}
-	return h
-}
-
 // SelectNotEmpty return 1 element if there is 1 empty element
 // SelectNotEmpty return 1 element if 2 element are equal
 // SelectNotEmpty return error otherwise